@@ -0,0 +1,360 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessionauth"
+	"github.com/martini-contrib/sessions"
+)
+
+var ACCOUNT_PAGE = "account"
+
+const (
+	// Deleted accounts are purged for good after this long. Until then
+	// they can't be used, but an admin can still look into abuse.
+	deletionGracePeriod = 7 * 24 * time.Hour
+
+	// Messages of deleted users show this as the sender.
+	deletedUserName = "deleted user"
+)
+
+// Exports are heavy, a couple an hour is plenty.
+var exportLimit = rateLimit{Rate: 1.0 / 1800, Burst: 2}
+
+func init() {
+	go purgeLoop()
+}
+
+// exportUser is the User record as it goes in an export, without the
+// secrets that only matter to the server.
+type exportUser struct {
+	Id         string            `json:"id"`
+	Email      string            `json:"email"`
+	Username   string            `json:"username,omitempty"`
+	Role       string            `json:"role,omitempty"`
+	Verified   bool              `json:"verified"`
+	TwoFactor  bool              `json:"two_factor"`
+	Identities map[string]string `json:"identities,omitempty"`
+	Bot        bool              `json:"bot,omitempty"`
+	OwnerID    string            `json:"owner_id,omitempty"`
+}
+
+type exportHub struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// writeExport writes a zip of everything we keep about u.
+func writeExport(u *User, w io.Writer) error {
+	z := zip.NewWriter(w)
+
+	writeJSON := func(name string, v interface{}) error {
+		f, err := z.Create(name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	err := writeJSON("user.json", exportUser{
+		Id:         u.Id,
+		Email:      u.Email,
+		Username:   u.Username,
+		Role:       u.Role,
+		Verified:   !u.Unverified,
+		TwoFactor:  u.TOTPEnabled,
+		Identities: u.Identities,
+		Bot:        u.Bot,
+		OwnerID:    u.OwnerID,
+	})
+	if err != nil {
+		return err
+	}
+
+	hubs := []exportHub{}
+	for hubID := range u.Hubs {
+		var hb hub
+		if err := hb.GetById(hubID); err != nil {
+			return err
+		}
+		hubs = append(hubs, exportHub{Id: hubID, Name: hb.HubName})
+	}
+	if err := writeJSON("hubs.json", hubs); err != nil {
+		return err
+	}
+
+	// one message per line, there can be lots
+	f, err := z.Create("messages.jsonl")
+	if err != nil {
+		return err
+	}
+	rows, err := r.Table("message").GetAllByIndex("from_id", u.Id).Run(dbSession)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for rows.Next() {
+		var m msg
+		if err := rows.Scan(&m); err != nil {
+			rows.Close()
+			return err
+		}
+		if err := enc.Encode(m); err != nil {
+			rows.Close()
+			return err
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	attachments, err := userAttachments(u.Id)
+	if err != nil {
+		return err
+	}
+	refs := make([]attachmentRef, 0, len(attachments))
+	for _, a := range attachments {
+		refs = append(refs, a.ref())
+		if blobs == nil {
+			continue
+		}
+		blob, err := blobs.Get(a.blobKey())
+		if err != nil {
+			fmt.Println("Error reading blob for export.", err)
+			continue
+		}
+		f, err := z.Create(path.Join("attachments", a.Id+"-"+path.Base(a.Name)))
+		if err == nil {
+			_, err = io.Copy(f, blob)
+		}
+		blob.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := writeJSON("attachments.json", refs); err != nil {
+		return err
+	}
+
+	saved, err := listBookmarks(u)
+	if err != nil {
+		return err
+	}
+	if err := writeJSON("bookmarks.json", saved); err != nil {
+		return err
+	}
+
+	return z.Close()
+}
+
+// userAttachments returns every attachment u uploaded.
+func userAttachments(userID string) ([]attachment, error) {
+	rows, err := r.Table("attachment").GetAllByIndex("owner_id", userID).Run(dbSession)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []attachment{}
+	for rows.Next() {
+		var a attachment
+		if err := rows.Scan(&a); err != nil {
+			return nil, err
+		}
+		list = append(list, a)
+	}
+	return list, rows.Err()
+}
+
+// deleteAccount disables a user right away and schedules the purge.
+// Their messages stay in the hubs, but without their name on them.
+func deleteAccount(u *User) error {
+	now := time.Now()
+	_, err := r.Table("user").Get(u.Id).Update(map[string]interface{}{
+		"deleted_at":  now,
+		"purge_after": now.Add(deletionGracePeriod),
+	}).RunWrite(dbSession)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.Table("user").Get(u.Id).Replace(r.Row.Without("hubs")).RunWrite(dbSession)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.Table("message").GetAllByIndex("from_id", u.Id).Update(map[string]interface{}{
+		"from":    deletedUserName,
+		"from_id": "",
+	}).RunWrite(dbSession)
+	if err != nil {
+		return err
+	}
+
+	// votes still count, without their name on them
+	_, err = r.Table("message").Filter(r.Row.Field("poll").Field("votes").HasFields(u.Id)).Update(map[string]interface{}{
+		"poll": map[string]interface{}{"votes": map[string]interface{}{u.Id: map[string]string{"name": deletedUserName}}},
+	}).RunWrite(dbSession)
+	if err != nil {
+		return err
+	}
+
+	// no more hub or workspace admin rights
+	_, err = r.Table("hub").Filter(r.Row.Field("admins").HasFields(u.Id)).
+		Replace(r.Row.Without(map[string]interface{}{"admins": map[string]bool{u.Id: true}})).
+		RunWrite(dbSession)
+	if err != nil {
+		return err
+	}
+	if err := dropWorkspaceAdmin(u.WorkspaceID, u.Id); err != nil {
+		return err
+	}
+
+	r.Table("api_token").GetAllByIndex("user_id", u.Id).Update(map[string]interface{}{"revoked": true}).RunWrite(dbSession)
+	r.Table("reset_token").GetAllByIndex("user_id", u.Id).Delete().RunWrite(dbSession)
+	r.Table("scheduled").GetAllByIndex("owner_id", u.Id).Delete().RunWrite(dbSession)
+
+	// out of every hub and off every device
+	if c := h.getConn(u.Id); c != nil {
+		h.leaveAll(c)
+	}
+	if err := revokeUserSessions(u.Id, "", "account deleted"); err != nil {
+		fmt.Println("Error revoking sessions of deleted user.", err)
+	}
+	disconnectUser(u.Id, "account deleted")
+
+	// bots go with their owner
+	bots, err := listBots(u.Id)
+	if err != nil {
+		return err
+	}
+	for i := range bots {
+		if bots[i].DeletedAt.IsZero() {
+			if err := deleteAccount(&bots[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// purgeUser removes what's left of a deleted user.
+func purgeUser(userID string) error {
+	attachments, err := userAttachments(userID)
+	if err != nil {
+		return err
+	}
+	for _, a := range attachments {
+		if blobs != nil {
+			blobs.Delete(a.blobKey())
+			blobs.Delete(a.thumbKey())
+		}
+	}
+	if _, err := r.Table("attachment").GetAllByIndex("owner_id", userID).Delete().RunWrite(dbSession); err != nil {
+		return err
+	}
+	r.Table("api_token").GetAllByIndex("user_id", userID).Delete().RunWrite(dbSession)
+	r.Table("bookmark").GetAllByIndex("user_id", userID).Delete().RunWrite(dbSession)
+	r.Table("scheduled").GetAllByIndex("owner_id", userID).Delete().RunWrite(dbSession)
+	// the audit log is append-only, it keeps what happened to the account
+
+	_, err = r.Table("user").Get(userID).Delete().RunWrite(dbSession)
+	return err
+}
+
+// purgeLoop purges deleted users once their grace period is over.
+func purgeLoop() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		rows, err := r.Table("user").Filter(r.Row.Field("purge_after").Default(nil).Ne(nil).
+			And(r.Row.Field("purge_after").Default(nil).Lt(time.Now()))).
+			Field("id").Run(dbSession)
+		if err != nil {
+			fmt.Println("Error finding users to purge.", err)
+			continue
+		}
+		var ids []string
+		for rows.Next() {
+			var id string
+			if rows.Scan(&id) == nil {
+				ids = append(ids, id)
+			}
+		}
+		rows.Close()
+
+		for _, id := range ids {
+			if err := purgeUser(id); err != nil {
+				fmt.Println("Error purging user.", id, err)
+			} else {
+				fmt.Println("Purged deleted user", id)
+				logAudit(nil, nil, auditAccountPurge, "user", id, nil)
+			}
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+// HANDLERS
+//-----------------------------------------------------------------------------
+
+func getAccountPage(session sessions.Session, user sessionauth.User, rend render.Render) {
+	rend.HTML(200, ACCOUNT_PAGE, page(session, map[string]interface{}{"User": user.(*User)}))
+}
+
+// getExportHandler - GET /account/export, a zip of the user's data.
+func getExportHandler(session sessions.Session, user sessionauth.User, rend render.Render, w http.ResponseWriter) {
+	currUser := user.(*User)
+
+	if ok, _ := limiter.take("export:"+currUser.Id, exportLimit); !ok {
+		session.AddFlash("You just made an export, try again later.")
+		rend.Redirect("/account")
+		return
+	}
+
+	name := fmt.Sprintf("chatgo-export-%s.zip", time.Now().Format("2006-01-02"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	if err := writeExport(currUser, w); err != nil {
+		// too late for an error page, the download will just be broken
+		fmt.Println("Error writing export.", err)
+	}
+}
+
+// postDeleteAccountHandler - POST /account/delete, the user has to type
+// their email to confirm.
+func postDeleteAccountHandler(session sessions.Session, user sessionauth.User, rend render.Render, req *http.Request) {
+	currUser := user.(*User)
+
+	if !strings.EqualFold(strings.TrimSpace(req.FormValue("confirm")), currUser.Email) {
+		session.AddFlash("Type your email to confirm deleting your account.")
+		rend.Redirect("/account")
+		return
+	}
+
+	if err := deleteAccount(currUser); err != nil {
+		fmt.Println("Error deleting account.", err)
+		session.AddFlash("Couldn't delete your account, try again.")
+		rend.Redirect("/account")
+		return
+	}
+
+	fmt.Println("Account deleted:", currUser.Id)
+	logAudit(req, currUser, auditAccountDelete, "user", currUser.Id, nil)
+	sessionauth.Logout(session, user)
+	session.AddFlash("Your account is deleted.")
+	rend.Redirect(INDEX_PAGE)
+}
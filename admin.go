@@ -0,0 +1,511 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.google.com/p/go.crypto/bcrypt"
+	r "github.com/dancannon/gorethink"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessionauth"
+	"github.com/martini-contrib/sessions"
+)
+
+var (
+	ADMIN_PAGE     = "admin"
+	ADMIN_HUB_PAGE = "adminhub"
+)
+
+// How many users a search returns at most.
+const adminPageSize = 50
+
+// adminUser is a user as admins see it, without password hashes and secrets.
+type adminUser struct {
+	Id          string    `json:"id"`
+	Email       string    `json:"email"`
+	Username    string    `json:"username,omitempty"`
+	Role        string    `json:"role"`
+	Verified    bool      `json:"verified"`
+	TwoFactor   bool      `json:"two_factor"`
+	Bot         bool      `json:"bot,omitempty"`
+	OwnerID     string    `json:"owner_id,omitempty"`
+	Disabled    bool      `json:"disabled"`
+	Deleted     bool      `json:"deleted"`
+	LockedUntil time.Time `json:"locked_until,omitempty"`
+	Hubs        int       `json:"hubs"`
+	Connected   bool      `json:"connected"` // to this node
+	WorkspaceID string    `json:"workspace_id,omitempty"`
+}
+
+func newAdminUser(u *User) adminUser {
+	role := u.Role
+	if role == "" {
+		role = roleUser
+	}
+	a := adminUser{
+		Id:        u.Id,
+		Email:     u.Email,
+		Username:  u.Username,
+		Role:      role,
+		Verified:  !u.Unverified,
+		TwoFactor: u.TOTPEnabled,
+		Bot:       u.Bot,
+		OwnerID:   u.OwnerID,
+		Disabled:  u.Disabled,
+		Deleted:   !u.DeletedAt.IsZero(),
+		Hubs:      len(u.Hubs),
+		Connected: h.getConn(u.Id) != nil,
+
+		WorkspaceID: u.WorkspaceID,
+	}
+	if time.Now().Before(u.LockedUntil) {
+		a.LockedUntil = u.LockedUntil
+	}
+	return a
+}
+
+// adminHub is a hub with how many people are in it right now, on any node.
+type adminHub struct {
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	Admins   int    `json:"admins"`
+	Archived bool   `json:"archived"`
+	Guests   bool   `json:"guest_access"`
+	Members  int    `json:"members"`
+
+	WorkspaceID string `json:"workspace_id,omitempty"`
+}
+
+func newAdminHub(hb *hub) adminHub {
+	return adminHub{
+		Id:       hb.HubID,
+		Name:     hb.HubName,
+		Admins:   len(hb.HubAdmins),
+		Archived: hb.Archived,
+		Guests:   hb.GuestAccess,
+		Members:  len(h.presence(hb.HubID)),
+
+		WorkspaceID: hb.WorkspaceID,
+	}
+}
+
+// adminConn is a connection in a hub. Only connections on this node have
+// the details, the others just say who they are.
+type adminConn struct {
+	UserID     string `json:"user_id"`
+	UserName   string `json:"user_name"`
+	Role       string `json:"role,omitempty"`
+	Token      bool   `json:"token,omitempty"` // opened with an API token
+	ReadOnly   bool   `json:"read_only,omitempty"`
+	ListenOnly bool   `json:"listen_only,omitempty"`
+	Remote     bool   `json:"remote,omitempty"`
+}
+
+// hubConns lists everyone connected to a hub.
+func hubConns(hubID string) []adminConn {
+	conns := []adminConn{}
+	for _, c := range h.getUsersFromHub(hubID) {
+		conns = append(conns, adminConn{
+			UserID:     c.userID,
+			UserName:   c.userName,
+			Role:       c.role,
+			Token:      c.sessionID == "",
+			ReadOnly:   c.readOnly,
+			ListenOnly: c.listenOnly,
+		})
+	}
+	for _, m := range cl.remoteMembers(hubID) {
+		conns = append(conns, adminConn{UserID: m.UserID, UserName: m.UserName, Remote: true})
+	}
+	return conns
+}
+
+// searchUsers finds users whose email or username contains q, by email.
+func searchUsers(q string, offset int) ([]adminUser, error) {
+	query := r.Table("user")
+	if q = strings.TrimSpace(q); q != "" {
+		re := regexp.QuoteMeta(strings.ToLower(q))
+		query = query.Filter(r.Row.Field("email").Default("").Downcase().Match(re).
+			Or(r.Row.Field("username").Default("").Downcase().Match(re)))
+	}
+	rows, err := query.OrderBy("email").Skip(offset).Limit(adminPageSize).Run(dbSession)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []adminUser{}
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u); err != nil {
+			return nil, err
+		}
+		users = append(users, newAdminUser(&u))
+	}
+	return users, rows.Err()
+}
+
+// listHubs returns every hub in the DB, by name.
+func listHubs() ([]adminHub, error) {
+	rows, err := r.Table("hub").OrderBy("name").Run(dbSession)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hubs := []adminHub{}
+	for rows.Next() {
+		var hb hub
+		if err := rows.Scan(&hb); err != nil {
+			return nil, err
+		}
+		hubs = append(hubs, newAdminHub(&hb))
+	}
+	return hubs, rows.Err()
+}
+
+// signOutEverywhere ends every session and websocket of a user.
+func signOutEverywhere(userID, reason string) error {
+	if err := revokeUserSessions(userID, "", reason); err != nil {
+		return err
+	}
+	disconnectUser(userID, reason)
+	return nil
+}
+
+// requireAdmin stops the request unless the user is an admin.
+// Goes after sessionauth.LoginRequired.
+func requireAdmin(user sessionauth.User, w http.ResponseWriter) {
+	if user.(*User).Role != roleAdmin {
+		http.Error(w, "admins only", http.StatusForbidden)
+	}
+}
+
+// adminReply answers an admin action. Forms from the admin pages get a
+// flash and go back where they came from, API calls get JSON.
+func adminReply(session sessions.Session, req *http.Request, rend render.Render, status int, text string) {
+	if strings.Contains(req.Header.Get("Accept"), "text/html") {
+		session.AddFlash(text)
+		back := "/admin"
+		if ref, err := url.Parse(req.Referer()); err == nil && strings.HasPrefix(ref.Path, "/admin") {
+			back = ref.RequestURI()
+		}
+		rend.Redirect(back)
+		return
+	}
+	if status >= 400 {
+		rend.JSON(status, map[string]string{"error": text})
+		return
+	}
+	rend.JSON(status, map[string]string{"status": "ok", "message": text})
+}
+
+// adminTarget loads the user an admin action is about.
+func adminTarget(params martini.Params) (*User, bool) {
+	var u User
+	if err := u.GetById(params["id"]); err != nil || u.Id == "" {
+		return nil, false
+	}
+	return &u, true
+}
+
+//-----------------------------------------------------------------------------
+// HANDLERS
+//-----------------------------------------------------------------------------
+
+// getAdminPage - GET /admin, users and hubs.
+func getAdminPage(session sessions.Session, rend render.Render, req *http.Request) {
+	q := req.URL.Query().Get("q")
+	offset, _ := strconv.Atoi(req.URL.Query().Get("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+
+	users, err := searchUsers(q, offset)
+	if err != nil {
+		fmt.Println("Error searching users.", err)
+	}
+	hubs, err := listHubs()
+	if err != nil {
+		fmt.Println("Error listing hubs.", err)
+	}
+
+	data := map[string]interface{}{
+		"Query": q,
+		"Users": users,
+		"Hubs":  hubs,
+	}
+	if offset > 0 {
+		prev := offset - adminPageSize
+		if prev < 0 {
+			prev = 0
+		}
+		data["Prev"] = "/admin?" + url.Values{"q": {q}, "offset": {strconv.Itoa(prev)}}.Encode()
+	}
+	if len(users) == adminPageSize {
+		data["Next"] = "/admin?" + url.Values{"q": {q}, "offset": {strconv.Itoa(offset + adminPageSize)}}.Encode()
+	}
+	rend.HTML(200, ADMIN_PAGE, page(session, data))
+}
+
+// getAdminHubPage - GET /admin/hubs/:id, who's in a hub.
+func getAdminHubPage(params martini.Params, session sessions.Session, rend render.Render) {
+	hb, err := h.findHub(params["id"])
+	if err != nil {
+		session.AddFlash("No such hub.")
+		rend.Redirect("/admin")
+		return
+	}
+	rend.HTML(200, ADMIN_HUB_PAGE, page(session, map[string]interface{}{
+		"Hub":   newAdminHub(hb),
+		"Conns": hubConns(hb.HubID),
+	}))
+}
+
+// getAdminUsersHandler - GET /api/admin/users?q=&offset=
+func getAdminUsersHandler(rend render.Render, req *http.Request) {
+	offset, _ := strconv.Atoi(req.URL.Query().Get("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+	users, err := searchUsers(req.URL.Query().Get("q"), offset)
+	if err != nil {
+		fmt.Println("Error searching users.", err)
+		rend.JSON(500, map[string]string{"error": "error searching users"})
+		return
+	}
+	rend.JSON(200, users)
+}
+
+// getAdminUserHandler - GET /api/admin/users/:id
+func getAdminUserHandler(params martini.Params, rend render.Render) {
+	u, ok := adminTarget(params)
+	if !ok {
+		rend.JSON(404, map[string]string{"error": "no such user"})
+		return
+	}
+	rend.JSON(200, newAdminUser(u))
+}
+
+// getAdminHubsHandler - GET /api/admin/hubs
+func getAdminHubsHandler(rend render.Render) {
+	hubs, err := listHubs()
+	if err != nil {
+		fmt.Println("Error listing hubs.", err)
+		rend.JSON(500, map[string]string{"error": "error listing hubs"})
+		return
+	}
+	rend.JSON(200, hubs)
+}
+
+// getAdminHubHandler - GET /api/admin/hubs/:id, the hub and its connections.
+func getAdminHubHandler(params martini.Params, rend render.Render) {
+	hb, err := h.findHub(params["id"])
+	if err != nil {
+		rend.JSON(404, map[string]string{"error": "no such hub"})
+		return
+	}
+	rend.JSON(200, map[string]interface{}{
+		"hub":         newAdminHub(hb),
+		"connections": hubConns(hb.HubID),
+	})
+}
+
+// postDisableUserHandler - POST /admin/users/:id/disable and /enable.
+// Disabling signs the user out everywhere too.
+func postDisableUserHandler(disabled bool) martini.Handler {
+	return func(params martini.Params, session sessions.Session, user sessionauth.User, rend render.Render, req *http.Request) {
+		u, ok := adminTarget(params)
+		if !ok {
+			adminReply(session, req, rend, 404, "No such user.")
+			return
+		}
+		if disabled && u.Id == user.(*User).Id {
+			adminReply(session, req, rend, 400, "You can't disable yourself.")
+			return
+		}
+
+		_, err := r.Table("user").Get(u.Id).Update(map[string]interface{}{"disabled": disabled}).RunWrite(dbSession)
+		if err == nil && disabled {
+			err = signOutEverywhere(u.Id, "account disabled")
+		}
+		if err != nil {
+			fmt.Println("Error disabling user.", err)
+			adminReply(session, req, rend, 500, "Couldn't change the account, try again.")
+			return
+		}
+
+		fmt.Println("User", u.Id, "disabled:", disabled, "by admin", user.(*User).Id)
+		action := auditUserEnable
+		if disabled {
+			action = auditUserDisable
+		}
+		logAudit(req, user.(*User), action, "user", u.Id, nil)
+		if disabled {
+			adminReply(session, req, rend, 200, u.Email+" is disabled.")
+		} else {
+			adminReply(session, req, rend, 200, u.Email+" is enabled.")
+		}
+	}
+}
+
+// postForceLogoutHandler - POST /admin/users/:id/logout
+func postForceLogoutHandler(params martini.Params, session sessions.Session, user sessionauth.User, rend render.Render, req *http.Request) {
+	u, ok := adminTarget(params)
+	if !ok {
+		adminReply(session, req, rend, 404, "No such user.")
+		return
+	}
+	if err := signOutEverywhere(u.Id, "signed out by an admin"); err != nil {
+		fmt.Println("Error signing user out.", err)
+		adminReply(session, req, rend, 500, "Couldn't sign the user out, try again.")
+		return
+	}
+	fmt.Println("User", u.Id, "signed out by admin", user.(*User).Id)
+	logAudit(req, user.(*User), auditUserKick, "user", u.Id, nil)
+	adminReply(session, req, rend, 200, u.Email+" is signed out everywhere.")
+}
+
+// postAdminResetPasswordHandler - POST /admin/users/:id/reset-password.
+// The old password stops working right away and the user gets a reset link.
+func postAdminResetPasswordHandler(params martini.Params, session sessions.Session, user sessionauth.User, rend render.Render, req *http.Request) {
+	u, ok := adminTarget(params)
+	if !ok || u.Bot {
+		adminReply(session, req, rend, 404, "No such user.")
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(randomID(32)), bcrypt.DefaultCost)
+	if err == nil {
+		err = setPassword(u.Id, hash, "")
+	}
+	if err != nil {
+		fmt.Println("Error resetting password.", err)
+		adminReply(session, req, rend, 500, "Couldn't reset the password, try again.")
+		return
+	}
+
+	logAudit(req, user.(*User), auditAdminPassword, "user", u.Id, nil)
+
+	body := "An admin reset the password of your ChatGo account, so you've been signed out.\n\n" +
+		"To choose a new password, open this link within an hour:\n\n%s\n\n" +
+		"If the link expired, ask for a new one at " + baseURL + "/forgot\n"
+	if err := sendResetMail(u, body); err != nil {
+		fmt.Println("Error sending reset mail.", err)
+		adminReply(session, req, rend, 500, "The password was reset, but the email to the user failed.")
+		return
+	}
+
+	fmt.Println("Password of", u.Id, "reset by admin", user.(*User).Id)
+	adminReply(session, req, rend, 200, "Password reset, "+u.Email+" got a link to choose a new one.")
+}
+
+// postResetTwoFactorHandler - POST /admin/users/:id/2fa/reset, for users
+// who lost both their authenticator and their recovery codes.
+func postResetTwoFactorHandler(params martini.Params, session sessions.Session, user sessionauth.User, rend render.Render, req *http.Request) {
+	u, ok := adminTarget(params)
+	if !ok {
+		adminReply(session, req, rend, 404, "No such user.")
+		return
+	}
+
+	if err := resetTwoFactor(u.Id); err != nil {
+		fmt.Println("Error resetting 2FA.", err)
+		adminReply(session, req, rend, 500, "Error resetting 2FA.")
+		return
+	}
+
+	fmt.Println("2FA reset for", u.Id, "by admin", user.(*User).Id)
+	logAudit(req, user.(*User), auditAdminTwoFactor, "user", u.Id, nil)
+	adminReply(session, req, rend, 200, "2FA is off for "+u.Email+".")
+}
+
+// postArchiveHubHandler - POST /admin/hubs/:id/archive and /unarchive.
+// The hub feed tells every node.
+func postArchiveHubHandler(archived bool) martini.Handler {
+	return func(params martini.Params, session sessions.Session, user sessionauth.User, rend render.Render, req *http.Request) {
+		res, err := r.Table("hub").Get(params["id"]).Update(map[string]interface{}{"archived": archived}).RunWrite(dbSession)
+		if err != nil {
+			fmt.Println("Error archiving hub.", err)
+			adminReply(session, req, rend, 500, "Couldn't change the hub, try again.")
+			return
+		}
+		if res.Replaced == 0 && res.Unchanged == 0 {
+			adminReply(session, req, rend, 404, "No such hub.")
+			return
+		}
+
+		fmt.Println("Hub", params["id"], "archived:", archived, "by admin", user.(*User).Id)
+		action := auditHubUnarchive
+		if archived {
+			action = auditHubArchive
+		}
+		logAudit(req, user.(*User), action, "hub", params["id"], nil)
+		if archived {
+			adminReply(session, req, rend, 200, "Hub archived.")
+		} else {
+			adminReply(session, req, rend, 200, "Hub unarchived.")
+		}
+	}
+}
+
+// postGuestAccessHandler - POST /admin/hubs/:id/guests and /no-guests.
+// Guests in the hub are dropped when it's closed to them.
+func postGuestAccessHandler(open bool) martini.Handler {
+	return func(params martini.Params, session sessions.Session, user sessionauth.User, rend render.Render, req *http.Request) {
+		res, err := r.Table("hub").Get(params["id"]).Update(map[string]interface{}{"guest_access": open}).RunWrite(dbSession)
+		if err != nil {
+			fmt.Println("Error changing guest access.", err)
+			adminReply(session, req, rend, 500, "Couldn't change the hub, try again.")
+			return
+		}
+		if res.Replaced == 0 && res.Unchanged == 0 {
+			adminReply(session, req, rend, 404, "No such hub.")
+			return
+		}
+
+		fmt.Println("Hub", params["id"], "guest access:", open, "by admin", user.(*User).Id)
+		logAudit(req, user.(*User), auditHubGuests, "hub", params["id"], map[string]string{"open": fmt.Sprint(open)})
+		if open {
+			adminReply(session, req, rend, 200, "Guests can join at "+baseURL+"/guest/"+params["id"])
+		} else {
+			adminReply(session, req, rend, 200, "Hub closed to guests.")
+		}
+	}
+}
+
+// postCloseHubHandler - POST /admin/hubs/:id/close, deletes the hub. Its
+// members are told it's gone by the hub feed, the history stays.
+func postCloseHubHandler(params martini.Params, session sessions.Session, user sessionauth.User, rend render.Render, req *http.Request) {
+	var hb hub
+	if err := hb.GetById(params["id"]); err != nil || hb.HubID == "" {
+		adminReply(session, req, rend, 404, "No such hub.")
+		return
+	}
+	if hb.HubName == "default" {
+		adminReply(session, req, rend, 400, "The default hub can't be closed, archive it instead.")
+		return
+	}
+
+	if _, err := r.Table("hub").Get(hb.HubID).Delete().RunWrite(dbSession); err != nil {
+		fmt.Println("Error closing hub.", err)
+		adminReply(session, req, rend, 500, "Couldn't close the hub, try again.")
+		return
+	}
+
+	fmt.Println("Hub", hb.HubID, "closed by admin", user.(*User).Id)
+	logAudit(req, user.(*User), auditHubDelete, "hub", hb.HubID, map[string]string{"name": hb.HubName})
+	if strings.Contains(req.Header.Get("Accept"), "text/html") {
+		// the hub's page is gone, don't go back to it
+		session.AddFlash("Hub " + hb.HubName + " closed.")
+		rend.Redirect("/admin")
+		return
+	}
+	adminReply(session, req, rend, 200, "Hub "+hb.HubName+" closed.")
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"code.google.com/p/go.crypto/bcrypt"
+	r "github.com/dancannon/gorethink"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessionauth"
+	"github.com/martini-contrib/sessions"
+)
+
+var TOKENS_PAGE = "tokens"
+
+const (
+	// What a token is allowed to do. Cookie sessions can do everything.
+	scopeRead  = "read"  // GET endpoints and listening on /ws
+	scopeWrite = "write" // posting messages, over REST or /ws
+	scopeAdmin = "admin" // the admin API, only works for admins' tokens
+
+	// Tokens start with this so they're easy to spot, eg. in leaked logs.
+	apiTokenPrefix = "cgo_"
+
+	// last_used is only written this often per token.
+	tokenTouchInterval = time.Minute
+)
+
+var allScopes = []string{scopeRead, scopeWrite, scopeAdmin}
+
+// apiToken lets scripts and bots act as a user without a browser session.
+// Like reset tokens, only the hash is stored.
+type apiToken struct {
+	Id       string    `gorethink:"id"` // sha256 of the token
+	UserID   string    `gorethink:"user_id"`
+	Name     string    `gorethink:"name"`
+	Hint     string    `gorethink:"hint"` // start of the token, to tell them apart
+	Scopes   []string  `gorethink:"scopes"`
+	Created  time.Time `gorethink:"created"`
+	LastUsed time.Time `gorethink:"last_used"`
+	Revoked  bool      `gorethink:"revoked"`
+}
+
+func (t *apiToken) has(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// newAPIToken stores a new token for the user and returns it.
+// Unknown scopes are dropped.
+func newAPIToken(userID, name string, scopes []string) (string, error) {
+	var valid []string
+	for _, s := range scopes {
+		for _, known := range allScopes {
+			if s == known {
+				valid = append(valid, s)
+			}
+		}
+	}
+	if len(valid) == 0 {
+		return "", errors.New("token needs at least one scope")
+	}
+	if name == "" {
+		name = "token"
+	}
+
+	token := apiTokenPrefix + randomID(32)
+	t := apiToken{
+		Id:      hashToken(token),
+		UserID:  userID,
+		Name:    name,
+		Hint:    token[:len(apiTokenPrefix)+6],
+		Scopes:  valid,
+		Created: time.Now(),
+	}
+	if _, err := r.Table("api_token").Insert(t).RunWrite(dbSession); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// getAPIToken looks up a token that hasn't been revoked.
+func getAPIToken(token string) (*apiToken, error) {
+	var t apiToken
+	row, err := r.Table("api_token").Get(hashToken(token)).RunRow(dbSession)
+	if err != nil {
+		return nil, err
+	}
+	if row.IsNil() {
+		return nil, errors.New("unknown API token")
+	}
+	if err := row.Scan(&t); err != nil {
+		return nil, err
+	}
+	if t.Revoked {
+		return nil, errors.New("API token revoked")
+	}
+	return &t, nil
+}
+
+// listAPITokens returns the tokens of a user, newest first.
+func listAPITokens(userID string) ([]apiToken, error) {
+	rows, err := r.Table("api_token").GetAllByIndex("user_id", userID).
+		OrderBy(r.Desc("created")).Run(dbSession)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []apiToken{}
+	for rows.Next() {
+		var t apiToken
+		if err := rows.Scan(&t); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// bearerToken returns the API token sent with a request, if any.
+// Websocket clients that can't set headers use ?access_token=.
+func bearerToken(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):])
+	}
+	return req.URL.Query().Get("access_token")
+}
+
+// apiAuth lets a route be used with an API token instead of a cookie, if
+// the token has scope. Goes before sessionauth.LoginRequired, and maps the
+// *apiToken, nil for cookie sessions. Routes without it ignore tokens, so a
+// token can't eg. change the password.
+func apiAuth(scope string) martini.Handler {
+	return func(c martini.Context, w http.ResponseWriter, req *http.Request) {
+		var t *apiToken
+
+		if token := bearerToken(req); token != "" {
+			var err error
+			t, err = getAPIToken(token)
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "invalid API token", http.StatusUnauthorized)
+				return
+			}
+			if !t.has(scope) {
+				http.Error(w, "token is missing the "+scope+" scope", http.StatusForbidden)
+				return
+			}
+
+			u := &User{}
+			if err := u.GetById(t.UserID); err != nil || u.Id == "" || loginBlocked(u) != nil {
+				http.Error(w, "invalid API token", http.StatusUnauthorized)
+				return
+			}
+			u.Login()
+			c.MapTo(u, (*sessionauth.User)(nil))
+
+			if time.Since(t.LastUsed) > tokenTouchInterval {
+				go r.Table("api_token").Get(t.Id).Update(map[string]interface{}{"last_used": time.Now()}).RunWrite(dbSession)
+			}
+		}
+
+		c.Map(t)
+	}
+}
+
+// newBot makes a bot account owned by ownerID. Bots have no email or
+// usable password, they only sign in with API tokens.
+func newBot(owner *User, name string) (*User, error) {
+	if name == "" {
+		return nil, errors.New("bots need a name")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(randomID(32)), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	bot := User{
+		Password: string(hash),
+		Username: name,
+		Role:     roleUser,
+		Bot:      true,
+		OwnerID:  owner.Id,
+
+		WorkspaceID: owner.WorkspaceID,
+	}
+	res, err := r.Table("user").Insert(bot).RunWrite(dbSession)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.GeneratedKeys) == 0 {
+		return nil, errors.New("no ID for new bot")
+	}
+	bot.Id = res.GeneratedKeys[0]
+	return &bot, nil
+}
+
+// listBots returns the bots a user owns.
+func listBots(ownerID string) ([]User, error) {
+	rows, err := r.Table("user").GetAllByIndex("owner_id", ownerID).Run(dbSession)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bots := []User{}
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u); err != nil {
+			return nil, err
+		}
+		bots = append(bots, u)
+	}
+	return bots, rows.Err()
+}
+
+// ownsToken tells if userID can manage t, their own or one of their bots'.
+func ownsToken(userID string, t *apiToken) bool {
+	if t.UserID == userID {
+		return true
+	}
+	var owner User
+	if err := owner.GetById(t.UserID); err != nil {
+		return false
+	}
+	return owner.Bot && owner.OwnerID == userID
+}
+
+//-----------------------------------------------------------------------------
+// HANDLERS
+//-----------------------------------------------------------------------------
+
+// renderTokensPage shows the user's tokens and bots. newToken is only ever
+// shown right after it's made.
+func renderTokensPage(session sessions.Session, currUser *User, newToken string, rend render.Render) {
+	tokens, err := listAPITokens(currUser.Id)
+	if err != nil {
+		fmt.Println("Error listing tokens.", err)
+	}
+
+	type botInfo struct {
+		User
+		Tokens []apiToken
+	}
+	var bots []botInfo
+	botUsers, err := listBots(currUser.Id)
+	if err != nil {
+		fmt.Println("Error listing bots.", err)
+	}
+	for _, b := range botUsers {
+		botTokens, _ := listAPITokens(b.Id)
+		bots = append(bots, botInfo{User: b, Tokens: botTokens})
+	}
+
+	rend.HTML(200, TOKENS_PAGE, page(session, map[string]interface{}{
+		"Tokens":   tokens,
+		"Bots":     bots,
+		"Scopes":   allScopes,
+		"NewToken": newToken,
+	}))
+}
+
+func getTokensPage(session sessions.Session, user sessionauth.User, rend render.Render) {
+	renderTokensPage(session, user.(*User), "", rend)
+}
+
+// postTokenHandler - POST /tokens, or /bots/:id/tokens for a bot.
+func postTokenHandler(params martini.Params, session sessions.Session, user sessionauth.User, rend render.Render, req *http.Request) {
+	currUser := user.(*User)
+
+	userID := currUser.Id
+	if botID := params["id"]; botID != "" {
+		var bot User
+		if err := bot.GetById(botID); err != nil || !bot.Bot || bot.OwnerID != currUser.Id {
+			rend.Redirect("/tokens")
+			return
+		}
+		userID = bot.Id
+	}
+
+	req.ParseForm()
+	token, err := newAPIToken(userID, req.FormValue("name"), req.Form["scope"])
+	if err != nil {
+		fmt.Println("Error creating token.", err)
+		session.AddFlash("Pick at least one scope for the token.")
+		rend.Redirect("/tokens")
+		return
+	}
+	logAudit(req, currUser, auditTokenCreate, "user", userID, map[string]string{
+		"hint":   token[:len(apiTokenPrefix)+6],
+		"scopes": strings.Join(req.Form["scope"], " "),
+	})
+	renderTokensPage(session, currUser, token, rend)
+}
+
+// postRevokeTokenHandler - POST /tokens/:id/revoke
+func postRevokeTokenHandler(params martini.Params, user sessionauth.User, rend render.Render, req *http.Request) {
+	currUser := user.(*User)
+
+	var target apiToken
+	row, err := r.Table("api_token").Get(params["id"]).RunRow(dbSession)
+	if err == nil && !row.IsNil() && row.Scan(&target) == nil && ownsToken(currUser.Id, &target) {
+		_, err = r.Table("api_token").Get(target.Id).Update(map[string]interface{}{"revoked": true}).RunWrite(dbSession)
+		if err != nil {
+			fmt.Println("Error revoking token.", err)
+		} else {
+			// websockets opened with it shouldn't outlive it, the owner's
+			// browser session has nothing to do with it
+			disconnectToken(target.UserID, target.Id, "token revoked")
+			logAudit(req, currUser, auditTokenRevoke, "user", target.UserID, map[string]string{"hint": target.Hint})
+		}
+	}
+	rend.Redirect("/tokens")
+}
+
+// postBotHandler - POST /bots, makes a new bot.
+func postBotHandler(session sessions.Session, user sessionauth.User, rend render.Render, req *http.Request) {
+	currUser := user.(*User)
+	if currUser.Bot || currUser.Unverified {
+		rend.Redirect("/tokens")
+		return
+	}
+	name := req.FormValue("name")
+	if problem := validateUsername(name, ""); problem != "" {
+		session.AddFlash(problem)
+		rend.Redirect("/tokens")
+		return
+	}
+	if bot, err := newBot(currUser, name); err != nil {
+		fmt.Println("Error creating bot.", err)
+	} else {
+		logAudit(req, currUser, auditBotCreate, "user", bot.Id, map[string]string{"name": name})
+	}
+	rend.Redirect("/tokens")
+}
+
+// postHubMessageHandler - POST /hub/:id/messages, lets scripts and bots
+// post without a websocket. Takes JSON like {"body": "hi"}.
+func postHubMessageHandler(params martini.Params, user sessionauth.User, rend render.Render, req *http.Request) {
+	currUser := user.(*User)
+	if currUser.Unverified {
+		rend.JSON(403, map[string]string{"error": "verify your email first"})
+		return
+	}
+
+	// same size cap as a websocket message, see maxMessageSize
+	var in struct {
+		Body        string          `json:"body"`
+		Attachments []attachmentRef `json:"attachments"`
+	}
+	if req.ContentLength > maxMessageSize {
+		rend.JSON(413, map[string]string{"error": fmt.Sprintf("messages are at most %d bytes", maxMessageSize)})
+		return
+	}
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxMessageSize)).Decode(&in); err != nil || in.Body == "" {
+		rend.JSON(400, map[string]string{"error": "expected {\"body\": \"...\"}"})
+		return
+	}
+
+	// like the websocket, only hubs the user joined, and the default hub
+	// everyone is in
+	hb, err := workspaceHub(currUser, params["id"])
+	if err != nil {
+		rend.JSON(404, map[string]string{"error": "no such hub"})
+		return
+	}
+	if !currUser.Hubs[hb.HubID] {
+		if d, err := h.defaultHub(currUser.WorkspaceID); err != nil || d != hb {
+			rend.JSON(403, map[string]string{"error": "join the hub first"})
+			return
+		}
+	}
+
+	if ok, retryAfter, own := limiter.allowSender(currUser.Id, currUser.Role, nil, hb.HubID); !ok {
+		w := int64(retryAfter / time.Millisecond)
+		reason := "rate limited"
+		if !own {
+			reason = "hub rate limited"
+		}
+		rend.JSON(429, map[string]interface{}{"error": reason, "retry_after": w})
+		return
+	}
+
+	attachments, err := resolveAttachments(currUser.Id, in.Attachments)
+	if err != nil {
+		rend.JSON(400, map[string]string{"error": err.Error()})
+		return
+	}
+
+	m := msg{
+		ID:          randomID(16),
+		Type:        msgTypeBroadcast,
+		HubID:       hb.HubID,
+		From:        currUser.Username,
+		FromID:      currUser.Id,
+		Body:        in.Body,
+		Time:        nowMillis(),
+		Attachments: attachments,
+	}
+	if err := h.broadcast(hb.HubID, m); err == errHubArchived {
+		rend.JSON(403, map[string]string{"error": err.Error()})
+		return
+	} else if err != nil {
+		fmt.Println(err)
+		rend.JSON(500, map[string]string{"error": "error sending message"})
+		return
+	}
+	rend.JSON(201, m)
+}
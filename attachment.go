@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessionauth"
+)
+
+const (
+	// Largest single file a user can upload.
+	maxAttachmentSize = 10 << 20
+
+	// Total bytes of attachments a single user can keep.
+	maxUserStorage = 100 << 20
+
+	// Thumbnails are scaled to fit in a square this many pixels wide.
+	thumbnailSize = 200
+
+	// Images with more pixels than this get no thumbnail. Decoding takes
+	// up to 8 bytes a pixel, and a few KB of png can claim any size.
+	maxThumbnailPixels = 25 << 20
+
+	// Most attachments a single message can reference.
+	maxMsgAttachments = 4
+)
+
+// allowedMimeTypes are the sniffed content types we accept for upload.
+var allowedMimeTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"application/pdf": true,
+	"application/zip": true,
+	"text/plain":      true,
+}
+
+// attachment is the metadata of an uploaded file, the contents are in blobs.
+type attachment struct {
+	Id       string    `gorethink:"id"`
+	OwnerID  string    `gorethink:"owner_id"`
+	Name     string    `gorethink:"name"`
+	Size     int64     `gorethink:"size"`
+	MimeType string    `gorethink:"mime_type"`
+	HasThumb bool      `gorethink:"has_thumb"`
+	Created  time.Time `gorethink:"created"`
+}
+
+// attachmentRef is how a message points at an attachment.
+// Clients only need to send the ID, the rest is filled in by the server.
+type attachmentRef struct {
+	ID       string `json:"id"`
+	Name     string `json:"name,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	MimeType string `json:"mime_type,omitempty"`
+	URL      string `json:"url,omitempty"`
+	ThumbURL string `json:"thumb_url,omitempty"`
+}
+
+// randomID returns a random hex string, n bytes of entropy.
+func randomID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (a *attachment) blobKey() string {
+	return "attachments/" + a.Id
+}
+
+func (a *attachment) thumbKey() string {
+	return "thumbnails/" + a.Id + ".png"
+}
+
+func (a *attachment) ref() attachmentRef {
+	ref := attachmentRef{
+		ID:       a.Id,
+		Name:     a.Name,
+		Size:     a.Size,
+		MimeType: a.MimeType,
+		URL:      "/attachment/" + a.Id,
+	}
+	if a.HasThumb {
+		ref.ThumbURL = ref.URL + "/thumb"
+	}
+	return ref
+}
+
+func (a *attachment) GetById(id string) error {
+	row, err := r.Table("attachment").Get(id).RunRow(dbSession)
+	if err != nil {
+		return err
+	}
+	if row.IsNil() {
+		return errors.New("attachment not found")
+	}
+	return row.Scan(a)
+}
+
+// storageUsed sums up the size of every attachment a user owns.
+func storageUsed(userID string) (int64, error) {
+	var used int64
+	row, err := r.Table("attachment").GetAllByIndex("owner_id", userID).Field("size").Sum().RunRow(dbSession)
+	if err != nil {
+		return 0, err
+	}
+	if !row.IsNil() {
+		if err := row.Scan(&used); err != nil {
+			return 0, err
+		}
+	}
+	return used, nil
+}
+
+// reserveStorage counts size against the user's quota, in one write so
+// parallel uploads can't both squeeze under it. used seeds the counter of
+// users that uploaded before it was kept.
+func reserveStorage(userID string, used, size int64) (bool, error) {
+	current := r.Row.Field("storage_used").Default(used)
+	res, err := r.Table("user").Get(userID).Update(r.Branch(
+		current.Add(size).Le(maxUserStorage),
+		map[string]interface{}{"storage_used": current.Add(size)},
+		map[string]interface{}{},
+	)).RunWrite(dbSession)
+	if err != nil {
+		return false, err
+	}
+	return res.Replaced == 1, nil
+}
+
+// releaseStorage gives back what reserveStorage took for a failed upload.
+func releaseStorage(userID string, size int64) {
+	_, err := r.Table("user").Get(userID).Update(map[string]interface{}{
+		"storage_used": r.Row.Field("storage_used").Default(size).Sub(size),
+	}).RunWrite(dbSession)
+	if err != nil {
+		fmt.Println("Error releasing storage.", err)
+	}
+}
+
+// resolveAttachments checks the attachments a client put in a message
+// and replaces them with the full metadata from the DB.
+// Users can only attach files they uploaded themselves.
+func resolveAttachments(userID string, refs []attachmentRef) ([]attachmentRef, error) {
+	if len(refs) == 0 {
+		return nil, nil
+	}
+	if len(refs) > maxMsgAttachments {
+		return nil, fmt.Errorf("too many attachments, max is %d", maxMsgAttachments)
+	}
+
+	resolved := make([]attachmentRef, 0, len(refs))
+	for _, ref := range refs {
+		var a attachment
+		if err := a.GetById(ref.ID); err != nil {
+			return nil, err
+		}
+		if a.OwnerID != userID {
+			return nil, errors.New("attachment belongs to another user")
+		}
+		resolved = append(resolved, a.ref())
+	}
+	return resolved, nil
+}
+
+// detectMimeType sniffs the content type and drops parameters like charset.
+func detectMimeType(data []byte) string {
+	mimeType, _, err := mime.ParseMediaType(http.DetectContentType(data))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return mimeType
+}
+
+// makeThumbnail scales an image down to fit in thumbnailSize and encodes it
+// as png. Nearest neighbour is good enough for a preview.
+func makeThumbnail(data []byte) ([]byte, error) {
+	// the header says how big it is, check before decoding all of it
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > maxThumbnailPixels {
+		return nil, fmt.Errorf("image too big for a thumbnail: %dx%d", cfg.Width, cfg.Height)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w == 0 || h == 0 {
+		return nil, errors.New("empty image")
+	}
+	if w > thumbnailSize || h > thumbnailSize {
+		if w > h {
+			w, h = thumbnailSize, h*thumbnailSize/w
+		} else {
+			w, h = w*thumbnailSize/h, thumbnailSize
+		}
+		if w == 0 {
+			w = 1
+		}
+		if h == 0 {
+			h = 1
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dst.Set(x, y, src.At(b.Min.X+x*b.Dx()/w, b.Min.Y+y*b.Dy()/h))
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, dst); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//-----------------------------------------------------------------------------
+// HANDLERS
+//-----------------------------------------------------------------------------
+
+// postAttachmentHandler takes a multipart upload in the "file" field,
+// stores it and replies with the attachment reference to put in a msg.
+func postAttachmentHandler(user sessionauth.User, rend render.Render, w http.ResponseWriter, req *http.Request) {
+	currUser := user.(*User)
+
+	if currUser.Unverified {
+		rend.JSON(403, map[string]string{"error": "verify your email first"})
+		return
+	}
+
+	if blobs == nil {
+		rend.JSON(503, map[string]string{"error": "uploads are disabled"})
+		return
+	}
+
+	// leave some room for the multipart headers
+	req.Body = http.MaxBytesReader(w, req.Body, maxAttachmentSize+(1<<20))
+	file, header, err := req.FormFile("file")
+	if err != nil {
+		fmt.Println("Error reading upload.", err)
+		rend.JSON(400, map[string]string{"error": "missing or too large file"})
+		return
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(file, maxAttachmentSize+1))
+	if err != nil {
+		rend.JSON(400, map[string]string{"error": "error reading file"})
+		return
+	}
+	if len(data) > maxAttachmentSize {
+		rend.JSON(413, map[string]string{"error": "file too large"})
+		return
+	}
+
+	mimeType := detectMimeType(data)
+	if !allowedMimeTypes[mimeType] {
+		rend.JSON(415, map[string]string{"error": "file type not allowed: " + mimeType})
+		return
+	}
+
+	used, err := storageUsed(currUser.Id)
+	if err != nil {
+		fmt.Println("Error getting storage used.", err)
+		rend.JSON(500, map[string]string{"error": "error checking quota"})
+		return
+	}
+	ok, err := reserveStorage(currUser.Id, used, int64(len(data)))
+	if err != nil {
+		fmt.Println("Error reserving storage.", err)
+		rend.JSON(500, map[string]string{"error": "error checking quota"})
+		return
+	}
+	if !ok {
+		rend.JSON(413, map[string]string{"error": "storage quota exceeded"})
+		return
+	}
+
+	a := attachment{
+		Id:       randomID(16),
+		OwnerID:  currUser.Id,
+		Name:     filepath.Base(header.Filename),
+		Size:     int64(len(data)),
+		MimeType: mimeType,
+		Created:  time.Now(),
+	}
+
+	if err := blobs.Put(a.blobKey(), bytes.NewReader(data), a.Size, a.MimeType); err != nil {
+		fmt.Println("Error storing blob.", err)
+		releaseStorage(currUser.Id, a.Size)
+		rend.JSON(500, map[string]string{"error": "error storing file"})
+		return
+	}
+
+	if thumb, err := makeThumbnail(data); err == nil {
+		if err := blobs.Put(a.thumbKey(), bytes.NewReader(thumb), int64(len(thumb)), "image/png"); err == nil {
+			a.HasThumb = true
+		} else {
+			fmt.Println("Error storing thumbnail.", err)
+		}
+	}
+
+	if _, err := r.Table("attachment").Insert(a).RunWrite(dbSession); err != nil {
+		fmt.Println("Error inserting attachment.", err)
+		blobs.Delete(a.blobKey())
+		blobs.Delete(a.thumbKey())
+		releaseStorage(currUser.Id, a.Size)
+		rend.JSON(500, map[string]string{"error": "error storing file"})
+		return
+	}
+
+	rend.JSON(201, a.ref())
+}
+
+// getAttachmentHandler streams an attachment back to a logged in user.
+func getAttachmentHandler(params martini.Params, w http.ResponseWriter, req *http.Request) {
+	serveAttachment(params["id"], false, w, req)
+}
+
+// getThumbnailHandler streams the thumbnail of an image attachment.
+func getThumbnailHandler(params martini.Params, w http.ResponseWriter, req *http.Request) {
+	serveAttachment(params["id"], true, w, req)
+}
+
+func serveAttachment(id string, thumb bool, w http.ResponseWriter, req *http.Request) {
+	var a attachment
+	if err := a.GetById(id); err != nil || (thumb && !a.HasThumb) || blobs == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	key, mimeType := a.blobKey(), a.MimeType
+	if thumb {
+		key, mimeType = a.thumbKey(), "image/png"
+	}
+
+	blob, err := blobs.Get(key)
+	if err != nil {
+		fmt.Println("Error reading blob.", err)
+		http.NotFound(w, req)
+		return
+	}
+	defer blob.Close()
+
+	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if !thumb {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Name}))
+	}
+	io.Copy(w, blob)
+}
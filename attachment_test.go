@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"testing"
+)
+
+// testPNG encodes a w by h png, then rewrites its header to claim
+// claimW by claimH, like a decompression bomb would.
+func testPNG(t *testing.T, w, h, claimW, claimH int) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// signature, then the IHDR chunk: length, type, width, height, ...
+	ihdr := data[8+8 : 8+8+13]
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(claimW))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(claimH))
+	binary.BigEndian.PutUint32(data[8+8+13:], crc32.ChecksumIEEE(data[8+4:8+8+13]))
+	return data
+}
+
+func TestMakeThumbnail(t *testing.T) {
+	thumb, err := makeThumbnail(testPNG(t, 800, 400, 800, 400))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(thumb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != thumbnailSize || b.Dy() != thumbnailSize/2 {
+		t.Fatalf("thumbnail is %dx%d", b.Dx(), b.Dy())
+	}
+}
+
+func TestMakeThumbnailRefusesHugeImages(t *testing.T) {
+	if _, err := makeThumbnail(testPNG(t, 1, 1, 50000, 50000)); err == nil {
+		t.Fatal("made a thumbnail of a 50000x50000 image")
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/martini-contrib/render"
+)
+
+// What happened, for the audit log.
+const (
+	auditLogin          = "login"
+	auditLoginFailed    = "login_failed"
+	auditLogout         = "logout"
+	auditPasswordChange = "password_change"
+	auditPasswordReset  = "password_reset"
+	auditRoleChange     = "role_change"
+	auditTwoFactorOn    = "2fa_enable"
+	auditTwoFactorOff   = "2fa_disable"
+	auditSessionRevoke  = "session_revoke"
+	auditTokenCreate    = "token_create"
+	auditTokenRevoke    = "token_revoke"
+	auditBotCreate      = "bot_create"
+	auditAccountDelete  = "account_delete"
+	auditAccountPurge   = "account_purge"
+	auditUserDisable    = "user_disable"
+	auditUserEnable     = "user_enable"
+	auditUserKick       = "user_kick" // signed out everywhere by an admin
+	auditUserLock       = "user_lock" // too many failed logins
+	auditUserUnlock     = "user_unlock"
+	auditHubArchive     = "hub_archive"
+	auditHubUnarchive   = "hub_unarchive"
+	auditHubDelete      = "hub_delete"
+	auditHubCreate      = "hub_create"
+	auditMessagePin     = "message_pin"
+	auditMessageUnpin   = "message_unpin"
+	auditHubGuests      = "hub_guest_access"
+	auditAdminPassword  = "admin_password_reset"
+	auditAdminTwoFactor = "admin_2fa_reset"
+
+	auditWorkspaceCreate = "workspace_create"
+	auditWorkspaceLeave  = "workspace_leave"
+	auditWorkspaceRemove = "workspace_remove"
+	auditWorkspaceAdmin  = "workspace_admin"
+
+	auditInviteCreate = "invite_create"
+	auditInviteAccept = "invite_accept"
+	auditInviteRevoke = "invite_revoke"
+)
+
+// How many entries the audit API returns at most, the export has no limit.
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// auditEvent is an entry in the "audit" table. Entries are only ever
+// inserted, nothing updates or deletes them.
+type auditEvent struct {
+	Id         string            `json:"id" gorethink:"id,omitempty"`
+	Time       time.Time         `json:"time" gorethink:"time"`
+	Action     string            `json:"action" gorethink:"action"`
+	ActorID    string            `json:"actor_id,omitempty" gorethink:"actor_id,omitempty"`
+	Actor      string            `json:"actor,omitempty" gorethink:"actor,omitempty"` // email when it happened
+	TargetType string            `json:"target_type,omitempty" gorethink:"target_type,omitempty"`
+	TargetID   string            `json:"target_id,omitempty" gorethink:"target_id,omitempty"`
+	IP         string            `json:"ip,omitempty" gorethink:"ip,omitempty"`
+	Detail     map[string]string `json:"detail,omitempty" gorethink:"detail,omitempty"`
+}
+
+// auditFilter picks entries out of the audit log. Empty fields match all.
+type auditFilter struct {
+	Action   string
+	ActorID  string
+	TargetID string
+	IP       string
+	Since    time.Time
+	Until    time.Time
+	Limit    int // 0 for no limit
+}
+
+// logAudit records that actor did action to a target. req and actor can be
+// nil, for things the server does by itself.
+func logAudit(req *http.Request, actor *User, action, targetType, targetID string, detail map[string]string) {
+	e := auditEvent{
+		Time:       time.Now(),
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Detail:     detail,
+	}
+	if actor != nil {
+		e.ActorID = actor.Id
+		e.Actor = actor.Email
+	}
+	if req != nil {
+		e.IP = clientIP(req)
+	}
+	saveAudit(e)
+}
+
+func saveAudit(e auditEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if _, err := r.Table("audit").Insert(e).RunWrite(dbSession); err != nil {
+		fmt.Println("Error writing audit log.", e.Action, err)
+	}
+}
+
+// queryAudit returns matching entries, newest first.
+func queryAudit(f auditFilter) r.Term {
+	until := interface{}(r.Maxval)
+	if !f.Until.IsZero() {
+		until = f.Until
+	}
+	since := interface{}(r.Minval)
+	if !f.Since.IsZero() {
+		since = f.Since
+	}
+
+	q := r.Table("audit").
+		Between(since, until, r.BetweenOpts{Index: "time"}).
+		OrderBy(r.OrderByOpts{Index: r.Desc("time")})
+	if f.Action != "" {
+		q = q.Filter(r.Row.Field("action").Eq(f.Action))
+	}
+	if f.ActorID != "" {
+		q = q.Filter(r.Row.Field("actor_id").Default("").Eq(f.ActorID))
+	}
+	if f.TargetID != "" {
+		q = q.Filter(r.Row.Field("target_id").Default("").Eq(f.TargetID))
+	}
+	if f.IP != "" {
+		q = q.Filter(r.Row.Field("ip").Default("").Eq(f.IP))
+	}
+	if f.Limit > 0 {
+		q = q.Limit(f.Limit)
+	}
+	return q
+}
+
+// parseAuditFilter reads a filter from the query string:
+// ?action=&actor=&target=&ip=&since=&until=&limit=, times are RFC 3339.
+func parseAuditFilter(req *http.Request) (auditFilter, error) {
+	v := req.URL.Query()
+	f := auditFilter{
+		Action:   v.Get("action"),
+		ActorID:  v.Get("actor"),
+		TargetID: v.Get("target"),
+		IP:       v.Get("ip"),
+	}
+	var err error
+	if s := v.Get("since"); s != "" {
+		if f.Since, err = time.Parse(time.RFC3339, s); err != nil {
+			return f, fmt.Errorf("bad since: %v", err)
+		}
+	}
+	if s := v.Get("until"); s != "" {
+		if f.Until, err = time.Parse(time.RFC3339, s); err != nil {
+			return f, fmt.Errorf("bad until: %v", err)
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		if f.Limit, err = strconv.Atoi(s); err != nil || f.Limit <= 0 {
+			return f, fmt.Errorf("bad limit: %s", s)
+		}
+	}
+	return f, nil
+}
+
+// loginAuditEvent is the audit entry for a login attempt from ip on the
+// account userID, "" if the email isn't a user's. Only a successful login
+// proves who the actor was, for failed ones the email is just what they
+// typed.
+func loginAuditEvent(userID, email, ip, method, reason string, success bool) auditEvent {
+	e := auditEvent{
+		Action: auditLoginFailed,
+		Actor:  email,
+		IP:     ip,
+		Detail: map[string]string{"method": method},
+	}
+	if userID != "" {
+		e.TargetType, e.TargetID = "user", userID
+	}
+	if success {
+		e.Action = auditLogin
+		e.ActorID = userID
+	}
+	if reason != "" {
+		e.Detail["reason"] = reason
+	}
+	return e
+}
+
+//-----------------------------------------------------------------------------
+// HANDLERS
+//-----------------------------------------------------------------------------
+
+// getAuditHandler - GET /api/admin/audit, see parseAuditFilter.
+func getAuditHandler(rend render.Render, req *http.Request) {
+	f, err := parseAuditFilter(req)
+	if err != nil {
+		rend.JSON(400, map[string]string{"error": err.Error()})
+		return
+	}
+	if f.Limit == 0 {
+		f.Limit = defaultAuditLimit
+	}
+	if f.Limit > maxAuditLimit {
+		f.Limit = maxAuditLimit
+	}
+
+	rows, err := queryAudit(f).Run(dbSession)
+	if err != nil {
+		fmt.Println("Error querying audit log.", err)
+		rend.JSON(500, map[string]string{"error": "error querying audit log"})
+		return
+	}
+	defer rows.Close()
+
+	events := []auditEvent{}
+	for rows.Next() {
+		var e auditEvent
+		if err := rows.Scan(&e); err != nil {
+			fmt.Println("Error reading audit log.", err)
+			rend.JSON(500, map[string]string{"error": "error reading audit log"})
+			return
+		}
+		events = append(events, e)
+	}
+
+	rend.JSON(200, events)
+}
+
+// getAuditExportHandler - GET /api/admin/audit/export, the same filters as
+// getAuditHandler but everything that matches, as JSON lines.
+func getAuditExportHandler(w http.ResponseWriter, req *http.Request) {
+	f, err := parseAuditFilter(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rows, err := queryAudit(f).Run(dbSession)
+	if err != nil {
+		fmt.Println("Error querying audit log.", err)
+		http.Error(w, "error querying audit log", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	name := fmt.Sprintf("chatgo-audit-%s.jsonl", time.Now().Format("2006-01-02"))
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+
+	enc := json.NewEncoder(w)
+	for rows.Next() {
+		var e auditEvent
+		if err := rows.Scan(&e); err != nil {
+			fmt.Println("Error reading audit log.", err)
+			return
+		}
+		if err := enc.Encode(e); err != nil {
+			return
+		}
+	}
+}
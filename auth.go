@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"code.google.com/p/go.crypto/bcrypt"
+)
+
+// authProvider checks an email and password, and returns the user they
+// belong to. Providers that don't know the email return errUnknownUser so
+// the next one gets a try, as do providers that can't be reached and
+// return errProviderDown.
+type authProvider interface {
+	Name() string
+	Authenticate(email, password string) (*User, error)
+}
+
+var (
+	errUnknownUser   = errors.New("unknown user")
+	errWrongPassword = errors.New("wrong password")
+	errProviderDown  = errors.New("auth provider unavailable")
+
+	// The account is waiting to be purged, see account.go
+	errAccountDeleted = errors.New("account deleted")
+
+	// An admin turned the account off, see admin.go
+	errAccountDisabled = errors.New("account disabled")
+)
+
+// authProviders are tried in order on login. Set AUTH_PROVIDERS to a comma
+// separated list, eg. AUTH_PROVIDERS=ldap,db. The default is just db, or
+// ldap,db when LDAP_ADDR is set.
+var authProviders []authProvider
+
+func init() {
+	names := os.Getenv("AUTH_PROVIDERS")
+	if names == "" {
+		names = "db"
+		if os.Getenv("LDAP_ADDR") != "" {
+			names = "ldap,db"
+		}
+	}
+
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "db":
+			authProviders = append(authProviders, dbAuthProvider{})
+		case "ldap":
+			p, err := newLDAPAuthProvider()
+			if err != nil {
+				fmt.Println("LDAP config error, LDAP login is off.", err)
+				continue
+			}
+			authProviders = append(authProviders, p)
+		default:
+			fmt.Println("Unknown auth provider:", name)
+		}
+	}
+}
+
+// authenticate finds the user for an email and password. The first provider
+// that knows the email decides.
+func authenticate(email, password string) (*User, error) {
+	if email == "" || password == "" {
+		return nil, errWrongPassword
+	}
+	for _, p := range authProviders {
+		// a provider being down never lets anyone in by itself: users it
+		// made have random passwords the next ones won't accept
+		u, err := p.Authenticate(email, password)
+		if err == errUnknownUser || err == errProviderDown {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", p.Name(), err)
+		}
+		if err := loginBlocked(u); err != nil {
+			return nil, err
+		}
+		return u, nil
+	}
+	return nil, errUnknownUser
+}
+
+// loginBlocked returns why u can't sign in at all, nil if they can.
+func loginBlocked(u *User) error {
+	if !u.DeletedAt.IsZero() {
+		return errAccountDeleted
+	}
+	if u.Disabled {
+		return errAccountDisabled
+	}
+	return nil
+}
+
+// dbAuthProvider checks the bcrypt password hash stored with the user.
+type dbAuthProvider struct{}
+
+func (dbAuthProvider) Name() string { return "db" }
+
+func (dbAuthProvider) Authenticate(email, password string) (*User, error) {
+	u, err := findUserByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return nil, errUnknownUser
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)) != nil {
+		return nil, errWrongPassword
+	}
+	return u, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/minio/minio-go"
+)
+
+// blobStore is where uploaded file contents live. The DB only keeps the
+// attachment metadata, the bytes go here under a key.
+type blobStore interface {
+	Put(key string, r io.Reader, size int64, mimeType string) error
+	Get(key string) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+// blobs is the store used by the attachment handlers.
+// Set BLOB_STORE=s3 to use an S3-compatible server (eg. a local MinIO),
+// otherwise files are written under BLOB_DIR on the local filesystem.
+var blobs blobStore
+
+func init() {
+	var (
+		store blobStore
+		err   error
+	)
+
+	// the constructors return typed nils on error, only a working store
+	// may end up in blobs or the nil checks of the handlers won't see it
+	switch os.Getenv("BLOB_STORE") {
+	case "s3":
+		var s3 *s3BlobStore
+		s3, err = newS3BlobStore(
+			os.Getenv("S3_ENDPOINT"),
+			os.Getenv("S3_ACCESS_KEY"),
+			os.Getenv("S3_SECRET_KEY"),
+			os.Getenv("S3_BUCKET"),
+			os.Getenv("S3_INSECURE") == "",
+		)
+		store = s3
+	default:
+		dir := os.Getenv("BLOB_DIR")
+		if dir == "" {
+			dir = "data/blobs"
+		}
+		var local *localBlobStore
+		local, err = newLocalBlobStore(dir)
+		store = local
+	}
+
+	if err != nil {
+		fmt.Println("Blob store error, uploads disabled.", err)
+		return
+	}
+	blobs = store
+}
+
+// localBlobStore keeps blobs as plain files under a directory.
+type localBlobStore struct {
+	dir string
+}
+
+func newLocalBlobStore(dir string) (*localBlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	fmt.Println("Storing blobs in:", dir)
+	return &localBlobStore{dir: dir}, nil
+}
+
+// path maps a key to a file inside the store dir.
+// Keys are generated by us, but never let one escape the dir anyway.
+func (s *localBlobStore) path(key string) (string, error) {
+	p := filepath.Join(s.dir, filepath.FromSlash(key))
+	if !strings.HasPrefix(p, filepath.Clean(s.dir)+string(filepath.Separator)) {
+		return "", errors.New("invalid blob key: " + key)
+	}
+	return p, nil
+}
+
+func (s *localBlobStore) Put(key string, r io.Reader, size int64, mimeType string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	// write to a temp file first so readers never see half a blob
+	tmp, err := ioutil.TempFile(filepath.Dir(p), ".upload")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (s *localBlobStore) Get(key string) (io.ReadCloser, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (s *localBlobStore) Delete(key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// s3BlobStore keeps blobs in a bucket on an S3-compatible server.
+type s3BlobStore struct {
+	client *minio.Client
+	bucket string
+}
+
+func newS3BlobStore(endpoint, accessKey, secretKey, bucket string, secure bool) (*s3BlobStore, error) {
+	if endpoint == "" || bucket == "" {
+		return nil, errors.New("S3_ENDPOINT and S3_BUCKET must be set")
+	}
+
+	client, err := minio.New(endpoint, accessKey, secretKey, secure)
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := client.BucketExists(bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := client.MakeBucket(bucket, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	fmt.Println("Storing blobs in bucket:", bucket, "at", endpoint)
+	return &s3BlobStore{client: client, bucket: bucket}, nil
+}
+
+func (s *s3BlobStore) Put(key string, r io.Reader, size int64, mimeType string) error {
+	_, err := s.client.PutObject(s.bucket, key, r, mimeType)
+	return err
+}
+
+func (s *s3BlobStore) Get(key string) (io.ReadCloser, error) {
+	return s.client.GetObject(s.bucket, key)
+}
+
+func (s *s3BlobStore) Delete(key string) error {
+	return s.client.RemoveObject(s.bucket, key)
+}
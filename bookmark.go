@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessionauth"
+)
+
+// Most messages a user can have saved.
+const maxBookmarks = 1000
+
+// bookmark is a message a user saved for later. Only they can see it.
+type bookmark struct {
+	Id        string    `json:"-" gorethink:"id"` // user ID and message ID, saving again replaces it
+	UserID    string    `json:"-" gorethink:"user_id"`
+	MessageID string    `json:"message_id" gorethink:"message_id"`
+	HubID     string    `json:"hub_id" gorethink:"hub_id"`
+	Note      string    `json:"note,omitempty" gorethink:"note,omitempty"`
+	Created   time.Time `json:"created" gorethink:"created"`
+
+	// Filled in by listBookmarks, nil if the message is gone or the user
+	// can't see its hub anymore, eg. after moving to another workspace
+	Message *msg `json:"message,omitempty" gorethink:"-"`
+}
+
+func init() {
+	_, err := r.Table("bookmark").IndexCreate("user_id").Run(dbSession)
+	fmt.Println("create index bookmark user_id error: ", err)
+}
+
+func bookmarkID(userID, msgID string) string {
+	return userID + ":" + msgID
+}
+
+// listBookmarks returns the user's saved messages, newest first. Messages
+// of hubs outside the user's workspace are left out, the bookmarks stay so
+// they can be removed.
+func listBookmarks(u *User) ([]bookmark, error) {
+	rows, err := r.Table("bookmark").GetAllByIndex("user_id", u.Id).
+		OrderBy(r.Desc("created")).
+		Run(dbSession)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	saved := []bookmark{}
+	ids := []string{}
+	for rows.Next() {
+		var b bookmark
+		if err := rows.Scan(&b); err != nil {
+			return nil, err
+		}
+		saved = append(saved, b)
+		ids = append(ids, b.MessageID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	msgs, err := getMessages(ids)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]msg, len(msgs))
+	visible := make(map[string]bool)
+	for _, m := range msgs {
+		if _, seen := visible[m.HubID]; !seen {
+			_, err := workspaceHub(u, m.HubID)
+			visible[m.HubID] = err == nil
+		}
+		if visible[m.HubID] {
+			byID[m.ID] = m
+		}
+	}
+	for i := range saved {
+		if m, ok := byID[saved[i].MessageID]; ok {
+			saved[i].Message = &m
+		}
+	}
+	return saved, nil
+}
+
+// countBookmarks returns how many messages the user saved.
+func countBookmarks(userID string) (int, error) {
+	row, err := r.Table("bookmark").GetAllByIndex("user_id", userID).Count().RunRow(dbSession)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	err = row.Scan(&n)
+	return n, err
+}
+
+//-----------------------------------------------------------------------------
+// HANDLERS
+//-----------------------------------------------------------------------------
+
+// getBookmarksHandler - GET /bookmarks, the user's saved messages.
+func getBookmarksHandler(user sessionauth.User, rend render.Render) {
+	saved, err := listBookmarks(user.(*User))
+	if err != nil {
+		fmt.Println("Error listing bookmarks.", err)
+		rend.JSON(500, map[string]string{"error": "error listing bookmarks"})
+		return
+	}
+	rend.JSON(200, saved)
+}
+
+// postBookmarkHandler - POST /bookmarks, saves a message of any hub the
+// user can see. Takes JSON like {"message_id": "...", "note": "..."}.
+func postBookmarkHandler(user sessionauth.User, rend render.Render, req *http.Request) {
+	u := user.(*User)
+
+	var in struct {
+		MessageID string `json:"message_id"`
+		Note      string `json:"note"`
+	}
+	if err := json.NewDecoder(io.LimitReader(req.Body, 16<<10)).Decode(&in); err != nil || in.MessageID == "" {
+		rend.JSON(400, map[string]string{"error": "expected {\"message_id\": \"...\"}"})
+		return
+	}
+
+	m, err := getSavedMessage(in.MessageID)
+	if err != nil {
+		fmt.Println("Error loading message to bookmark.", err)
+		rend.JSON(500, map[string]string{"error": "error saving bookmark"})
+		return
+	}
+	if m == nil {
+		rend.JSON(404, map[string]string{"error": "no such message"})
+		return
+	}
+	if _, err := workspaceHub(u, m.HubID); err != nil {
+		rend.JSON(404, map[string]string{"error": "no such message"})
+		return
+	}
+
+	if n, err := countBookmarks(u.Id); err != nil || n >= maxBookmarks {
+		rend.JSON(403, map[string]string{"error": fmt.Sprintf("you can save at most %d messages", maxBookmarks)})
+		return
+	}
+
+	b := bookmark{
+		Id:        bookmarkID(u.Id, in.MessageID),
+		UserID:    u.Id,
+		MessageID: in.MessageID,
+		HubID:     m.HubID,
+		Note:      in.Note,
+		Created:   time.Now(),
+	}
+	if _, err := r.Table("bookmark").Get(b.Id).Replace(b).RunWrite(dbSession); err != nil {
+		fmt.Println("Error saving bookmark.", err)
+		rend.JSON(500, map[string]string{"error": "error saving bookmark"})
+		return
+	}
+	b.Message = m
+	rend.JSON(201, b)
+}
+
+// postRemoveBookmarkHandler - POST /bookmarks/:id/remove, :id is the
+// message ID.
+func postRemoveBookmarkHandler(params martini.Params, user sessionauth.User, rend render.Render) {
+	_, err := r.Table("bookmark").Get(bookmarkID(user.(*User).Id, params["id"])).Delete().RunWrite(dbSession)
+	if err != nil {
+		fmt.Println("Error removing bookmark.", err)
+		rend.JSON(500, map[string]string{"error": "error removing bookmark"})
+		return
+	}
+	rend.JSON(200, map[string]string{"status": "ok"})
+}
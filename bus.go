@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/nats-io/nats"
+)
+
+// bus is a publish/subscribe transport between server nodes.
+type bus interface {
+	Publish(subject string, data []byte) error
+	// Subscribe calls handler for every message on subject, in order.
+	// The returned func stops the subscription.
+	Subscribe(subject string, handler func(data []byte)) (func(), error)
+	Close() error
+}
+
+// inProcSubBuffer is how many messages a slow in-process subscriber can
+// fall behind before messages to it get dropped.
+const inProcSubBuffer = 1024
+
+// inProcBus delivers messages inside this process only. Good for a single
+// node, or for trying cluster mode without running a broker.
+type inProcBus struct {
+	mu   sync.RWMutex
+	subs map[string]map[*inProcSub]bool
+}
+
+type inProcSub struct {
+	ch   chan []byte
+	done chan struct{}
+	once sync.Once
+}
+
+// stop ends the subscription's delivery goroutine. Both unsubscribing
+// and closing the bus call it, possibly for the same sub.
+func (sub *inProcSub) stop() {
+	sub.once.Do(func() { close(sub.done) })
+}
+
+func newInProcBus() *inProcBus {
+	return &inProcBus{subs: make(map[string]map[*inProcSub]bool)}
+}
+
+func (b *inProcBus) Publish(subject string, data []byte) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for sub := range b.subs[subject] {
+		select {
+		case sub.ch <- data:
+		default:
+			fmt.Println("In-process bus subscriber too slow, dropping message on", subject)
+		}
+	}
+	return nil
+}
+
+func (b *inProcBus) Subscribe(subject string, handler func(data []byte)) (func(), error) {
+	sub := &inProcSub{
+		ch:   make(chan []byte, inProcSubBuffer),
+		done: make(chan struct{}),
+	}
+
+	b.mu.Lock()
+	if b.subs[subject] == nil {
+		b.subs[subject] = make(map[*inProcSub]bool)
+	}
+	b.subs[subject][sub] = true
+	b.mu.Unlock()
+
+	go func() {
+		for {
+			select {
+			case data := <-sub.ch:
+				handler(data)
+			case <-sub.done:
+				return
+			}
+		}
+	}()
+
+	unsubscribe := func() {
+		b.mu.Lock()
+		delete(b.subs[subject], sub)
+		b.mu.Unlock()
+		sub.stop()
+	}
+	return unsubscribe, nil
+}
+
+func (b *inProcBus) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, subs := range b.subs {
+		for sub := range subs {
+			sub.stop()
+		}
+	}
+	b.subs = make(map[string]map[*inProcSub]bool)
+	return nil
+}
+
+// natsBus relays messages through a NATS server, eg. gnatsd running locally.
+type natsBus struct {
+	conn *nats.Conn
+}
+
+func newNatsBus(url string) (*natsBus, error) {
+	if url == "" {
+		url = nats.DefaultURL
+	}
+	conn, err := nats.Connect(url)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Connected to NATS at:", url)
+	return &natsBus{conn: conn}, nil
+}
+
+func (b *natsBus) Publish(subject string, data []byte) error {
+	return b.conn.Publish(subject, data)
+}
+
+func (b *natsBus) Subscribe(subject string, handler func(data []byte)) (func(), error) {
+	sub, err := b.conn.Subscribe(subject, func(m *nats.Msg) {
+		handler(m.Data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func() { sub.Unsubscribe() }, nil
+}
+
+func (b *natsBus) Close() error {
+	b.conn.Close()
+	return nil
+}
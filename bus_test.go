@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it's true or a second has passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for " + what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestInProcBusDeliversInOrder(t *testing.T) {
+	b := newInProcBus()
+	defer b.Close()
+
+	got := make(chan string, 100)
+	if _, err := b.Subscribe("test", func(data []byte) { got <- string(data) }); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		b.Publish("test", []byte(fmt.Sprint(i)))
+	}
+	b.Publish("other", []byte("not for us"))
+
+	for i := 0; i < 100; i++ {
+		select {
+		case data := <-got:
+			if data != fmt.Sprint(i) {
+				t.Fatalf("got %s, want %d", data, i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for message %d", i)
+		}
+	}
+	select {
+	case data := <-got:
+		t.Fatalf("got %s from another subject", data)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestInProcBusUnsubscribe(t *testing.T) {
+	b := newInProcBus()
+	got := make(chan string, 10)
+	unsubscribe, err := b.Subscribe("test", func(data []byte) { got <- string(data) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unsubscribe()
+	unsubscribe()
+	b.Publish("test", []byte("gone"))
+	select {
+	case data := <-got:
+		t.Fatalf("got %s after unsubscribing", data)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// closing stops the remaining subs, unsubscribing after must not panic
+	unsubscribe2, _ := b.Subscribe("test", func([]byte) {})
+	b.Close()
+	b.Close()
+	unsubscribe2()
+}
+
+// Two nodes on one in-process bus see each other's events, but not
+// their own.
+func TestClusterRelaysBetweenNodes(t *testing.T) {
+	b := newInProcBus()
+	defer b.Close()
+
+	a, err := newCluster("node-a", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := newCluster("node-b", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hb := h.addHub(&hub{HubID: "cluster-test-hub", HubName: "cluster test"})
+	c := newConnection("local-user", "local", roleUser, nil)
+	hb.mu.Lock()
+	hb.connections[c] = true
+	hb.mu.Unlock()
+	defer func() {
+		hb.mu.Lock()
+		delete(hb.connections, c)
+		hb.mu.Unlock()
+	}()
+
+	// node-b relays node-a's message to the local member, node-a doesn't
+	// deliver its own message a second time
+	a.publishMsg(msg{ID: "m1", HubID: hb.HubID, Body: "hello", FromID: "remote-user"})
+	select {
+	case m := <-c.send:
+		if m.ID != "m1" || m.FromID != "remote-user" {
+			t.Fatalf("got %+v", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message wasn't relayed")
+	}
+	select {
+	case m := <-c.send:
+		t.Fatalf("message delivered twice: %+v", m)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// both nodes share h here, so only look for the user that never
+	// connected to either
+	a.publish(clusterEvent{Kind: eventJoin, HubID: hb.HubID, UserID: "remote-user", UserName: "remote"})
+	waitFor(t, "the join", func() bool { return hasMember(other, hb.HubID, "remote-user") })
+	if hasMember(a, hb.HubID, "remote-user") {
+		t.Fatal("node-a saw its own join as remote")
+	}
+
+	a.publish(clusterEvent{Kind: eventLeave, HubID: hb.HubID, UserID: "remote-user"})
+	waitFor(t, "the leave", func() bool { return !hasMember(other, hb.HubID, "remote-user") })
+}
+
+func hasMember(node *cluster, hubID, userID string) bool {
+	for _, m := range node.remoteMembers(hubID) {
+		if m.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// A kick for a token only closes the connection opened with it, wherever
+// the kick came from.
+func TestClusterKickByToken(t *testing.T) {
+	b := newInProcBus()
+	defer b.Close()
+
+	a, err := newCluster("node-a", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newCluster("node-b", b); err != nil {
+		t.Fatal(err)
+	}
+
+	browser := newConnection("kick-browser", "browser", roleUser, nil)
+	browser.sessionID = "session-1"
+	bot := newConnection("kick-bot", "bot", roleUser, nil)
+	bot.tokenID = "token-1"
+	for _, c := range []*connection{browser, bot} {
+		if !h.addConn(c) {
+			t.Fatal("user already connected")
+		}
+		defer h.removeConn(c)
+	}
+
+	kicked := func(c *connection) bool {
+		select {
+		case <-c.quit:
+			return true
+		default:
+			return false
+		}
+	}
+
+	a.publishDisconnect("kick-browser", "", "token-1", "token revoked")
+	a.publishDisconnect("kick-bot", "", "token-2", "token revoked")
+	a.publishDisconnect("kick-bot", "", "token-1", "token revoked")
+	waitFor(t, "the kick", func() bool { return kicked(bot) })
+	if kicked(browser) {
+		t.Fatal("revoking a token closed a browser session's connection")
+	}
+}
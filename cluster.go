@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/gorilla/websocket"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessionauth"
+)
+
+const (
+	// Every node publishes and listens to hub events on this subject.
+	clusterSubject = "chatgo.hubs"
+
+	// How often a node announces its full membership to the others.
+	presenceInterval = 30 * time.Second
+
+	// Nodes we haven't heard from in this long are considered gone.
+	presenceTimeout = 3 * presenceInterval
+)
+
+// Kinds of clusterEvent.
+const (
+	eventMsg      = "msg"      // broadcast to a hub
+	eventJoin     = "join"     // user joined a hub
+	eventLeave    = "leave"    // user left a hub
+	eventPresence = "presence" // full membership of the sending node
+	eventSync     = "sync"     // new node asking everyone for presence
+	eventKick     = "kick"     // close a user's connection
+)
+
+// clusterEvent is what nodes send each other over the bus.
+type clusterEvent struct {
+	Node string `json:"node"`
+	Kind string `json:"kind"`
+
+	HubID    string `json:"hub_id,omitempty"`
+	UserID   string `json:"user_id,omitempty"`
+	UserName string `json:"user_name,omitempty"`
+
+	// eventMsg only. FromID isn't part of msg's JSON so it's carried here.
+	Msg    *msg   `json:"msg,omitempty"`
+	FromID string `json:"from_id,omitempty"`
+
+	// eventKick only, SessionID and TokenID limit it to the connection
+	// opened from that session or with that API token
+	Reason    string `json:"reason,omitempty"`
+	SessionID string `json:"session_id,omitempty"`
+	TokenID   string `json:"token_id,omitempty"`
+
+	// eventPresence only, hubID -> members
+	Presence map[string][]member `json:"presence,omitempty"`
+}
+
+// member is a user in a hub, on any node.
+type member struct {
+	UserID   string `json:"user_id"`
+	UserName string `json:"user_name"`
+}
+
+// remoteNode is what we know about another node's hub members.
+type remoteNode struct {
+	seen time.Time
+	hubs map[string]map[string]string // hubID -> userID -> userName
+}
+
+// cluster relays hub traffic between nodes so users connected to
+// different nodes share the same rooms.
+// A nil *cluster means we're running standalone, all methods are no-ops.
+type cluster struct {
+	node string
+	bus  bus
+
+	mu     sync.Mutex
+	remote map[string]*remoteNode
+}
+
+var cl *cluster
+
+// Cluster mode is off unless CLUSTER_BUS is set:
+// CLUSTER_BUS=inproc  single process, mostly for development
+// CLUSTER_BUS=nats    relay through NATS_URL (default nats://localhost:4222)
+func init() {
+	var b bus
+	var err error
+
+	switch os.Getenv("CLUSTER_BUS") {
+	case "":
+		return
+	case "inproc":
+		b = newInProcBus()
+	case "nats":
+		b, err = newNatsBus(os.Getenv("NATS_URL"))
+	default:
+		err = fmt.Errorf("unknown CLUSTER_BUS %q", os.Getenv("CLUSTER_BUS"))
+	}
+	if err != nil {
+		fmt.Println("Cluster bus error, running standalone.", err)
+		return
+	}
+
+	node := os.Getenv("NODE_ID")
+	if node == "" {
+		node = randomID(8)
+	}
+
+	cl, err = newCluster(node, b)
+	if err != nil {
+		fmt.Println("Cluster subscribe error, running standalone.", err)
+		cl = nil
+	}
+}
+
+func newCluster(node string, b bus) (*cluster, error) {
+	c := &cluster{
+		node:   node,
+		bus:    b,
+		remote: make(map[string]*remoteNode),
+	}
+	if _, err := b.Subscribe(clusterSubject, c.handle); err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Cluster mode, node:", node)
+	c.publish(clusterEvent{Kind: eventSync})
+	go c.presenceLoop()
+	return c, nil
+}
+
+func (cl *cluster) publish(ev clusterEvent) {
+	ev.Node = cl.node
+	data, err := json.Marshal(ev)
+	if err != nil {
+		fmt.Println("Error encoding cluster event.", err)
+		return
+	}
+	if err := cl.bus.Publish(clusterSubject, data); err != nil {
+		fmt.Println("Error publishing cluster event.", err)
+	}
+}
+
+// publishMsg relays a broadcast to the other nodes.
+func (cl *cluster) publishMsg(m msg) {
+	if cl == nil {
+		return
+	}
+	cl.publish(clusterEvent{Kind: eventMsg, HubID: m.HubID, Msg: &m, FromID: m.FromID})
+}
+
+// publishMembership tells the other nodes a user joined or left a hub.
+func (cl *cluster) publishMembership(kind string, c *connection, hb *hub) {
+	if cl == nil {
+		return
+	}
+	cl.publish(clusterEvent{Kind: kind, HubID: hb.HubID, UserID: c.userID, UserName: c.userName})
+}
+
+// publishDisconnect asks the other nodes to close a user's connection,
+// only if it's from sessionID or with tokenID when those are set.
+func (cl *cluster) publishDisconnect(userID, sessionID, tokenID, reason string) {
+	if cl == nil {
+		return
+	}
+	cl.publish(clusterEvent{Kind: eventKick, UserID: userID, SessionID: sessionID, TokenID: tokenID, Reason: reason})
+}
+
+// publishPresence announces every local hub member.
+func (cl *cluster) publishPresence() {
+	if h == nil { // still starting up
+		return
+	}
+	presence := make(map[string][]member)
+	h.eachHub(func(hb *hub) {
+		for _, c := range hb.members() {
+			presence[hb.HubID] = append(presence[hb.HubID], member{UserID: c.userID, UserName: c.userName})
+		}
+	})
+	cl.publish(clusterEvent{Kind: eventPresence, Presence: presence})
+}
+
+// handle applies an event from another node.
+func (cl *cluster) handle(data []byte) {
+	var ev clusterEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		fmt.Println("Error decoding cluster event.", err)
+		return
+	}
+	if ev.Node == cl.node {
+		return
+	}
+	if h == nil { // still starting up, presence is resent every presenceInterval
+		return
+	}
+
+	switch ev.Kind {
+	case eventMsg:
+		// only the hubs someone on this node is in are loaded
+		if hb := h.getHub(ev.HubID); hb != nil && ev.Msg != nil {
+			m := *ev.Msg
+			m.FromID = ev.FromID
+			hb.broadcast(m)
+		}
+	case eventJoin, eventLeave:
+		cl.mu.Lock()
+		rn := cl.remoteNode(ev.Node)
+		if ev.Kind == eventJoin {
+			if rn.hubs[ev.HubID] == nil {
+				rn.hubs[ev.HubID] = make(map[string]string)
+			}
+			rn.hubs[ev.HubID][ev.UserID] = ev.UserName
+		} else {
+			delete(rn.hubs[ev.HubID], ev.UserID)
+		}
+		cl.mu.Unlock()
+	case eventPresence:
+		cl.mu.Lock()
+		rn := cl.remoteNode(ev.Node)
+		rn.hubs = make(map[string]map[string]string)
+		for hubID, members := range ev.Presence {
+			rn.hubs[hubID] = make(map[string]string)
+			for _, m := range members {
+				rn.hubs[hubID][m.UserID] = m.UserName
+			}
+		}
+		cl.mu.Unlock()
+	case eventSync:
+		cl.publishPresence()
+	case eventKick:
+		if c := h.getConn(ev.UserID); c != nil && c.openedFrom(ev.SessionID, ev.TokenID) {
+			c.kick(websocket.ClosePolicyViolation, ev.Reason)
+		}
+	}
+}
+
+// remoteNode returns the state of a node, marking it as seen.
+// cl.mu must be held.
+func (cl *cluster) remoteNode(node string) *remoteNode {
+	rn := cl.remote[node]
+	if rn == nil {
+		rn = &remoteNode{hubs: make(map[string]map[string]string)}
+		cl.remote[node] = rn
+	}
+	rn.seen = time.Now()
+	return rn
+}
+
+// presenceLoop keeps announcing our members and forgets dead nodes.
+func (cl *cluster) presenceLoop() {
+	ticker := time.NewTicker(presenceInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		cl.publishPresence()
+
+		cl.mu.Lock()
+		for node, rn := range cl.remote {
+			if now.Sub(rn.seen) > presenceTimeout {
+				fmt.Println("Cluster node gone:", node)
+				delete(cl.remote, node)
+			}
+		}
+		cl.mu.Unlock()
+	}
+}
+
+// remoteMembers returns the members of a hub connected to other nodes.
+func (cl *cluster) remoteMembers(hubID string) []member {
+	if cl == nil {
+		return nil
+	}
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	var members []member
+	for _, rn := range cl.remote {
+		for userID, userName := range rn.hubs[hubID] {
+			members = append(members, member{UserID: userID, UserName: userName})
+		}
+	}
+	return members
+}
+
+// presence returns everyone in a hub, on this node and the others.
+func (hm *hubManager) presence(hubID string) []member {
+	members := []member{}
+	for _, c := range hm.getUsersFromHub(hubID) {
+		members = append(members, member{UserID: c.userID, UserName: c.userName})
+	}
+	return append(members, cl.remoteMembers(hubID)...)
+}
+
+// getMembersHandler - GET /hub/:id/members
+func getMembersHandler(params martini.Params, user sessionauth.User, rend render.Render) {
+	if _, err := workspaceHub(user.(*User), params["id"]); err != nil {
+		rend.JSON(404, map[string]string{"error": "no such hub"})
+		return
+	}
+	rend.JSON(200, h.presence(params["id"]))
+}
@@ -10,10 +10,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/martini-contrib/sessionauth"
+	"github.com/martini-contrib/sessions"
 )
 
 const (
@@ -29,6 +31,10 @@ const (
 	// Maximum message size allowed from peer.
 	maxMessageSize = 512
 
+	// Polls can be bigger, up to maxPollOptions options of maxPollText
+	// each even if every character comes escaped as \uXXXX.
+	maxPollFrameSize = 16 << 10
+
 	// We should have a system to determine what type of message we got
 	// and do actions accordingly.
 	// eg.
@@ -37,11 +43,43 @@ const (
 	// 201 = rename room, must have hubid attached, must be admin
 	// 300 = leave room
 	// 301 = leave all
-	msgTypeBroadcast  = 100
-	msgTypeCreateRoom = 200
-	msgTypeJoinRoom   = 201
-	msgTypeLeaveRoom  = 300
-	msgTypeLeaveAll   = 301
+	// 400 = error from the server, see code
+	// 500 = gap, messages for hubid were dropped because client was slow
+	// 501 = resync, client should reload hubid from /hub/:id/history
+	// 502 = hub changed, body has the new name
+	// 503 = hub deleted, client is no longer in it
+	// 202 = mark read, the user has seen hubid up to now
+	// 203 = pin, body has the ID of a message in hubid, must be hub admin
+	// 204 = unpin, same as pin
+	// 504 = hello, first frame on connect, hubs has the user's hubs
+	// 505 = joined, ack of a join or create, pinned has the pinned messages
+	// 506 = pins changed, pinned has the hub's pinned messages
+	// 507 = reminder, a scheduled message only the user gets, id is the schedule
+	// 101 = poll, like a broadcast with poll set, body is the question
+	// 205 = vote, body is the poll's message ID, choices the option indexes, none takes the vote back
+	// 206 = close poll, body is the poll's message ID, must be its author or hub admin
+	// 508 = poll tally, body is the poll's message ID, poll has the counts
+	msgTypeBroadcast   = 100
+	msgTypePoll        = 101
+	msgTypeCreateRoom  = 200
+	msgTypeJoinRoom    = 201
+	msgTypeMarkRead    = 202
+	msgTypePin         = 203
+	msgTypeUnpin       = 204
+	msgTypeVote        = 205
+	msgTypeClosePoll   = 206
+	msgTypeLeaveRoom   = 300
+	msgTypeLeaveAll    = 301
+	msgTypeError       = 400
+	msgTypeGap         = 500
+	msgTypeResync      = 501
+	msgTypeHubUpdated  = 502
+	msgTypeHubDeleted  = 503
+	msgTypeHello       = 504
+	msgTypeJoined      = 505
+	msgTypePinsUpdated = 506
+	msgTypeReminder    = 507
+	msgTypePollTally   = 508
 )
 
 var upgrader = websocket.Upgrader{
@@ -53,26 +91,102 @@ var upgrader = websocket.Upgrader{
 type connection struct {
 	userID   string
 	userName string
+	role     string
+
+	// Only hubs of this workspace can be joined.
+	workspaceID string
+
+	// Who and where from, for the audit log.
+	email string
+	ip    string
+
+	// Session the websocket was opened from, "" for API tokens, and the
+	// token it was opened with, "" for sessions.
+	sessionID string
+	tokenID   string
+
+	// Can only read the default hub, eg. email not verified yet.
+	readOnly bool
+
+	// Can join and listen but not send, eg. a token without the write scope.
+	listenOnly bool
+
+	// Not logged in, see guest.go. Only in hubs open to guests.
+	guest bool
+
+	// Rate limiting state, only touched by readPump.
+	bucket         tokenBucket
+	violations     int
+	violationStart time.Time
+	mutedUntil     time.Time
 
 	// The websocket connection.
 	ws *websocket.Conn
 
+	// Hubs this connection is in, nil once the connection is closed.
+	hubsMu sync.Mutex
+	hubs   map[*hub]bool
+
 	// Buffered channel of outbound messages.
 	send chan msg
+
+	// Notices for the write pump when the hub couldn't keep up with us.
+	// gaps counts dropped messages per hubID, resync holds hubIDs to reload
+	// and the last message of each the client missed.
+	mu     sync.Mutex
+	gaps   map[string]int
+	resync map[string]string
+	notify chan struct{}
+
+	// Closed when the hub wants this connection gone, see kick.
+	quit        chan struct{}
+	quitOnce    sync.Once
+	closeCode   int
+	closeReason string
 }
 
 type msg struct {
-	Type  int    `json:"msg_type"`
-	HubID string `json:"hub_id"`
-	From  string `json:"from,omitempty"`
-	Body  string `json:"body"`
-}
+	ID     string `json:"id,omitempty" gorethink:"id,omitempty"`
+	Type   int    `json:"msg_type" gorethink:"msg_type"`
+	HubID  string `json:"hub_id" gorethink:"hub_id"`
+	From   string `json:"from,omitempty" gorethink:"from"`
+	FromID string `json:"-" gorethink:"from_id"`
+	Body   string `json:"body" gorethink:"body"`
+	Time   int64  `json:"time,omitempty" gorethink:"time"` // unix millis
+
+	// Files uploaded through /attachment, referenced by ID
+	Attachments []attachmentRef `json:"attachments,omitempty" gorethink:"attachments,omitempty"`
 
-// connMap maps the userIDs to the websocket connection
-var connMap map[string]*connection
+	// Polls and their tallies, saved with the poll message
+	Poll *poll `json:"poll,omitempty" gorethink:"poll,omitempty"`
 
-func init() {
-	connMap = make(map[string]*connection)
+	// Votes only, indexes of the chosen options
+	Choices []int `json:"choices,omitempty" gorethink:"-"`
+
+	// Hello only, the hubs the user is in
+	Hubs []hubState `json:"hubs,omitempty" gorethink:"-"`
+
+	// Joined and pins changed only, the hub's pinned messages
+	Pinned []msg `json:"pinned,omitempty" gorethink:"-"`
+
+	// Set on errors, RetryAfter is in milliseconds
+	Code       string `json:"code,omitempty" gorethink:"-"`
+	RetryAfter int64  `json:"retry_after,omitempty" gorethink:"-"`
+}
+
+func newConnection(userID, userName, role string, ws *websocket.Conn) *connection {
+	return &connection{
+		userID:   userID,
+		userName: userName,
+		role:     role,
+		send:     make(chan msg, 64),
+		ws:       ws,
+		hubs:     make(map[*hub]bool),
+		gaps:     make(map[string]int),
+		resync:   make(map[string]string),
+		notify:   make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+	}
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -80,20 +194,25 @@ func (c *connection) readPump() {
 	defer func() {
 		// if this conn is closed, user is done
 		// unregister from all its hubs, clean the maps
-		h.remEdge <- hubConnMsg{Con: c}
-		delete(connMap, c.userID)
+		h.removeConn(c)
 		c.ws.Close()
 	}()
 
-	c.ws.SetReadLimit(maxMessageSize)
+	c.ws.SetReadLimit(maxPollFrameSize)
 	c.ws.SetReadDeadline(time.Now().Add(pongWait))
 	c.ws.SetPongHandler(func(string) error { c.ws.SetReadDeadline(time.Now().Add(pongWait)); return nil })
 
 	fmt.Println("Started read pump:", c.userID)
 	for {
 		msg := msg{}
-		err := c.ws.ReadJSON(&msg)
+		_, data, err := c.ws.ReadMessage()
+		if err == nil {
+			err = json.Unmarshal(data, &msg)
+		}
+		msg.ID = ""
 		msg.From = c.userName
+		msg.FromID = c.userID
+		msg.Time = nowMillis()
 
 		if err != nil {
 			fmt.Println("msg error: ", err)
@@ -105,18 +224,147 @@ func (c *connection) readPump() {
 		// Then send the message to the hub.
 		fmt.Println(msg)
 
+		// only hubs c is in get charged, so nobody can use up the budget
+		// of a hub they can't post to
+		hubID := ""
+		if (msg.Type == msgTypeBroadcast || msg.Type == msgTypePoll) && c.inHub(msg.HubID) {
+			hubID = msg.HubID
+		}
+		if !c.checkRate(hubID) {
+			continue
+		}
+		// only polls get the bigger frames
+		if len(data) > maxMessageSize && msg.Type != msgTypePoll {
+			c.sendError("too_long", fmt.Sprintf("Messages are at most %d bytes.", maxMessageSize))
+			continue
+		}
+
+		polling := msg.Type == msgTypePoll || msg.Type == msgTypeVote || msg.Type == msgTypeClosePoll
+		if c.readOnly && (msg.Type == msgTypeBroadcast || msg.Type == msgTypeJoinRoom || msg.Type == msgTypeCreateRoom || msg.Type == msgTypePin || msg.Type == msgTypeUnpin || polling) {
+			c.sendError("unverified", "Verify your email to start chatting.")
+			continue
+		}
+		if c.listenOnly && (msg.Type == msgTypeBroadcast || msg.Type == msgTypeCreateRoom || msg.Type == msgTypePin || msg.Type == msgTypeUnpin || polling) {
+			c.sendError("forbidden", "This token can't send messages.")
+			continue
+		}
+		if c.guest {
+			if msg.Type == msgTypeCreateRoom {
+				c.sendError("forbidden", "Log in to create hubs.")
+				continue
+			}
+			if msg.Type == msgTypeJoinRoom {
+				if _, ok := guestHub(msg.HubID); !ok {
+					c.sendError("forbidden", "That hub isn't open to guests.")
+					continue
+				}
+			}
+			if msg.Type == msgTypeBroadcast && len(msg.Attachments) > 0 {
+				c.sendError("forbidden", "Log in to send files.")
+				continue
+			}
+			if polling {
+				c.sendError("forbidden", "Log in to take part in polls.")
+				continue
+			}
+		}
+
 		if err == nil {
 			if msg.Type == msgTypeBroadcast {
-				h.bCastToHub <- hubConnMsg{Con: c, HubID: msg.HubID, Msg: &msg}
+				attachments, err := resolveAttachments(c.userID, msg.Attachments)
+				if err != nil {
+					fmt.Println("Error with attachments, dropping message.", err)
+					continue
+				}
+				msg.Attachments = attachments
+				msg.ID = randomID(16)
+				if !c.inHub(msg.HubID) {
+					fmt.Println("User not in hub, dropping message.", c.userID, msg.HubID)
+					continue
+				}
+				if err := h.broadcast(msg.HubID, msg); err == errHubArchived {
+					c.sendError("archived", "This hub is archived, nobody can post in it.")
+				} else if err != nil {
+					fmt.Println(err)
+				}
 			} else if msg.Type == msgTypeJoinRoom {
-				h.addEdge <- hubConnMsg{Con: c, HubID: msg.HubID}
-				// Todo reply with all users in hub and other hub metadata
+				hb, err := h.findHub(msg.HubID)
+				if err != nil {
+					fmt.Println("Error joining hub.", err)
+					continue
+				}
+				if hb.WorkspaceID != c.workspaceID {
+					c.sendError("forbidden", "That hub is in another workspace.")
+					continue
+				}
+				h.join(c, hb)
+				if err := saveMembership(c.userID, hb.HubID, true); err != nil {
+					fmt.Println("Error saving membership.", err)
+				}
+				c.sendJoined(hb)
 			} else if msg.Type == msgTypeCreateRoom {
-				// Todo
+				hb, created, err := newHub(c.workspaceID, msg.Body, c)
+				if err != nil {
+					fmt.Println("Error creating hub.", err)
+					continue
+				}
+				if created {
+					c.audit(auditHubCreate, "hub", hb.HubID, map[string]string{"name": hb.HubName, "workspace": hb.WorkspaceID})
+				}
+				if err := saveMembership(c.userID, hb.HubID, true); err != nil {
+					fmt.Println("Error saving membership.", err)
+				}
+				c.sendJoined(hb)
 			} else if msg.Type == msgTypeLeaveRoom {
-				// Todo
+				if hb := h.getHub(msg.HubID); hb != nil {
+					h.leave(c, hb)
+				}
+				if err := saveMembership(c.userID, msg.HubID, false); err != nil {
+					fmt.Println("Error saving membership.", err)
+				}
 			} else if msg.Type == msgTypeLeaveAll {
-				// Todo
+				for _, hb := range c.rooms() {
+					h.leave(c, hb)
+				}
+				if err := clearMemberships(c.userID); err != nil {
+					fmt.Println("Error saving membership.", err)
+				}
+			} else if msg.Type == msgTypeMarkRead {
+				if c.inHub(msg.HubID) {
+					if err := markRead(c.userID, msg.HubID); err != nil {
+						fmt.Println("Error marking hub read.", err)
+					}
+				}
+			} else if msg.Type == msgTypePin || msg.Type == msgTypeUnpin {
+				hb := h.getHub(msg.HubID)
+				if hb == nil || !c.inHub(msg.HubID) {
+					continue
+				}
+				if !canModerate(c.userID, c.role, hb) {
+					c.sendError("forbidden", "Only hub admins can pin messages.")
+					continue
+				}
+				var err error
+				action := auditMessagePin
+				if msg.Type == msgTypePin {
+					err = pinMessage(hb, msg.Body)
+				} else {
+					err = unpinMessage(hb, msg.Body)
+					action = auditMessageUnpin
+				}
+				if err == errTooManyPins || err == errNotInHub {
+					c.sendError("pin", err.Error())
+				} else if err != nil {
+					fmt.Println("Error changing pins.", err)
+				} else {
+					c.audit(action, "message", msg.Body, map[string]string{"hub": hb.HubID})
+				}
+			} else if msg.Type == msgTypePoll {
+				c.startPoll(msg)
+			} else if msg.Type == msgTypeVote {
+				c.votePoll(msg)
+			} else if msg.Type == msgTypeClosePoll {
+				c.endPoll(msg)
 			} else {
 				// Todo
 			}
@@ -126,6 +374,31 @@ func (c *connection) readPump() {
 	}
 }
 
+// rooms returns a snapshot of the hubs this connection is in.
+func (c *connection) rooms() []*hub {
+	c.hubsMu.Lock()
+	defer c.hubsMu.Unlock()
+
+	hubs := make([]*hub, 0, len(c.hubs))
+	for hb := range c.hubs {
+		hubs = append(hubs, hb)
+	}
+	return hubs
+}
+
+// inHub reports if this connection joined the hub with the given ID.
+func (c *connection) inHub(hubID string) bool {
+	c.hubsMu.Lock()
+	defer c.hubsMu.Unlock()
+
+	for hb := range c.hubs {
+		if hb.HubID == hubID {
+			return true
+		}
+	}
+	return false
+}
+
 // write writes a message with the given message type and payload.
 func (c *connection) write(mt int, payload []byte) error {
 	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
@@ -149,14 +422,19 @@ func (c *connection) writePump() {
 				c.write(websocket.CloseMessage, []byte{})
 				return
 			}
-			b, jsonErr := json.Marshal(message)
-			if jsonErr != nil {
-				fmt.Println("json marshal error", message)
+			if err := c.writeMsg(message); err != nil {
 				return
 			}
-			if err := c.write(websocket.TextMessage, b); err != nil {
+		case <-c.notify:
+			if err := c.writeNotices(); err != nil {
 				return
 			}
+		case <-c.quit:
+			c.mu.Lock()
+			reason := websocket.FormatCloseMessage(c.closeCode, c.closeReason)
+			c.mu.Unlock()
+			c.write(websocket.CloseMessage, reason)
+			return
 		case <-ticker.C:
 			if err := c.write(websocket.PingMessage, []byte{}); err != nil {
 				return
@@ -165,15 +443,165 @@ func (c *connection) writePump() {
 	}
 }
 
+// writeMsg marshals a msg and writes it to the websocket.
+func (c *connection) writeMsg(m msg) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		fmt.Println("json marshal error", m)
+		return err
+	}
+	return c.write(websocket.TextMessage, b)
+}
+
+// writeNotices tells the client about messages the hub couldn't deliver.
+func (c *connection) writeNotices() error {
+	c.mu.Lock()
+	gaps, resync := c.gaps, c.resync
+	c.gaps, c.resync = make(map[string]int), make(map[string]string)
+	c.mu.Unlock()
+
+	for hubID, n := range gaps {
+		m := msg{Type: msgTypeGap, HubID: hubID, Body: fmt.Sprintf("%d messages dropped", n)}
+		if err := c.writeMsg(m); err != nil {
+			return err
+		}
+	}
+	for hubID, lastID := range resync {
+		// the client reloads right away, what it missed has to be there
+		if lastID != "" {
+			waitSaved(lastID)
+		}
+		if err := c.writeMsg(msg{Type: msgTypeResync, HubID: hubID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendError tells the client something it sent was rejected.
+// Never blocks, if the client isn't reading it won't see it anyway.
+func (c *connection) sendError(code, body string) {
+	select {
+	case c.send <- msg{Type: msgTypeError, Code: code, Body: body}:
+	default:
+	}
+}
+
+// poke wakes up the write pump to send notices. Never blocks.
+func (c *connection) poke() {
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// addGap records a message for hubID this connection never got.
+func (c *connection) addGap(hubID string) {
+	c.mu.Lock()
+	c.gaps[hubID]++
+	c.mu.Unlock()
+	c.poke()
+}
+
+// needResync flags hubID so the client reloads it from history. msgID is
+// the message that didn't fit, "" if it isn't saved.
+func (c *connection) needResync(hubID, msgID string) {
+	c.mu.Lock()
+	if msgID != "" || c.resync[hubID] == "" {
+		c.resync[hubID] = msgID
+	}
+	c.mu.Unlock()
+	c.poke()
+}
+
+// kick makes the write pump close the websocket with the given reason.
+// Closing the socket ends the read pump, which cleans up the edges.
+// Safe to call from any goroutine, more than once.
+func (c *connection) kick(code int, reason string) {
+	c.quitOnce.Do(func() {
+		c.mu.Lock()
+		c.closeCode, c.closeReason = code, reason
+		c.mu.Unlock()
+		close(c.quit)
+	})
+}
+
+// audit records something the connection's user did in the audit log.
+func (c *connection) audit(action, targetType, targetID string, detail map[string]string) {
+	saveAudit(auditEvent{
+		Action:     action,
+		ActorID:    c.userID,
+		Actor:      c.email,
+		TargetType: targetType,
+		TargetID:   targetID,
+		IP:         c.ip,
+		Detail:     detail,
+	})
+}
+
+// disconnectUser closes the user's websocket, on this node and the others.
+func disconnectUser(userID, reason string) {
+	disconnect(userID, "", "", reason)
+}
+
+// disconnectSession closes the user's connection if it was opened from
+// sessionID, on any node.
+func disconnectSession(userID, sessionID, reason string) {
+	disconnect(userID, sessionID, "", reason)
+}
+
+// disconnectToken closes the user's connection if it was opened with the
+// API token tokenID, on any node.
+func disconnectToken(userID, tokenID, reason string) {
+	disconnect(userID, "", tokenID, reason)
+}
+
+func disconnect(userID, sessionID, tokenID, reason string) {
+	if c := h.getConn(userID); c != nil && c.openedFrom(sessionID, tokenID) {
+		c.kick(websocket.ClosePolicyViolation, reason)
+	}
+	cl.publishDisconnect(userID, sessionID, tokenID, reason)
+}
+
+// openedFrom reports if the connection was opened from sessionID and with
+// tokenID. Empty ones match anything.
+func (c *connection) openedFrom(sessionID, tokenID string) bool {
+	return (sessionID == "" || c.sessionID == sessionID) && (tokenID == "" || c.tokenID == tokenID)
+}
+
+// sendToUser queues m for the user's connection on this node, and
+// reports if it could.
+func sendToUser(userID string, m msg) bool {
+	c := h.getConn(userID)
+	if c == nil {
+		return false
+	}
+	select {
+	case <-c.quit: // on its way out, m would be lost with it
+		return false
+	default:
+	}
+	select {
+	case c.send <- m:
+		return true
+	default:
+		return false
+	}
+}
+
 // wsHandler - takes care of incomming chat connection requests
 // The user has to be logged in to get to this point
-func wsHandler(w http.ResponseWriter, user sessionauth.User, r *http.Request) {
+func wsHandler(w http.ResponseWriter, session sessions.Session, user sessionauth.User, t *apiToken, r *http.Request) {
 	currUser := user.(*User)
 	userID := currUser.Id
 	userName := currUser.Username
+	role := currUser.Role
+	if role == "" {
+		role = roleUser
+	}
 
 	fmt.Println("handler start", r.RemoteAddr)
-	if connMap[userID] != nil {
+	if h.getConn(userID) != nil {
 		fmt.Println("Error user already has websocket connection ")
 		return // user already has websocket connection
 	}
@@ -189,20 +617,24 @@ func wsHandler(w http.ResponseWriter, user sessionauth.User, r *http.Request) {
 		fmt.Println("handshake ok ", userID)
 	}
 
-	c := &connection{
-		userID:   userID,
-		userName: userName,
-		send:     make(chan msg, 64),
-		ws:       ws,
+	c := newConnection(userID, userName, role, ws)
+	c.workspaceID = currUser.WorkspaceID
+	c.email = currUser.Email
+	c.ip = clientIP(r)
+	c.readOnly = currUser.Unverified
+	c.listenOnly = t != nil && !t.has(scopeWrite)
+	if t == nil {
+		c.sessionID, _ = session.Get(sessionIDKey).(string)
+	} else {
+		c.tokenID = t.Id
 	}
-	connMap[userID] = c // remember user's connection
-
-	if h.DefaultHub == nil {
-		h.DefaultHub, _ = newHub("default", nil)
+	if !h.addConn(c) { // lost a race with another connection of the user
+		fmt.Println("Error user already has websocket connection ")
+		ws.Close()
+		return
 	}
 
-	h.addEdge <- hubConnMsg{Con: c, Hub: h.DefaultHub}
-
 	go c.writePump()
+	restoreMemberships(c, currUser)
 	c.readPump()
 }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/martini-contrib/sessions"
+)
+
+const (
+	// Session key of the CSRF token, one per session.
+	csrfKey = "csrf_token"
+
+	// Forms send the token in this field, scripts in the header.
+	csrfField  = "_csrf"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// csrfToken returns the session's CSRF token, making one if needed.
+func csrfToken(session sessions.Session) string {
+	token, _ := session.Get(csrfKey).(string)
+	if token == "" {
+		token = randomID(32)
+		session.Set(csrfKey, token)
+	}
+	return token
+}
+
+// checkCSRF rejects POSTs that don't carry the session's CSRF token, so
+// other sites can't post forms as our users. Runs on every request.
+// Requests with an Authorization header don't use the cookie, and other
+// sites can't set that header, so they're let through.
+func checkCSRF(session sessions.Session, w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return
+	}
+	if strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ") {
+		return
+	}
+
+	sent := req.Header.Get(csrfHeader)
+	if sent == "" {
+		sent = req.FormValue(csrfField)
+	}
+	token, _ := session.Get(csrfKey).(string)
+	if token == "" || !hmac.Equal([]byte(sent), []byte(token)) {
+		fmt.Println("Bad CSRF token on", req.Method, req.URL.Path)
+		http.Error(w, "bad or missing CSRF token, reload the page and try again", http.StatusForbidden)
+	}
+}
+
+// page is the data every template gets: the CSRF token for its forms and
+// the flash messages waiting to be shown, plus whatever the handler adds.
+func page(session sessions.Session, data map[string]interface{}) map[string]interface{} {
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	data["CSRF"] = csrfToken(session)
+	data["Flashes"] = session.Flashes()
+	return data
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/go-martini/martini"
+	"github.com/gorilla/websocket"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessionauth"
+	"github.com/martini-contrib/sessions"
+)
+
+const (
+	roleGuest = "guest"
+
+	// Guest connections use this in front of their ID as the user ID,
+	// so they can't be mistaken for a user in the DB.
+	guestIDPrefix = "guest:"
+
+	// Reserved for guests, see newGuestName.
+	guestNamePrefix = "guest-"
+
+	// Session keys of a guest's identity, kept until they log in.
+	guestIDKey   = "guest_id"
+	guestNameKey = "guest_name"
+)
+
+// New guest connections per IP, so nobody opens thousands of them.
+var guestConnectLimit = rateLimit{Rate: 1.0 / 10, Burst: 5}
+
+var (
+	guestAdjectives = []string{"quiet", "brave", "sunny", "swift", "clever", "gentle", "lucky", "misty", "bold", "calm"}
+	guestAnimals    = []string{"otter", "falcon", "panda", "lynx", "heron", "badger", "koala", "moose", "gecko", "wren"}
+)
+
+func isGuestID(userID string) bool {
+	return strings.HasPrefix(userID, guestIDPrefix)
+}
+
+func randomPick(list []string) string {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(len(list))))
+	if err != nil {
+		panic(err)
+	}
+	return list[n.Int64()]
+}
+
+// newGuestName makes a nickname like "sunny-otter-42" that no user has.
+// If none of a few tries is free it falls back to guestNamePrefix and the
+// start of the guest ID, which users can't pick.
+func newGuestName(guestID string) string {
+	for i := 0; i < 5; i++ {
+		n, _ := rand.Int(rand.Reader, big.NewInt(100))
+		name := fmt.Sprintf("%s-%s-%d", randomPick(guestAdjectives), randomPick(guestAnimals), n.Int64())
+		if validateUsername(name, "") == "" {
+			return name
+		}
+	}
+	return guestNamePrefix + guestID[:12]
+}
+
+// guestIdentity returns the guest ID and nickname of the session, making
+// them up the first time.
+func guestIdentity(session sessions.Session) (string, string) {
+	id, _ := session.Get(guestIDKey).(string)
+	name, _ := session.Get(guestNameKey).(string)
+	if id == "" || name == "" {
+		id = randomID(16)
+		name = newGuestName(id)
+		session.Set(guestIDKey, id)
+		session.Set(guestNameKey, name)
+	}
+	return id, name
+}
+
+// guestHub returns hubID if guests are allowed in it.
+func guestHub(hubID string) (*hub, bool) {
+	hb, err := h.findHub(hubID)
+	if err != nil {
+		return nil, false
+	}
+	return hb, hb.guestAccess()
+}
+
+func (hb *hub) guestAccess() bool {
+	hb.mu.RLock()
+	defer hb.mu.RUnlock()
+	return hb.GuestAccess && !hb.Archived
+}
+
+// dropGuests takes the guests out of a hub that no longer lets them in.
+func (hm *hubManager) dropGuests(hb *hub) {
+	notice := msg{Type: msgTypeHubDeleted, HubID: hb.HubID}
+	for _, c := range hb.members() {
+		if !c.guest {
+			continue
+		}
+		hm.leave(c, hb)
+		select {
+		case c.send <- notice:
+		default:
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+// HANDLERS
+//-----------------------------------------------------------------------------
+
+// getGuestHub - GET /guest/:id, the chat page for guests of a hub.
+func getGuestHub(params martini.Params, session sessions.Session, user sessionauth.User, rend render.Render) {
+	if user.IsAuthenticated() {
+		rend.Redirect("/hub")
+		return
+	}
+	hb, ok := guestHub(params["id"])
+	if !ok {
+		session.AddFlash("That hub isn't open to guests, log in to join it.")
+		rend.Redirect(sessionauth.RedirectUrl)
+		return
+	}
+	_, name := guestIdentity(session)
+	rend.HTML(200, "room", page(session, map[string]interface{}{
+		"WSPath":      "/ws/guest?hub=" + hb.HubID,
+		"HistoryPath": "/guest/",
+		"Guest":       name,
+	}))
+}
+
+// getGuestHistoryHandler - GET /guest/:id/history, like /hub/:id/history
+// but only for hubs open to guests.
+func getGuestHistoryHandler(params martini.Params, rend render.Render, req *http.Request) {
+	if _, ok := guestHub(params["id"]); !ok {
+		rend.JSON(403, map[string]string{"error": "hub isn't open to guests"})
+		return
+	}
+	renderHistory(params["id"], rend, req)
+}
+
+// wsGuestHandler - GET /ws/guest?hub=<id>, a websocket for someone who
+// isn't logged in. Guests get a made up nickname, can only be in hubs
+// open to guests, can't create hubs or upload, and have tight rate limits.
+// There are no direct messages, so there's nothing to keep them out of.
+func wsGuestHandler(w http.ResponseWriter, session sessions.Session, user sessionauth.User, r *http.Request) {
+	if user.IsAuthenticated() {
+		http.Error(w, "already logged in, use /ws", http.StatusBadRequest)
+		return
+	}
+	hb, ok := guestHub(r.URL.Query().Get("hub"))
+	if !ok {
+		http.Error(w, "hub isn't open to guests", http.StatusForbidden)
+		return
+	}
+	if ok, _ := limiter.take("guest:"+clientIP(r), guestConnectLimit); !ok {
+		http.Error(w, "too many guest connections, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	// the handshake skips saving the session, so a guest that didn't come
+	// through /guest/:id first gets a nickname for this connection only
+	guestID, name := guestIdentity(session)
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if _, ok := err.(websocket.HandshakeError); ok {
+		fmt.Println("Error with guest handshake.", err)
+		return
+	} else if err != nil {
+		fmt.Println("Guest handshake error, ", err)
+		return
+	}
+
+	c := newConnection(guestIDPrefix+guestID, name, roleGuest, ws)
+	c.guest = true
+	c.workspaceID = hb.WorkspaceID
+	if !h.addConn(c) {
+		fmt.Println("Error guest already has websocket connection ")
+		ws.Close()
+		return
+	}
+
+	go c.writePump()
+	hb.mu.RLock()
+	hello := msg{Type: msgTypeHello, Hubs: []hubState{{ID: hb.HubID, Name: hb.HubName}}}
+	hb.mu.RUnlock()
+	hello.Hubs[0].Pinned = hb.pinnedMessages()
+	select {
+	case c.send <- hello:
+	default:
+	}
+	h.join(c, hb)
+	c.readPump()
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessionauth"
+)
+
+const (
+	// Messages waiting to be written to the DB. When it's full senders
+	// wait for the writer, history is never dropped.
+	historyQueueSize = 4096
+
+	// Most messages written to the DB in one insert.
+	historyBatchSize = 256
+
+	// Most messages returned by a single history request.
+	maxHistoryLimit = 200
+
+	// How long, and how often, waitSaved looks for a message.
+	saveWaitTimeout  = 5 * time.Second
+	saveWaitInterval = 100 * time.Millisecond
+)
+
+// historyOp is a message to save, or a flush: flushed is closed once
+// everything queued before it is in the DB.
+type historyOp struct {
+	m       msg
+	flushed chan struct{}
+}
+
+// historyQueue feeds the history writer, see saveHistory.
+var historyQueue = make(chan historyOp, historyQueueSize)
+
+// queuedIDs counts the messages of each ID that are queued but not in the
+// DB yet, so lookups only flush for messages that could still show up.
+var queuedIDs = struct {
+	sync.Mutex
+	ids map[string]int
+}{ids: make(map[string]int)}
+
+func init() {
+	go historyWriter()
+}
+
+// nowMillis is the timestamp format used in msg.
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// saveHistory queues a broadcast message to be persisted. If the writer
+// is behind this blocks, which slows down the senders instead of losing
+// messages that resyncs, pins and bookmarks rely on.
+func saveHistory(m msg) {
+	queuedIDs.Lock()
+	queuedIDs.ids[m.ID]++
+	queuedIDs.Unlock()
+	historyQueue <- historyOp{m: m}
+}
+
+// historyQueued reports if the message msgID is waiting for the history
+// writer on this node.
+func historyQueued(msgID string) bool {
+	queuedIDs.Lock()
+	defer queuedIDs.Unlock()
+	return queuedIDs.ids[msgID] > 0
+}
+
+// flushHistory waits until every message queued so far is in the DB.
+func flushHistory() {
+	op := historyOp{flushed: make(chan struct{})}
+	historyQueue <- op
+	<-op.flushed
+}
+
+// waitSaved waits until the message msgID is in the DB, up to
+// saveWaitTimeout. Messages of this node are flushed, ones relayed from
+// other nodes are waited for.
+func waitSaved(msgID string) {
+	deadline := time.Now().Add(saveWaitTimeout)
+	for {
+		if msgs, err := getMessages([]string{msgID}); err == nil && len(msgs) > 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			fmt.Println("Message still not saved, resyncing anyway.", msgID)
+			return
+		}
+		if historyQueued(msgID) {
+			flushHistory()
+		}
+		time.Sleep(saveWaitInterval)
+	}
+}
+
+// historyWriter drains historyQueue into the message table, in batches.
+// A batch that fails is retried, the queue backs up meanwhile.
+func historyWriter() {
+	for op := range historyQueue {
+		var batch []msg
+		var flushes []chan struct{}
+		for {
+			if op.flushed != nil {
+				flushes = append(flushes, op.flushed)
+			} else {
+				batch = append(batch, op.m)
+			}
+			if len(batch) >= historyBatchSize {
+				break
+			}
+			var ok bool
+			select {
+			case op, ok = <-historyQueue:
+			default:
+			}
+			if !ok {
+				break
+			}
+		}
+
+		for len(batch) > 0 {
+			// conflicts are messages a failed attempt already wrote
+			_, err := r.Table("message").Insert(batch, r.InsertOpts{Upsert: true}).RunWrite(dbSession)
+			if err == nil {
+				break
+			}
+			fmt.Println("Error saving message history, retrying.", err)
+			time.Sleep(time.Second)
+		}
+		queuedIDs.Lock()
+		for _, m := range batch {
+			if queuedIDs.ids[m.ID]--; queuedIDs.ids[m.ID] <= 0 {
+				delete(queuedIDs.ids, m.ID)
+			}
+		}
+		queuedIDs.Unlock()
+		for _, f := range flushes {
+			close(f)
+		}
+	}
+}
+
+// getHistory returns up to limit messages of a hub that come after the
+// message with the given time and ID, oldest first. Clients use it to
+// catch up after a gap or resync. Without an ID, everything after the
+// time is returned.
+func getHistory(hubID string, after int64, afterID string, limit int) ([]msg, error) {
+	var from interface{} = afterID
+	if afterID == "" {
+		from = r.Maxval
+	}
+	rows, err := r.Table("message").
+		Between([]interface{}{hubID, after, from}, []interface{}{hubID, r.Maxval, r.Maxval}, r.BetweenOpts{Index: "hub_time_id", LeftBound: "open"}).
+		OrderBy(r.OrderByOpts{Index: "hub_time_id"}).
+		Limit(limit).
+		Run(dbSession)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []msg{}
+	for rows.Next() {
+		var m msg
+		if err := rows.Scan(&m); err != nil {
+			return nil, err
+		}
+		history = append(history, m)
+	}
+	return history, rows.Err()
+}
+
+//-----------------------------------------------------------------------------
+// HANDLERS
+//-----------------------------------------------------------------------------
+
+// getHistoryHandler - GET /hub/:id/history?after=<msg time>&after_id=<msg id>&limit=<n>
+func getHistoryHandler(params martini.Params, user sessionauth.User, rend render.Render, req *http.Request) {
+	if _, err := workspaceHub(user.(*User), params["id"]); err != nil {
+		rend.JSON(404, map[string]string{"error": "no such hub"})
+		return
+	}
+	renderHistory(params["id"], rend, req)
+}
+
+// renderHistory replies with the history of a hub the caller can see.
+func renderHistory(hubID string, rend render.Render, req *http.Request) {
+	query := req.URL.Query()
+
+	after, _ := strconv.ParseInt(query.Get("after"), 10, 64)
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 || limit > maxHistoryLimit {
+		limit = maxHistoryLimit
+	}
+
+	history, err := getHistory(hubID, after, query.Get("after_id"), limit)
+	if err != nil {
+		fmt.Println("Error reading history.", err)
+		rend.JSON(500, map[string]string{"error": "error reading history"})
+		return
+	}
+	rend.JSON(200, history)
+}
@@ -8,282 +8,587 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"os"
+	"sync"
 
 	r "github.com/dancannon/gorethink"
+	"github.com/go-martini/martini"
+	"github.com/gorilla/websocket"
 	"github.com/martini-contrib/render"
 	"github.com/martini-contrib/sessionauth"
+	"github.com/martini-contrib/sessions"
 )
 
+// What a hub does when a connection's send buffer is full.
+const (
+	// Drop the oldest queued message and tell the client about the gap.
+	slowPolicyDropOldest = "drop_oldest"
+	// Close the connection with a reason, the client can reconnect.
+	slowPolicyDisconnect = "disconnect"
+	// Skip the message and tell the client to reload the hub from history.
+	slowPolicyResync = "resync"
+)
+
+// defaultSlowPolicy applies to hubs without their own slow_policy.
+// Override with SLOW_CONSUMER_POLICY.
+var defaultSlowPolicy = slowPolicyDropOldest
+
+var (
+	errHubArchived = errors.New("hub is archived")
+	errNoSuchHub   = errors.New("no such hub")
+)
+
+// hubShardCount is how many pieces the hub registry is split into.
+// Lookups only lock the shard the HubID hashes to.
+const hubShardCount = 64
+
 // hub maintains the set of active connections and broadcasts messages to the
 // connections.
 type hub struct {
-	HubID     string         `form:"-" gorethink:"id"`
+	HubID     string         `form:"-" gorethink:"id,omitempty"`
 	HubName   string         `form:"name" gorethink:"name"`
 	HubAdmins map[string]int `form:"-" gorethink:"admins"`
 
+	// Never changes, connections only join hubs of their own workspace.
+	WorkspaceID string `form:"-" gorethink:"workspace_id,omitempty"`
+
+	// One of the slowPolicy consts, empty means defaultSlowPolicy.
+	SlowPolicy string `form:"-" gorethink:"slow_policy,omitempty"`
+
+	// Archived hubs can still be joined and read, but nobody can post.
+	Archived bool `form:"-" gorethink:"archived,omitempty"`
+
+	// Guests can join without logging in, see guest.go.
+	GuestAccess bool `form:"-" gorethink:"guest_access,omitempty"`
+
+	// IDs of pinned messages, oldest pin first, see pin.go.
+	Pinned []string `form:"-" gorethink:"pinned,omitempty"`
+
+	mu          sync.RWMutex         `form:"-" gorethink:"-"`
 	connections map[*connection]bool `form:"-" gorethink:"-"`
-	broadcast   chan msg             `form:"-" gorethink:"-"`
-	register    chan *connection     `form:"-" gorethink:"-"`
-	unregister  chan *connection     `form:"-" gorethink:"-"`
-}
 
-// Edges holds all the edges between the users and hubs, bidirectional
-type Edges struct {
-	Hub_to_users map[*hub]map[*connection]bool // one-to-many hub  -> conns
-	User_to_hubs map[*connection]map[*hub]bool // one-to-many conn -> hubs
+	// Held while a message is saved and fanned out, so every member on
+	// this node gets the hub's messages in the same order.
+	sendMu sync.Mutex `form:"-" gorethink:"-"`
 }
 
-// hubConnMsg is the message type passed to the hubmanager
-type hubConnMsg struct {
-	Hub *hub
-	Con *connection
-
-	HubID string
-	Msg   *msg
+// hubShard is one piece of the hub registry.
+type hubShard struct {
+	mu   sync.RWMutex
+	hubs map[string]*hub
 }
 
-// hubManger is the in-memory hub manager
+// hubManager is the in-memory hub registry. Hubs are sharded by HubID so
+// joins, leaves and broadcasts on different hubs don't contend.
+//
+// Locks are always taken in this order, never the other way around:
+// connection.hubsMu -> hub.mu -> connection.mu
 type hubManager struct {
-	HubMap     map[string]*hub        // maps hub IDs to the actual hub objects
-	UserMap    map[string]*connection // maps user IDs to the actual connection objects
-	EdgeMap    *Edges                 // represents edges between users and hubs
-	DefaultHub *hub                   // default hub everyone connects to first
+	shards [hubShardCount]*hubShard
 
-	newHub     chan hubConnMsg
-	addEdge    chan hubConnMsg
-	remEdge    chan hubConnMsg
-	bCastToHub chan hubConnMsg
+	// maps user IDs to their websocket connection
+	connsMu sync.RWMutex
+	conns   map[string]*connection
+
+	// default hub of each workspace, everyone connects to it first
+	defaultMu   sync.Mutex
+	defaultHubs map[string]*hub
 }
 
 var h *hubManager
 
-func init() {
-	h = &hubManager{
-		HubMap:  make(map[string]*hub),
-		EdgeMap: &Edges{},
+func newHubManager() *hubManager {
+	hm := &hubManager{
+		conns:       make(map[string]*connection),
+		defaultHubs: make(map[string]*hub),
+	}
+	for i := range hm.shards {
+		hm.shards[i] = &hubShard{hubs: make(map[string]*hub)}
+	}
+	return hm
+}
 
-		newHub:     make(chan hubConnMsg, 256),
-		addEdge:    make(chan hubConnMsg, 2048),
-		remEdge:    make(chan hubConnMsg, 2048),
-		bCastToHub: make(chan hubConnMsg, 2048),
+func init() {
+	switch p := os.Getenv("SLOW_CONSUMER_POLICY"); p {
+	case "":
+	case slowPolicyDropOldest, slowPolicyDisconnect, slowPolicyResync:
+		defaultSlowPolicy = p
+	default:
+		fmt.Println("Unknown SLOW_CONSUMER_POLICY, using", defaultSlowPolicy)
 	}
 
-	var err error
-	h.DefaultHub, err = newHub("default", nil)
+	h = newHubManager()
 
-	if err != nil {
+	if _, err := h.defaultHub(defaultWorkspaceID); err != nil {
 		fmt.Println("Default insert error, still running hub.", err)
 	}
 
 	// create index
-	_, err = r.Table("hub").IndexCreate("name").Run(dbSession)
+	_, err := r.Table("hub").IndexCreate("name").Run(dbSession)
 	fmt.Println("create index name error: ", err)
+	_, err = r.Table("hub").IndexCreateFunc("workspace_name", func(row r.Term) interface{} {
+		return []interface{}{row.Field("workspace_id").Default(defaultWorkspaceID), row.Field("name")}
+	}).Run(dbSession)
+	fmt.Println("create index hub workspace_name error: ", err)
 	_, err = r.Table("user").IndexCreate("email").Run(dbSession)
 	fmt.Println("create index user email error: ", err)
-
-	go h.run()
+	_, err = r.Table("attachment").IndexCreate("owner_id").Run(dbSession)
+	fmt.Println("create index attachment owner_id error: ", err)
+	_, err = r.Table("message").IndexCreateFunc("hub_time", func(row r.Term) interface{} {
+		return []interface{}{row.Field("hub_id"), row.Field("time")}
+	}).Run(dbSession)
+	fmt.Println("create index message hub_time error: ", err)
+	// messages can share a millisecond, history pages by time and ID
+	_, err = r.Table("message").IndexCreateFunc("hub_time_id", func(row r.Term) interface{} {
+		return []interface{}{row.Field("hub_id"), row.Field("time"), row.Field("id")}
+	}).Run(dbSession)
+	fmt.Println("create index message hub_time_id error: ", err)
+	_, err = r.Table("message").IndexCreate("from_id").Run(dbSession)
+	fmt.Println("create index message from_id error: ", err)
+	_, err = r.Table("reset_token").IndexCreate("user_id").Run(dbSession)
+	fmt.Println("create index reset_token user_id error: ", err)
+	_, err = r.Table("api_token").IndexCreate("user_id").Run(dbSession)
+	fmt.Println("create index api_token user_id error: ", err)
+	_, err = r.Table("user").IndexCreate("owner_id").Run(dbSession)
+	fmt.Println("create index user owner_id error: ", err)
+	_, err = r.Table("session").IndexCreate("user_id").Run(dbSession)
+	fmt.Println("create index session user_id error: ", err)
+	_, err = r.Table("audit").IndexCreate("time").Run(dbSession)
+	fmt.Println("create index audit time error: ", err)
 }
 
-// newHub return's a new hub object
-// It takes in a connection that will be inserted into the hub if not nil
-func newHub(hubName string, con *connection) (*hub, error) {
+// newHub return's a new hub object, names are unique per workspace
+// It takes in a connection that will be inserted into the hub if not nil.
+// created is only true if the hub wasn't in the DB yet.
+func newHub(workspaceID, hubName string, con *connection) (hb *hub, created bool, err error) {
 	newH := &hub{
-		HubName:   hubName,
-		HubAdmins: make(map[string]int),
-
-		broadcast:   make(chan msg, 256),
-		register:    make(chan *connection),
-		unregister:  make(chan *connection),
-		connections: make(map[*connection]bool),
+		HubName:     hubName,
+		HubAdmins:   make(map[string]int),
+		WorkspaceID: workspaceID,
 	}
 
-	err := newH.GetByName(hubName)
+	err = newH.GetByName(workspaceID, hubName)
 
 	if newH.HubID == "" && err == nil { // hub not in DB, insert
-		_, err = r.Table("hub").Insert(newH).RunWrite(dbSession)
-		fmt.Println("hub not in db, insert", newH)
+		var res r.WriteResponse
+		res, err = r.Table("hub").Insert(newH).RunWrite(dbSession)
+		if err == nil && len(res.GeneratedKeys) > 0 {
+			newH.HubID = res.GeneratedKeys[0]
+			created = true
+		}
+		fmt.Println("hub not in db, insert", newH.HubName)
 	}
 
 	if err != nil {
 		fmt.Println("Error newHub", err)
-		return nil, err
+		return nil, false, err
 	}
 
-	// register new hub in the hubmap
-	newHubMsg := hubConnMsg{Con: con, Hub: newH}
+	// register new hub in the registry, someone may have beaten us to it
+	newH = h.addHub(newH)
 
-	if h != nil {
-		h.newHub <- newHubMsg
+	if con != nil {
+		h.join(con, newH)
 	}
 
-	if con != nil {
-		h.addEdge <- newHubMsg
+	return newH, created, nil
+}
+
+func (hm *hubManager) shard(hubID string) *hubShard {
+	// FNV-1a, inlined so lookups don't allocate
+	var sum uint32 = 2166136261
+	for i := 0; i < len(hubID); i++ {
+		sum ^= uint32(hubID[i])
+		sum *= 16777619
 	}
+	return hm.shards[sum%hubShardCount]
+}
 
-	go newH.run()
+// addHub registers hb, unless a hub with the same ID is already registered
+// in which case that one is returned instead.
+func (hm *hubManager) addHub(hb *hub) *hub {
+	s := hm.shard(hb.HubID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	return newH, nil
+	if existing := s.hubs[hb.HubID]; existing != nil {
+		return existing
+	}
+	if hb.connections == nil {
+		hb.connections = make(map[*connection]bool)
+	}
+	s.hubs[hb.HubID] = hb
+	return hb
+}
+
+// getHub returns the in-memory hub for hubID, nil if it isn't loaded.
+func (hm *hubManager) getHub(hubID string) *hub {
+	s := hm.shard(hubID)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.hubs[hubID]
 }
 
-func (hb *hub) run() {
-	for {
+// removeHub takes a hub out of the registry and out of every connection,
+// telling its members it is gone.
+func (hm *hubManager) removeHub(hubID string) {
+	s := hm.shard(hubID)
+	s.mu.Lock()
+	hb := s.hubs[hubID]
+	delete(s.hubs, hubID)
+	s.mu.Unlock()
+
+	if hb == nil {
+		return
+	}
+
+	hm.defaultMu.Lock()
+	if hm.defaultHubs[hb.WorkspaceID] == hb {
+		delete(hm.defaultHubs, hb.WorkspaceID)
+	}
+	hm.defaultMu.Unlock()
+
+	notice := msg{Type: msgTypeHubDeleted, HubID: hubID}
+	for _, c := range hb.members() {
+		hm.leave(c, hb)
 		select {
-		case r := <-hb.register:
-			hb.connections[r] = true
-		case u := <-hb.unregister:
-			delete(hb.connections, u)
-		case m := <-hb.broadcast:
-			for c := range hb.connections {
-				select {
-				case c.send <- m:
-				default:
-					h.remEdge <- hubConnMsg{Con: c, Hub: hb}
-				}
-			}
+		case c.send <- notice:
+		default:
 		}
 	}
+	fmt.Println("Hub removed:", hubID)
 }
 
-// Get hub from the DB by id and populate it into 'gb'
-// This is not a complete representation of hub, since it
-// will only have ID and name after querying. (no conns or anything)
-// The real hub is in h.hubMap[] which is an in-memory store
-func (hb *hub) GetById(id string) error {
+// findHub returns the hub for hubID, loading it from the DB if needed.
+// errNoSuchHub means the DB doesn't have it, other errors that the DB
+// couldn't be asked.
+func (hm *hubManager) findHub(hubID string) (*hub, error) {
+	if hb := hm.getHub(hubID); hb != nil {
+		return hb, nil
+	}
 
-	row, err := r.Table("hub").Get(id).RunRow(dbSession)
-	if err != nil {
-		return err
+	hb := &hub{}
+	if err := hb.GetById(hubID); err != nil {
+		return nil, err
 	}
-	if !row.IsNil() {
-		if err := row.Scan(&hb); err != nil {
-			return err
-		}
+	if hb.HubID == "" {
+		return nil, errNoSuchHub
 	}
-	return nil
+	return hm.addHub(hb), nil
 }
 
-func (hb *hub) GetByName(hbName string) error {
-	row, err := r.Table("hub").Filter(r.Row.Field("name").Eq(hbName)).RunRow(dbSession)
+// defaultHub returns the hub everyone in the workspace joins, creating it
+// if needed.
+func (hm *hubManager) defaultHub(workspaceID string) (*hub, error) {
+	hm.defaultMu.Lock()
+	defer hm.defaultMu.Unlock()
 
-	if err != nil {
-		fmt.Println("Error getbyname filter.")
-		return err
-	}
-	if !row.IsNil() {
-		if err := row.Scan(&hb); err != nil {
-			fmt.Println("Error scanning hub from db.")
-			return err
+	if hm.defaultHubs[workspaceID] == nil {
+		hb, created, err := newHub(workspaceID, "default", nil)
+		if err != nil {
+			return nil, err
 		}
+		if created {
+			logAudit(nil, nil, auditHubCreate, "hub", hb.HubID, map[string]string{"name": hb.HubName, "workspace": workspaceID})
+		}
+		hm.defaultHubs[workspaceID] = hb
 	}
-	return nil
+	return hm.defaultHubs[workspaceID], nil
 }
 
-func (hm *hubManager) run() {
-	for {
-		select {
-		case n := <-hm.newHub:
-			hm.HubMap[n.Hub.HubID] = n.Hub
-		case a := <-hm.addEdge:
-			hub := hm.HubMap[a.HubID]
-			hm.insertEdge(a.Con, hub)
-		case r := <-hm.remEdge:
-			hm.removeEdge(r.Con, r.Hub)
-		case b := <-hm.bCastToHub:
-			hm.HubMap[b.HubID].broadcast <- *b.Msg
+// eachHub calls fn for every loaded hub, one shard at a time.
+func (hm *hubManager) eachHub(fn func(*hub)) {
+	for _, s := range hm.shards {
+		s.mu.RLock()
+		hubs := make([]*hub, 0, len(s.hubs))
+		for _, hb := range s.hubs {
+			hubs = append(hubs, hb)
+		}
+		s.mu.RUnlock()
+
+		for _, hb := range hubs {
+			fn(hb)
 		}
 	}
 }
 
-func (hm *hubManager) insertEdge(c *connection, hb *hub) {
+// addConn remembers the connection of a user. Returns false if the
+// user already has one.
+func (hm *hubManager) addConn(c *connection) bool {
+	hm.connsMu.Lock()
+	defer hm.connsMu.Unlock()
 
-	if hm.EdgeMap == nil {
-		hm.EdgeMap = &Edges{}
+	if hm.conns[c.userID] != nil {
+		return false
 	}
+	hm.conns[c.userID] = c
+	return true
+}
 
-	// Initialize needed structs
-	if hm.EdgeMap.Hub_to_users == nil {
-		hm.EdgeMap.Hub_to_users = make(map[*hub]map[*connection]bool)
+// removeConn forgets c and takes it out of all its hubs.
+func (hm *hubManager) removeConn(c *connection) {
+	hm.connsMu.Lock()
+	if hm.conns[c.userID] == c {
+		delete(hm.conns, c.userID)
 	}
-	if hm.EdgeMap.User_to_hubs == nil {
-		hm.EdgeMap.User_to_hubs = make(map[*connection]map[*hub]bool)
+	hm.connsMu.Unlock()
+
+	hm.leaveAll(c)
+}
+
+// connections returns a snapshot of every connection on this node.
+func (hm *hubManager) connections() []*connection {
+	hm.connsMu.RLock()
+	defer hm.connsMu.RUnlock()
+
+	conns := make([]*connection, 0, len(hm.conns))
+	for _, c := range hm.conns {
+		conns = append(conns, c)
 	}
-	if hm.EdgeMap.Hub_to_users[hb] == nil { // use the hb's connection map
-		if hb.connections == nil {
-			hb.connections = make(map[*connection]bool)
-		}
-		hm.EdgeMap.Hub_to_users[hb] = hb.connections
+	return conns
+}
+
+// getConn returns the connection of a user, nil if not connected.
+func (hm *hubManager) getConn(userID string) *connection {
+	hm.connsMu.RLock()
+	defer hm.connsMu.RUnlock()
+	return hm.conns[userID]
+}
+
+// join creates an edge between a connection and a hub.
+// Does nothing if the connection was already closed, or if the hub is in
+// another workspace, so messages never cross workspaces.
+func (hm *hubManager) join(c *connection, hb *hub) {
+	if hb.WorkspaceID != c.workspaceID {
+		fmt.Println("Not joining hub of another workspace.", c.userID, hb.HubID)
+		return
 	}
-	if hm.EdgeMap.User_to_hubs[c] == nil {
-		hm.EdgeMap.User_to_hubs[c] = make(map[*hub]bool)
+	c.hubsMu.Lock()
+	if c.hubs == nil { // closed by leaveAll
+		c.hubsMu.Unlock()
+		return
 	}
+	c.hubs[hb] = true
 
-	hb.register <- c
-	hm.EdgeMap.User_to_hubs[c][hb] = true
+	hb.mu.Lock()
+	hb.connections[c] = true
+	hb.mu.Unlock()
+	c.hubsMu.Unlock()
+
+	cl.publishMembership(eventJoin, c, hb)
 }
 
-// removeEdge deletes a relationship between a user and a hub
-// nil hub means remove user from all his hubs
-func (hm *hubManager) removeEdge(c *connection, hb *hub) error {
-	if c == nil {
-		return errors.New("conn is nil.")
+// leave deletes the edge between a connection and a hub.
+func (hm *hubManager) leave(c *connection, hb *hub) {
+	c.hubsMu.Lock()
+	delete(c.hubs, hb)
+
+	hb.mu.Lock()
+	delete(hb.connections, c)
+	hb.mu.Unlock()
+	c.hubsMu.Unlock()
+
+	cl.publishMembership(eventLeave, c, hb)
+}
+
+// leaveAll removes a connection from all of its hubs, and closes it
+// for joins so a late join can't leave it dangling in a hub.
+func (hm *hubManager) leaveAll(c *connection) {
+	c.hubsMu.Lock()
+	left := c.hubs
+	for hb := range left {
+		hb.mu.Lock()
+		delete(hb.connections, c)
+		hb.mu.Unlock()
 	}
+	c.hubs = nil
+	c.hubsMu.Unlock()
 
-	if hb != nil {
-		hb.unregister <- c
-		delete(hm.EdgeMap.User_to_hubs[c], hb)
-	} else { // else, delete user from all his hubs
-		for hh := range hm.EdgeMap.User_to_hubs[c] {
-			hh.unregister <- c
-			delete(hm.EdgeMap.User_to_hubs[c], hh)
-		}
+	for hb := range left {
+		cl.publishMembership(eventLeave, c, hb)
+	}
+}
+
+// broadcast sends m to every connection in the hub, on this node and the
+// others, and saves it in the history. Fan-out happens on the caller's
+// goroutine and never blocks on a member. Senders of the same hub take
+// turns, so the history, the members here and the other nodes all get
+// the hub's messages in one order.
+func (hm *hubManager) broadcast(hubID string, m msg) error {
+	return hm.send(hubID, m, true)
+}
+
+// broadcastSaved is broadcast for a message the caller already saved.
+func (hm *hubManager) broadcastSaved(hubID string, m msg) error {
+	return hm.send(hubID, m, false)
+}
+
+func (hm *hubManager) send(hubID string, m msg, save bool) error {
+	hb := hm.getHub(hubID)
+	if hb == nil {
+		return errors.New("broadcast to unknown hub: " + hubID)
+	}
+	if hb.archived() {
+		return errHubArchived
+	}
+
+	hb.sendMu.Lock()
+	defer hb.sendMu.Unlock()
+	if save {
+		saveHistory(m)
 	}
+	hb.fanOut(m)
+	cl.publishMsg(m)
 	return nil
 }
 
-func getHub(r render.Render) {
-	r.HTML(200, "room", nil)
+// broadcast fans m out to the connections in this hub, in turn with the
+// hub's other messages.
+func (hb *hub) broadcast(m msg) {
+	hb.sendMu.Lock()
+	defer hb.sendMu.Unlock()
+	hb.fanOut(m)
 }
 
-func (hm *hubManager) getUsersFromHub(hubID string) *map[*connection]bool {
-	hub := hm.HubMap[hubID]
-	connections := hm.EdgeMap.Hub_to_users[hub]
+// fanOut queues m on every connection in the hub. hb.sendMu must be held.
+func (hb *hub) fanOut(m msg) {
+	hb.mu.RLock()
+	defer hb.mu.RUnlock()
 
-	return &connections
+	for c := range hb.connections {
+		hb.deliver(c, m)
+	}
 }
 
-func (hm *hubManager) getRoom(userID string) *map[*hub]bool {
-	userConn := hm.UserMap[userID]
-	userHubs := hm.EdgeMap.User_to_hubs[userConn]
+// members returns a snapshot of the connections in the hub.
+func (hb *hub) members() []*connection {
+	hb.mu.RLock()
+	defer hb.mu.RUnlock()
+
+	conns := make([]*connection, 0, len(hb.connections))
+	for c := range hb.connections {
+		conns = append(conns, c)
+	}
+	return conns
+}
 
-	return &userHubs
+func (hb *hub) archived() bool {
+	hb.mu.RLock()
+	defer hb.mu.RUnlock()
+	return hb.Archived
 }
 
-func createHub(user sessionauth.User, newHub hub, rend render.Render, req *http.Request) {
+func (hb *hub) slowPolicy() string {
+	if hb.SlowPolicy == "" {
+		return defaultSlowPolicy
+	}
+	return hb.SlowPolicy
+}
 
-	var hubInDB hub
-	query := r.Table("hub").Filter(r.Row.Field("name").Eq(newHub.HubName))
-	row, err := query.RunRow(dbSession)
+// deliver queues m on c without ever blocking the hub. If c is too slow
+// to keep its buffer drained, the hub's slow policy decides what happens.
+// Called with hb.mu held, so it must not touch the registry.
+func (hb *hub) deliver(c *connection, m msg) {
+	select {
+	case c.send <- m:
+		return
+	default:
+	}
 
-	if err == nil && !row.IsNil() {
-		// Register, error case.
-		if err := row.Scan(&hubInDB); err != nil {
-			fmt.Println("Error reading DB")
-		} else {
-			fmt.Println("User already exists. Redirecting to login.")
+	switch hb.slowPolicy() {
+	case slowPolicyDisconnect:
+		c.kick(websocket.CloseTryAgainLater, "too slow, messages were backing up")
+	case slowPolicyResync:
+		// m is queued for the history, the write pump waits for it to be
+		// saved before telling the client to fetch it from there
+		c.needResync(m.HubID, m.ID)
+	default:
+		// make room by dropping the oldest message in the buffer
+		select {
+		case old := <-c.send:
+			if old.HubID != "" {
+				c.addGap(old.HubID)
+			}
+		default:
+		}
+		select {
+		case c.send <- m:
+		default:
+			c.addGap(m.HubID)
 		}
+	}
+}
 
-		rend.Redirect(sessionauth.RedirectUrl)
-		return
-	} else { // User doesn't exist, continue with registration.
-		if row.IsNil() {
-			fmt.Println("User doesn't exist. Registering...")
-		} else {
-			fmt.Println(err)
+// Get hub from the DB by id and populate it into 'gb'
+// This is not a complete representation of hub, since it
+// will only have ID and name after querying. (no conns or anything)
+// The real hub is in h.hubMap[] which is an in-memory store
+func (hb *hub) GetById(id string) error {
+
+	row, err := r.Table("hub").Get(id).RunRow(dbSession)
+	if err != nil {
+		return err
+	}
+	if !row.IsNil() {
+		if err := row.Scan(&hb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (hb *hub) GetByName(workspaceID, hbName string) error {
+	row, err := r.Table("hub").GetAllByIndex("workspace_name", []interface{}{workspaceID, hbName}).RunRow(dbSession)
+
+	if err != nil {
+		fmt.Println("Error getbyname filter.")
+		return err
+	}
+	if !row.IsNil() {
+		if err := row.Scan(&hb); err != nil {
+			fmt.Println("Error scanning hub from db.")
+			return err
 		}
 	}
+	return nil
+}
 
-	r.Table("hub").Insert(newHub).RunWrite(dbSession)
-	fmt.Println("New hub done. Try to con")
+func getHub(session sessions.Session, r render.Render) {
+	r.HTML(200, "room", page(session, map[string]interface{}{
+		"WSPath":      "/ws",
+		"HistoryPath": "/hub/",
+	}))
+}
 
-	rend.Redirect(sessionauth.RedirectUrl)
+// getUsersFromHub returns a snapshot of the connections in a hub.
+func (hm *hubManager) getUsersFromHub(hubID string) []*connection {
+	hb := hm.getHub(hubID)
+	if hb == nil {
+		return nil
+	}
+	return hb.members()
+}
+
+// getRoom returns a snapshot of the hubs a user is in.
+func (hm *hubManager) getRoom(userID string) []*hub {
+	c := hm.getConn(userID)
+	if c == nil {
+		return nil
+	}
+	return c.rooms()
+}
+
+// createHub - creates the hub named in the URL in the user's workspace if
+// it doesn't exist yet, and replies with it so the client can join by ID.
+func createHub(params martini.Params, user sessionauth.User, rend render.Render, req *http.Request) {
+	currUser := user.(*User)
+	hb, created, err := newHub(currUser.WorkspaceID, params["name"], nil)
+	if err != nil {
+		rend.JSON(500, map[string]string{"error": "error creating hub"})
+		return
+	}
+	if created {
+		logAudit(req, currUser, auditHubCreate, "hub", hb.HubID, map[string]string{"name": hb.HubName, "workspace": hb.WorkspaceID})
+	}
+	rend.JSON(200, map[string]string{"id": hb.HubID, "name": hb.HubName})
 }
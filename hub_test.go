@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Like the server, the tests need RethinkDB at RETHINKDB_ADDRESS for the
+// package init. Nothing here touches the DB or the cluster bus though,
+// only the in-memory registry and fan-out.
+
+// testHub returns a hub with n members, and the members themselves.
+func testHub(n, buffer int) (*hub, []*connection) {
+	hb := &hub{HubID: "test-hub", HubName: "test", connections: make(map[*connection]bool)}
+	conns := make([]*connection, n)
+	for i := range conns {
+		c := newConnection(fmt.Sprint("user-", i), fmt.Sprint("user ", i), roleUser, nil)
+		c.send = make(chan msg, buffer)
+		hb.connections[c] = true
+		conns[i] = c
+	}
+	return hb, conns
+}
+
+// drain empties the members' send buffers until stop is closed, like
+// their write pumps would.
+func drain(conns []*connection, stop chan struct{}) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *connection) {
+			defer wg.Done()
+			for {
+				select {
+				case <-c.send:
+				case <-stop:
+					return
+				}
+			}
+		}(c)
+	}
+	return &wg
+}
+
+func TestBroadcastOrder(t *testing.T) {
+	const senders, perSender = 4, 250
+	hb, conns := testHub(5, senders*perSender)
+
+	var wg sync.WaitGroup
+	for s := 0; s < senders; s++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			for i := 0; i < perSender; i++ {
+				hb.broadcast(msg{ID: fmt.Sprint(s, "-", i), HubID: hb.HubID})
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	var want []string
+	for i, c := range conns {
+		if len(c.send) != senders*perSender {
+			t.Fatalf("member %d got %d messages, want %d", i, len(c.send), senders*perSender)
+		}
+		var got []string
+		for len(c.send) > 0 {
+			got = append(got, (<-c.send).ID)
+		}
+		if i == 0 {
+			want = got
+			continue
+		}
+		for j := range got {
+			if got[j] != want[j] {
+				t.Fatalf("member %d got %s as message %d, member 0 got %s", i, got[j], j, want[j])
+			}
+		}
+	}
+}
+
+func BenchmarkBroadcast(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprint(n, "-members"), func(b *testing.B) {
+			hb, conns := testHub(n, 64)
+			stop := make(chan struct{})
+			wg := drain(conns, stop)
+			m := msg{ID: "bench", HubID: hb.HubID, Body: "hello"}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				hb.broadcast(m)
+			}
+			b.StopTimer()
+			close(stop)
+			wg.Wait()
+		})
+	}
+}
+
+func BenchmarkBroadcastParallel(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprint(n, "-members"), func(b *testing.B) {
+			hb, conns := testHub(n, 64)
+			stop := make(chan struct{})
+			wg := drain(conns, stop)
+			m := msg{ID: "bench", HubID: hb.HubID, Body: "hello"}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					hb.broadcast(m)
+				}
+			})
+			b.StopTimer()
+			close(stop)
+			wg.Wait()
+		})
+	}
+}
+
+// registerHubs puts hubs hubs with perHub members each in the registry,
+// through h.join like real connections. The returned func takes them out.
+func registerHubs(hubs, perHub, buffer int) ([]string, []*connection, func()) {
+	ids := make([]string, hubs)
+	var conns []*connection
+	for i := range ids {
+		hb := h.addHub(&hub{HubID: fmt.Sprint("bench-hub-", i), HubName: fmt.Sprint("bench ", i)})
+		ids[i] = hb.HubID
+		for j := 0; j < perHub; j++ {
+			c := newConnection(fmt.Sprint("bench-user-", i, "-", j), "bench", roleUser, nil)
+			c.send = make(chan msg, buffer)
+			h.join(c, hb)
+			conns = append(conns, c)
+		}
+	}
+	return ids, conns, func() {
+		for _, c := range conns {
+			h.leaveAll(c)
+		}
+		for _, id := range ids {
+			s := h.shard(id)
+			s.mu.Lock()
+			delete(s.hubs, id)
+			s.mu.Unlock()
+		}
+	}
+}
+
+// BenchmarkRegistryBroadcast sends to thousands of hubs from many
+// goroutines at once, through the sharded registry. broadcastSaved takes
+// the same path as broadcast without the history writer, so the DB isn't
+// what's measured.
+func BenchmarkRegistryBroadcast(b *testing.B) {
+	for _, size := range []struct{ hubs, perHub int }{{1000, 10}, {5000, 10}, {2000, 25}} {
+		b.Run(fmt.Sprint(size.hubs, "-hubs-", size.hubs*size.perHub, "-conns"), func(b *testing.B) {
+			ids, conns, unregister := registerHubs(size.hubs, size.perHub, 16)
+			defer unregister()
+			stop := make(chan struct{})
+			wg := drain(conns, stop)
+
+			var next uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					hubID := ids[atomic.AddUint64(&next, 1)%uint64(len(ids))]
+					if err := h.broadcastSaved(hubID, msg{ID: "bench", HubID: hubID, Body: "hello"}); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			b.StopTimer()
+			close(stop)
+			wg.Wait()
+		})
+	}
+}
+
+// BenchmarkRegistryJoinLeave joins and leaves hubs across every shard
+// from many goroutines, with the registry full.
+func BenchmarkRegistryJoinLeave(b *testing.B) {
+	ids, _, unregister := registerHubs(5000, 10, 1)
+	defer unregister()
+
+	var next uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		n := atomic.AddUint64(&next, 1)
+		c := newConnection(fmt.Sprint("bench-joiner-", n), "joiner", roleUser, nil)
+		i := int(n)
+		for pb.Next() {
+			hb := h.getHub(ids[i%len(ids)])
+			h.join(c, hb)
+			h.leave(c, hb)
+			i += 7
+		}
+	})
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+)
+
+const (
+	// Wait this long before reopening a feed that failed, doubling up to
+	// maxFeedRetryWait while it keeps failing.
+	minFeedRetryWait = 1 * time.Second
+	maxFeedRetryWait = 30 * time.Second
+)
+
+// hubChange is a changefeed row from the hub table.
+// OldVal is nil for inserts, NewVal is nil for deletes.
+type hubChange struct {
+	NewVal *hub `gorethink:"new_val"`
+	OldVal *hub `gorethink:"old_val"`
+}
+
+// userChange is a changefeed row from the user table.
+type userChange struct {
+	NewVal *User `gorethink:"new_val"`
+	OldVal *User `gorethink:"old_val"`
+}
+
+// watchFeeds keeps hubManager in sync with changes other processes make
+// to the hub table and to user hub memberships. Runs forever.
+func watchFeeds() {
+	go keepFeed("hub", watchHubFeed)
+	go keepFeed("user", watchUserFeed)
+}
+
+// keepFeed runs watch again every time it fails, backing off while it
+// keeps failing. watch resyncs when it (re)starts, to pick up what
+// changed while the feed was down.
+func keepFeed(name string, watch func() error) {
+	wait := minFeedRetryWait
+	for {
+		started := time.Now()
+		err := watch()
+		fmt.Println("Changefeed", name, "stopped, retrying in", wait, err)
+
+		// it ran fine for a while, so this is a new problem
+		if time.Since(started) > maxFeedRetryWait {
+			wait = minFeedRetryWait
+		}
+		time.Sleep(wait)
+		if wait *= 2; wait > maxFeedRetryWait {
+			wait = maxFeedRetryWait
+		}
+	}
+}
+
+// watchHubFeed applies hub inserts, renames, admin changes and deletes.
+func watchHubFeed() error {
+	rows, err := r.Table("hub").Changes().Run(dbSession)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	// the feed is open, now catch up on anything we missed before it
+	if err := syncHubs(); err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		var change hubChange
+		if err := rows.Scan(&change); err != nil {
+			return err
+		}
+		if change.NewVal == nil {
+			if change.OldVal != nil {
+				h.removeHub(change.OldVal.HubID)
+			}
+			continue
+		}
+		h.applyHub(change.NewVal)
+	}
+	return rows.Err()
+}
+
+// watchUserFeed applies changes to the hubs of connected users.
+func watchUserFeed() error {
+	rows, err := r.Table("user").Changes().Run(dbSession)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if err := syncMemberships(); err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		var change userChange
+		if err := rows.Scan(&change); err != nil {
+			return err
+		}
+		if change.NewVal == nil {
+			continue // deleted users are cleaned up by whoever deleted them
+		}
+		if c := h.getConn(change.NewVal.Id); c != nil {
+			var oldHubs map[string]bool
+			if change.OldVal != nil {
+				oldHubs = change.OldVal.Hubs
+			}
+			h.applyMemberships(c, oldHubs, change.NewVal.Hubs)
+		}
+	}
+	return rows.Err()
+}
+
+// syncHubs reloads every hub from the DB, and drops the ones that are gone.
+func syncHubs() error {
+	rows, err := r.Table("hub").Run(dbSession)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	inDB := make(map[string]bool)
+	for rows.Next() {
+		hb := &hub{}
+		if err := rows.Scan(hb); err != nil {
+			return err
+		}
+		inDB[hb.HubID] = true
+		h.applyHub(hb)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	h.eachHub(func(hb *hub) {
+		if !inDB[hb.HubID] {
+			h.removeHub(hb.HubID)
+		}
+	})
+	return nil
+}
+
+// syncMemberships makes every connected user's hubs match the DB: hubs
+// saved there are joined, others are left. The default hub is always kept.
+func syncMemberships() error {
+	for _, c := range h.connections() {
+		if c.readOnly || c.guest {
+			continue // only ever in the default hub, or not saved at all
+		}
+		var defaultID string
+		if hb, err := h.defaultHub(c.workspaceID); err == nil {
+			defaultID = hb.HubID
+		}
+		var u User
+		if err := u.GetById(c.userID); err != nil {
+			return err
+		}
+		joined := make(map[string]bool)
+		for _, hb := range c.rooms() {
+			if hb.HubID != defaultID {
+				joined[hb.HubID] = true
+			}
+		}
+		h.applyMemberships(c, joined, u.Hubs)
+	}
+	return nil
+}
+
+// applyHub adds a hub from the DB to the registry, or updates the loaded
+// one and tells its members if it changed.
+func (hm *hubManager) applyHub(from *hub) {
+	hb := hm.getHub(from.HubID)
+	if hb == nil {
+		hm.addHub(from)
+		return
+	}
+	oldPins := hb.pinnedIDs()
+	if hb.update(from) {
+		hb.broadcast(msg{Type: msgTypeHubUpdated, HubID: hb.HubID, Body: from.HubName})
+	}
+	if !samePins(oldPins, from.Pinned) {
+		hb.broadcast(msg{Type: msgTypePinsUpdated, HubID: hb.HubID, Pinned: hb.pinnedMessages()})
+	}
+	if !hb.guestAccess() {
+		hm.dropGuests(hb)
+	}
+}
+
+// applyMemberships applies a change of a user's hubs in the DB to their
+// connection: hubs only in oldHubs are left, hubs in newHubs are joined.
+func (hm *hubManager) applyMemberships(c *connection, oldHubs, newHubs map[string]bool) {
+	joined := make(map[string]*hub)
+	for _, hb := range c.rooms() {
+		joined[hb.HubID] = hb
+	}
+
+	for hubID := range oldHubs {
+		if hb := joined[hubID]; hb != nil && !newHubs[hubID] {
+			hm.leave(c, hb)
+		}
+	}
+	for hubID, in := range newHubs {
+		if !in || joined[hubID] != nil {
+			continue
+		}
+		hb, err := hm.findHub(hubID)
+		if err != nil {
+			fmt.Println("Error joining hub from membership change.", err)
+			continue
+		}
+		hm.join(c, hb)
+	}
+}
+
+// update copies the DB fields of from into hb.
+// Returns true if anything members can see changed.
+func (hb *hub) update(from *hub) bool {
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+
+	changed := hb.HubName != from.HubName || hb.Archived != from.Archived
+	hb.HubName = from.HubName
+	hb.HubAdmins = from.HubAdmins
+	hb.SlowPolicy = from.SlowPolicy
+	hb.Archived = from.Archived
+	hb.GuestAccess = from.GuestAccess
+	hb.Pinned = from.Pinned
+	return changed
+}
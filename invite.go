@@ -0,0 +1,448 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessionauth"
+	"github.com/martini-contrib/sessions"
+)
+
+const (
+	// Roles an invite can give in its hub or workspace.
+	inviteRoleMember = "member"
+	inviteRoleAdmin  = "admin"
+
+	// Session key of an invite opened before logging in, it's accepted
+	// once they have.
+	inviteTokenKey = "invite_token"
+
+	// Longest an invite can work for.
+	maxInviteTTL = 30 * 24 * time.Hour
+)
+
+var (
+	errInviteUsed       = errors.New("invite revoked, expired or used up")
+	errInviteEmail      = errors.New("invite is for another email")
+	errInviteUnverified = errors.New("invite needs a verified email")
+	errInviteElsewhere  = errors.New("user is in another workspace")
+)
+
+// invite lets whoever has the link into a workspace, or into a hub and its
+// workspace. Only the hash of the token is stored, the token itself is only
+// in the link.
+type invite struct {
+	Id          string    `json:"id" gorethink:"id"` // sha256 of the token
+	WorkspaceID string    `json:"workspace_id" gorethink:"workspace_id"`
+	HubID       string    `json:"hub_id,omitempty" gorethink:"hub_id,omitempty"`
+	Email       string    `json:"email,omitempty" gorethink:"email,omitempty"` // "" for anyone
+	Role        string    `json:"role" gorethink:"role"`
+	MaxUses     int       `json:"max_uses,omitempty" gorethink:"max_uses"` // 0 for no limit
+	Uses        int       `json:"uses" gorethink:"uses"`
+	Expires     time.Time `json:"expires,omitempty" gorethink:"expires,omitempty"`
+	Revoked     bool      `json:"revoked,omitempty" gorethink:"revoked,omitempty"`
+	CreatedBy   string    `json:"created_by" gorethink:"created_by"`
+	Created     time.Time `json:"created" gorethink:"created"`
+
+	// For the invites list, not stored
+	Target string `json:"target,omitempty" gorethink:"-"`
+}
+
+func init() {
+	_, err := r.Table("invite").IndexCreate("workspace_id").Run(dbSession)
+	fmt.Println("create index invite workspace_id error: ", err)
+	_, err = r.Table("invite").IndexCreate("created_by").Run(dbSession)
+	fmt.Println("create index invite created_by error: ", err)
+}
+
+// usable reports if the invite can still let someone in.
+func (inv *invite) usable() bool {
+	if inv.Revoked || (inv.MaxUses > 0 && inv.Uses >= inv.MaxUses) {
+		return false
+	}
+	return inv.Expires.IsZero() || time.Now().Before(inv.Expires)
+}
+
+// canInvite reports if u can mint invites to hb, or to ws when hb is nil.
+// Workspace admins can invite to the workspace and all its hubs, hub
+// admins only to their hub.
+func canInvite(u *User, ws *workspace, hb *hub) bool {
+	if u.Role == roleAdmin {
+		return true
+	}
+	if ws != nil && ws.isAdmin(u) {
+		return true
+	}
+	if hb == nil {
+		return false
+	}
+	hb.mu.RLock()
+	defer hb.mu.RUnlock()
+	return hb.HubAdmins[u.Id] > 0
+}
+
+// canManageInvite reports if u can see and revoke inv.
+func canManageInvite(u *User, inv *invite) bool {
+	if inv.CreatedBy == u.Id || u.Role == roleAdmin {
+		return true
+	}
+	ws, err := getWorkspace(inv.WorkspaceID)
+	if err != nil {
+		return false
+	}
+	var hb *hub
+	if inv.HubID != "" {
+		if hb, err = h.findHub(inv.HubID); err != nil {
+			return false
+		}
+	}
+	return canInvite(u, ws, hb)
+}
+
+// newInvite stores an invite and returns the link to accept it.
+func newInvite(inv *invite) (string, error) {
+	token := randomID(32)
+	inv.Id = hashToken(token)
+	inv.Email = strings.ToLower(inv.Email)
+	inv.Created = time.Now()
+	if _, err := r.Table("invite").Insert(inv).RunWrite(dbSession); err != nil {
+		return "", err
+	}
+	return inviteLink(token), nil
+}
+
+func inviteLink(token string) string {
+	return baseURL + "/invite/" + token
+}
+
+// getInvite looks up an invite by ID, the hash of its token.
+func getInvite(id string) (*invite, error) {
+	row, err := r.Table("invite").Get(id).RunRow(dbSession)
+	if err != nil {
+		return nil, err
+	}
+	if row.IsNil() {
+		return nil, errors.New("unknown invite")
+	}
+	var inv invite
+	if err := row.Scan(&inv); err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+// listInvites returns the invites u can manage that can still be used,
+// newest first. Admins of the workspace see all of them, others only
+// the ones they made.
+func listInvites(u *User, ws *workspace) ([]invite, error) {
+	q := r.Table("invite").GetAllByIndex("created_by", u.Id)
+	if (ws != nil && ws.isAdmin(u)) || (u.WorkspaceID == defaultWorkspaceID && u.Role == roleAdmin) {
+		q = r.Table("invite").GetAllByIndex("workspace_id", u.WorkspaceID)
+	}
+	rows, err := q.OrderBy(r.Desc("created")).Run(dbSession)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := []invite{}
+	for rows.Next() {
+		var inv invite
+		if err := rows.Scan(&inv); err != nil {
+			return nil, err
+		}
+		if !inv.usable() {
+			continue
+		}
+		inv.Target = "the workspace"
+		if inv.HubID != "" {
+			if hb := h.getHub(inv.HubID); hb != nil {
+				hb.mu.RLock()
+				inv.Target = hb.HubName
+				hb.mu.RUnlock()
+			} else {
+				inv.Target = inv.HubID
+			}
+		}
+		invites = append(invites, inv)
+	}
+	return invites, rows.Err()
+}
+
+// inviteHubs returns the hubs of u's workspace u can invite people to.
+func inviteHubs(u *User, ws *workspace) ([]*hub, error) {
+	rows, err := r.Table("hub").
+		Filter(r.Row.Field("workspace_id").Default(defaultWorkspaceID).Eq(u.WorkspaceID)).
+		OrderBy("name").
+		Run(dbSession)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hubs := []*hub{}
+	for rows.Next() {
+		var hb hub
+		if err := rows.Scan(&hb); err != nil {
+			return nil, err
+		}
+		if canInvite(u, ws, &hb) {
+			hubs = append(hubs, &hb)
+		}
+	}
+	return hubs, rows.Err()
+}
+
+// acceptInvite lets u in. Users still in the default workspace are moved
+// into the invite's workspace first. A use is only counted if the user
+// wasn't in already. Invites for an email need that email verified, or
+// anyone could sign up with it and take the invite.
+func acceptInvite(inv *invite, u *User) error {
+	if !inv.usable() {
+		return errInviteUsed
+	}
+	if inv.Email != "" && !strings.EqualFold(inv.Email, u.Email) {
+		return errInviteEmail
+	}
+	if inv.Email != "" && u.Unverified {
+		return errInviteUnverified
+	}
+	if u.WorkspaceID != inv.WorkspaceID && u.WorkspaceID != defaultWorkspaceID {
+		return errInviteElsewhere
+	}
+	if u.WorkspaceID == inv.WorkspaceID && (inv.HubID == "" || u.Hubs[inv.HubID]) && inv.Role != inviteRoleAdmin {
+		return nil // nothing to do
+	}
+
+	// claim a use, the check and the update are one write so the last
+	// use can't be taken twice
+	res, err := r.Table("invite").Get(inv.Id).Update(r.Branch(
+		r.Row.Field("revoked").Default(false).Not().And(
+			r.Row.Field("max_uses").Eq(0).Or(r.Row.Field("uses").Lt(r.Row.Field("max_uses")))),
+		map[string]interface{}{"uses": r.Row.Field("uses").Add(1)},
+		map[string]interface{}{},
+	)).RunWrite(dbSession)
+	if err != nil {
+		return err
+	}
+	if res.Replaced == 0 {
+		return errInviteUsed
+	}
+
+	if u.WorkspaceID != inv.WorkspaceID {
+		if err := moveToWorkspace(u.Id, inv.WorkspaceID); err != nil {
+			return err
+		}
+		u.WorkspaceID, u.Hubs = inv.WorkspaceID, nil
+	}
+
+	if inv.Role == inviteRoleAdmin {
+		if inv.HubID != "" {
+			_, err = r.Table("hub").Get(inv.HubID).
+				Update(map[string]interface{}{"admins": map[string]int{u.Id: 1}}).
+				RunWrite(dbSession)
+		} else {
+			_, err = r.Table("workspace").Get(inv.WorkspaceID).
+				Update(map[string]interface{}{"admins": map[string]bool{u.Id: true}}).
+				RunWrite(dbSession)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// the user feed joins their connections to the hub, on every node
+	if inv.HubID != "" {
+		return saveMembership(u.Id, inv.HubID, true)
+	}
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// HANDLERS
+//-----------------------------------------------------------------------------
+
+// postInviteHandler - POST /invites, mints an invite to the user's
+// workspace, or to one of its hubs. Takes hub, email, role, max_uses and
+// expires_in (hours). Invites with an email are mailed and work once.
+func postInviteHandler(session sessions.Session, user sessionauth.User, rend render.Render, req *http.Request) {
+	u := user.(*User)
+	ws, err := getWorkspace(u.WorkspaceID)
+	if err != nil {
+		fmt.Println("Error loading workspace.", err)
+		session.AddFlash("Couldn't create the invite, try again.")
+		rend.Redirect("/workspace")
+		return
+	}
+
+	inv := &invite{
+		WorkspaceID: u.WorkspaceID,
+		Email:       strings.TrimSpace(req.FormValue("email")),
+		Role:        req.FormValue("role"),
+		CreatedBy:   u.Id,
+	}
+	var hb *hub
+	if hubID := req.FormValue("hub"); hubID != "" {
+		if hb, err = workspaceHub(u, hubID); err != nil {
+			session.AddFlash("No such hub.")
+			rend.Redirect("/workspace")
+			return
+		}
+		inv.HubID = hb.HubID
+	}
+	if !canInvite(u, ws, hb) || (hb == nil && ws == nil) {
+		session.AddFlash("You can't invite people there.")
+		rend.Redirect("/workspace")
+		return
+	}
+
+	problems := []string{}
+	if inv.Role == "" {
+		inv.Role = inviteRoleMember
+	}
+	if inv.Role != inviteRoleMember && inv.Role != inviteRoleAdmin {
+		problems = append(problems, "Unknown role.")
+	}
+	if inv.Email != "" {
+		if problem := validateEmail(inv.Email); problem != "" {
+			problems = append(problems, problem)
+		}
+		inv.MaxUses = 1
+	} else if s := req.FormValue("max_uses"); s != "" {
+		if inv.MaxUses, err = strconv.Atoi(s); err != nil || inv.MaxUses < 0 {
+			problems = append(problems, "Max uses has to be a number, 0 for no limit.")
+		}
+	}
+	if s := req.FormValue("expires_in"); s != "" {
+		hours, err := strconv.Atoi(s)
+		ttl := time.Duration(hours) * time.Hour
+		if err != nil || hours < 0 || ttl > maxInviteTTL {
+			problems = append(problems, fmt.Sprintf("Invites expire within %d days.", maxInviteTTL/(24*time.Hour)))
+		} else if hours > 0 {
+			inv.Expires = time.Now().Add(ttl)
+		}
+	}
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			session.AddFlash(problem)
+		}
+		rend.Redirect("/workspace")
+		return
+	}
+
+	link, err := newInvite(inv)
+	if err != nil {
+		fmt.Println("Error creating invite.", err)
+		session.AddFlash("Couldn't create the invite, try again.")
+		rend.Redirect("/workspace")
+		return
+	}
+	logAudit(req, u, auditInviteCreate, "invite", inv.Id, map[string]string{
+		"workspace": inv.WorkspaceID,
+		"hub":       inv.HubID,
+		"email":     inv.Email,
+		"role":      inv.Role,
+	})
+
+	if inv.Email == "" {
+		session.AddFlash("Invite link: " + link)
+		rend.Redirect("/workspace")
+		return
+	}
+	where := "a workspace"
+	if ws != nil {
+		where = "the " + ws.Name + " workspace"
+	}
+	if hb != nil {
+		hb.mu.RLock()
+		where = "the " + hb.HubName + " hub"
+		hb.mu.RUnlock()
+	}
+	body := fmt.Sprintf("You're invited to %s on ChatGo.\n\n"+
+		"Open this link to join, you can sign up first if you don't have an account:\n\n%s\n", where, link)
+	if err := sendMail(inv.Email, "You're invited to ChatGo", body); err != nil {
+		fmt.Println("Error sending invite mail.", err)
+		session.AddFlash("Couldn't send the invite, here's the link to send yourself: " + link)
+	} else {
+		session.AddFlash("Invite sent to " + inv.Email + ".")
+	}
+	rend.Redirect("/workspace")
+}
+
+// getInviteHandler - GET /invite/:token, where invite links go. Visitors
+// that aren't logged in are sent to log in or sign up, and the invite is
+// accepted once they have, see finishLogin.
+func getInviteHandler(params martini.Params, session sessions.Session, user sessionauth.User, rend render.Render, req *http.Request) {
+	token := params["token"]
+	if !user.IsAuthenticated() {
+		session.Set(inviteTokenKey, token)
+		session.AddFlash("Log in, or register if you're new, to accept the invite.")
+		rend.Redirect(sessionauth.RedirectUrl + "?" + sessionauth.RedirectParam + "=/invite/" + token)
+		return
+	}
+	session.Delete(inviteTokenKey)
+
+	u := user.(*User)
+	inv, err := getInvite(hashToken(token))
+	if err == nil {
+		err = acceptInvite(inv, u)
+	}
+	switch err {
+	case nil:
+	case errInviteEmail:
+		session.AddFlash("That invite is for another email, log in with " + inv.Email + ".")
+		rend.Redirect(INDEX_PAGE)
+		return
+	case errInviteUnverified:
+		session.AddFlash("Verify your email, then open the invite link again.")
+		rend.Redirect(INDEX_PAGE)
+		return
+	case errInviteElsewhere:
+		session.AddFlash("Leave your workspace before accepting an invite to another.")
+		rend.Redirect("/workspace")
+		return
+	default:
+		if err != errInviteUsed {
+			fmt.Println("Error accepting invite.", err)
+		}
+		session.AddFlash("That invite doesn't work anymore, ask for a new one.")
+		rend.Redirect(INDEX_PAGE)
+		return
+	}
+
+	logAudit(req, u, auditInviteAccept, "invite", inv.Id, map[string]string{
+		"workspace": inv.WorkspaceID,
+		"hub":       inv.HubID,
+	})
+	session.AddFlash("You're in!")
+	rend.Redirect("/hub")
+}
+
+// postRevokeInviteHandler - POST /invites/:id/revoke
+func postRevokeInviteHandler(params martini.Params, session sessions.Session, user sessionauth.User, rend render.Render, req *http.Request) {
+	u := user.(*User)
+	inv, err := getInvite(params["id"])
+	if err != nil || !canManageInvite(u, inv) {
+		session.AddFlash("No such invite.")
+		rend.Redirect("/workspace")
+		return
+	}
+
+	_, err = r.Table("invite").Get(inv.Id).Update(map[string]interface{}{"revoked": true}).RunWrite(dbSession)
+	if err != nil {
+		fmt.Println("Error revoking invite.", err)
+		session.AddFlash("Couldn't revoke the invite, try again.")
+		rend.Redirect("/workspace")
+		return
+	}
+	logAudit(req, u, auditInviteRevoke, "invite", inv.Id, nil)
+	session.AddFlash("Invite revoked.")
+	rend.Redirect("/workspace")
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAcceptInviteNeedsVerifiedEmail(t *testing.T) {
+	inv := &invite{
+		Id:          "invite",
+		WorkspaceID: "ws",
+		Email:       "carol@example.com",
+		Role:        inviteRoleMember,
+		Expires:     time.Now().Add(time.Hour),
+	}
+
+	tests := []struct {
+		email      string
+		unverified bool
+		want       error
+	}{
+		{"carol@example.com", true, errInviteUnverified},
+		{"Carol@Example.com", true, errInviteUnverified},
+		{"mallory@example.com", true, errInviteEmail},
+		{"mallory@example.com", false, errInviteEmail},
+	}
+	for _, tt := range tests {
+		u := &User{Id: "u", Email: tt.email, Unverified: tt.unverified, WorkspaceID: defaultWorkspaceID}
+		if err := acceptInvite(inv, u); err != tt.want {
+			t.Errorf("%s, unverified %v: got %v, want %v", tt.email, tt.unverified, err, tt.want)
+		}
+	}
+
+	// already in, so there's nothing to write
+	u := &User{Id: "u", Email: "carol@example.com", WorkspaceID: "ws"}
+	if err := acceptInvite(inv, u); err != nil {
+		t.Errorf("verified member: got %v, want nil", err)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"code.google.com/p/go.crypto/bcrypt"
+	r "github.com/dancannon/gorethink"
+	"github.com/go-ldap/ldap"
+)
+
+// ldapAuthProvider checks passwords against an LDAP directory. It looks the
+// user up with a service account, then binds as them to check the password.
+// Users are copied into the user table on their first login.
+//
+//	LDAP_ADDR            host:port of the server
+//	LDAP_TLS             "ldaps", "starttls" or empty for plain
+//	LDAP_BIND_DN         service account, empty for anonymous search
+//	LDAP_BIND_PASSWORD
+//	LDAP_BASE_DN         where users are searched
+//	LDAP_USER_FILTER     default (mail=%s), %s is the escaped email
+//	LDAP_GROUP_ATTR      default memberOf
+//	LDAP_ADMIN_GROUP     members get the admin role
+//	LDAP_HUB_ADMINS      group DN to hub names, members admin those hubs,
+//	                     eg. '{"cn=ops,ou=groups,dc=example,dc=com":["ops"]}'
+type ldapAuthProvider struct {
+	addr       string
+	tlsMode    string
+	bindDN     string
+	bindPass   string
+	baseDN     string
+	userFilter string
+	groupAttr  string
+	adminGroup string
+	hubAdmins  map[string][]string
+
+	// connect opens a connection to the directory, p.dial unless a test
+	// puts a stand-in directory there.
+	connect func() (ldapConn, error)
+}
+
+// ldapConn is what we use of a directory connection.
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close()
+}
+
+// Slow directories shouldn't hang logins.
+const ldapTimeout = 10 * time.Second
+
+func newLDAPAuthProvider() (*ldapAuthProvider, error) {
+	p := &ldapAuthProvider{
+		addr:       os.Getenv("LDAP_ADDR"),
+		tlsMode:    os.Getenv("LDAP_TLS"),
+		bindDN:     os.Getenv("LDAP_BIND_DN"),
+		bindPass:   os.Getenv("LDAP_BIND_PASSWORD"),
+		baseDN:     os.Getenv("LDAP_BASE_DN"),
+		userFilter: os.Getenv("LDAP_USER_FILTER"),
+		groupAttr:  os.Getenv("LDAP_GROUP_ATTR"),
+		adminGroup: os.Getenv("LDAP_ADMIN_GROUP"),
+		hubAdmins:  make(map[string][]string),
+	}
+	p.connect = p.dial
+	if p.addr == "" || p.baseDN == "" {
+		return nil, errors.New("LDAP_ADDR and LDAP_BASE_DN are required")
+	}
+	if p.userFilter == "" {
+		p.userFilter = "(mail=%s)"
+	}
+	if p.groupAttr == "" {
+		p.groupAttr = "memberOf"
+	}
+	if s := os.Getenv("LDAP_HUB_ADMINS"); s != "" {
+		if err := json.Unmarshal([]byte(s), &p.hubAdmins); err != nil {
+			return nil, fmt.Errorf("parsing LDAP_HUB_ADMINS: %v", err)
+		}
+	}
+	return p, nil
+}
+
+func (p *ldapAuthProvider) Name() string { return "ldap" }
+
+func (p *ldapAuthProvider) dial() (ldapConn, error) {
+	var conn *ldap.Conn
+	var err error
+
+	host := p.addr
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		host = host[:i]
+	}
+	tlsConfig := &tls.Config{ServerName: host}
+
+	switch p.tlsMode {
+	case "ldaps":
+		conn, err = ldap.DialTLS("tcp", p.addr, tlsConfig)
+	default:
+		conn, err = ldap.Dial("tcp", p.addr)
+		if err == nil && p.tlsMode == "starttls" {
+			if err = conn.StartTLS(tlsConfig); err != nil {
+				conn.Close()
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(ldapTimeout)
+	return conn, nil
+}
+
+func (p *ldapAuthProvider) Authenticate(email, password string) (*User, error) {
+	entry, err := p.lookup(email, password)
+	if err != nil {
+		return nil, err
+	}
+	return p.syncUser(email, entry)
+}
+
+// lookup finds the directory entry for an email and checks the password
+// by binding as it.
+func (p *ldapAuthProvider) lookup(email, password string) (*ldap.Entry, error) {
+	// an empty password is an anonymous bind, which always works
+	if password == "" {
+		return nil, errWrongPassword
+	}
+
+	// until the user's own bind, anything going wrong is the directory's
+	// problem, and the next provider gets a try
+	conn, err := p.connect()
+	if err != nil {
+		fmt.Println("LDAP server unreachable.", err)
+		return nil, errProviderDown
+	}
+	defer conn.Close()
+
+	if p.bindDN != "" {
+		if err := conn.Bind(p.bindDN, p.bindPass); err != nil {
+			fmt.Println("LDAP service bind failed.", err)
+			return nil, errProviderDown
+		}
+	}
+
+	search := ldap.NewSearchRequest(
+		p.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(ldapTimeout/time.Second), false,
+		fmt.Sprintf(p.userFilter, ldap.EscapeFilter(email)),
+		[]string{"dn", "mail", "uid", "cn", p.groupAttr},
+		nil,
+	)
+	res, err := conn.Search(search)
+	if err != nil {
+		fmt.Println("LDAP search failed.", err)
+		return nil, errProviderDown
+	}
+	if len(res.Entries) == 0 {
+		return nil, errUnknownUser
+	}
+	if len(res.Entries) > 1 {
+		return nil, fmt.Errorf("more than one entry for %s", email)
+	}
+	entry := res.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		return nil, errWrongPassword
+	}
+	return entry, nil
+}
+
+// groups returns the lowercased group DNs of an entry.
+func (p *ldapAuthProvider) groups(entry *ldap.Entry) map[string]bool {
+	groups := make(map[string]bool)
+	for _, g := range entry.GetAttributeValues(p.groupAttr) {
+		groups[strings.ToLower(g)] = true
+	}
+	return groups
+}
+
+// role is the role the groups give, roleUser without the admin group.
+func (p *ldapAuthProvider) role(groups map[string]bool) string {
+	if p.adminGroup != "" && groups[strings.ToLower(p.adminGroup)] {
+		return roleAdmin
+	}
+	return roleUser
+}
+
+// hubAdminChanges splits the mapped hub names into those the groups make
+// the user admin of, and those they don't.
+func (p *ldapAuthProvider) hubAdminChanges(groups map[string]bool) (grant, revoke map[string]bool) {
+	grant = make(map[string]bool)
+	revoke = make(map[string]bool)
+	for group, hubNames := range p.hubAdmins {
+		for _, name := range hubNames {
+			if groups[strings.ToLower(group)] {
+				grant[name] = true
+			} else {
+				revoke[name] = true
+			}
+		}
+	}
+	for name := range grant {
+		delete(revoke, name)
+	}
+	return grant, revoke
+}
+
+// syncUser makes sure the directory user has a local user, and applies
+// their group memberships to their role and hub admin rights.
+func (p *ldapAuthProvider) syncUser(email string, entry *ldap.Entry) (*User, error) {
+	groups := p.groups(entry)
+	role := p.role(groups)
+
+	u, err := findUserByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+
+	if u == nil {
+		// nobody can log in with this password, the directory has the real one
+		hash, err := bcrypt.GenerateFromPassword([]byte(randomID(32)), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		u = &User{
+			Email:      email,
+			Password:   string(hash),
+			Username:   entry.GetAttributeValue("uid"),
+			Role:       role,
+			Identities: map[string]string{p.Name(): entry.DN},
+		}
+		res, err := r.Table("user").Insert(u).RunWrite(dbSession)
+		if err != nil {
+			return nil, err
+		}
+		if len(res.GeneratedKeys) == 0 {
+			return nil, errors.New("no ID for new user")
+		}
+		u.Id = res.GeneratedKeys[0]
+		fmt.Println("Registered", email, "from LDAP")
+	} else {
+		changes := map[string]interface{}{
+			"unverified": false,
+			"identities": map[string]string{p.Name(): entry.DN},
+		}
+		// without an admin group, roles are managed in chatgo
+		oldRole := u.Role
+		if p.adminGroup != "" {
+			changes["role"] = role
+			u.Role = role
+		}
+		if _, err := r.Table("user").Get(u.Id).Update(changes).RunWrite(dbSession); err != nil {
+			return nil, err
+		}
+		if u.Role != oldRole {
+			logAudit(nil, nil, auditRoleChange, "user", u.Id, map[string]string{
+				"from": oldRole, "to": u.Role, "by": p.Name(),
+			})
+		}
+		u.Unverified = false
+	}
+
+	p.syncHubAdmins(u, groups)
+	return u, nil
+}
+
+// syncHubAdmins grants admin on the hubs mapped to the user's groups, and
+// takes it away on mapped hubs the user's groups no longer give. Hub names
+// are only unique inside a workspace, so only the user's own workspace is
+// looked at. The hub feed picks the changes up.
+func (p *ldapAuthProvider) syncHubAdmins(u *User, groups map[string]bool) {
+	grant, revoke := p.hubAdminChanges(groups)
+	for name := range grant {
+		_, err := r.Table("hub").GetAllByIndex("workspace_name", []interface{}{u.WorkspaceID, name}).
+			Update(map[string]interface{}{"admins": map[string]int{u.Id: 1}}).
+			RunWrite(dbSession)
+		if err != nil {
+			fmt.Println("Error granting hub admin.", err)
+		}
+	}
+	for name := range revoke {
+		_, err := r.Table("hub").GetAllByIndex("workspace_name", []interface{}{u.WorkspaceID, name}).
+			Replace(r.Row.Without(map[string]interface{}{"admins": map[string]bool{u.Id: true}})).
+			RunWrite(dbSession)
+		if err != nil {
+			fmt.Println("Error revoking hub admin.", err)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-ldap/ldap"
+)
+
+// fakeDirectory stands in for an LDAP server: entries by DN, with their
+// passwords, searched by the filter lookup sends.
+type fakeDirectory struct {
+	entries   []*ldap.Entry
+	passwords map[string]string
+	down      bool // dialing fails
+	searchErr error
+	binds     []string
+}
+
+type fakeDirectoryConn struct {
+	dir *fakeDirectory
+}
+
+func (d *fakeDirectory) add(dn, mail, password string, groups ...string) {
+	d.entries = append(d.entries, &ldap.Entry{DN: dn, Attributes: []*ldap.EntryAttribute{
+		{Name: "mail", Values: []string{mail}},
+		{Name: "memberOf", Values: groups},
+	}})
+	d.passwords[dn] = password
+}
+
+func (d *fakeDirectory) connect() (ldapConn, error) {
+	if d.down {
+		return nil, errors.New("connection refused")
+	}
+	return fakeDirectoryConn{d}, nil
+}
+
+func (c fakeDirectoryConn) Bind(dn, password string) error {
+	c.dir.binds = append(c.dir.binds, dn)
+	if pw, ok := c.dir.passwords[dn]; !ok || pw != password {
+		return errors.New("invalid credentials")
+	}
+	return nil
+}
+
+func (c fakeDirectoryConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if c.dir.searchErr != nil {
+		return nil, c.dir.searchErr
+	}
+	res := &ldap.SearchResult{}
+	for _, e := range c.dir.entries {
+		if req.Filter == fmt.Sprintf("(mail=%s)", ldap.EscapeFilter(e.GetAttributeValue("mail"))) {
+			res.Entries = append(res.Entries, e)
+		}
+	}
+	return res, nil
+}
+
+func (c fakeDirectoryConn) Close() {}
+
+func testLDAP() (*ldapAuthProvider, *fakeDirectory) {
+	dir := &fakeDirectory{passwords: make(map[string]string)}
+	dir.passwords["cn=svc,dc=example,dc=com"] = "svc-pass"
+	dir.add("uid=alice,dc=example,dc=com", "alice@example.com", "alice-pass", "cn=Admins,dc=example,dc=com", "cn=ops,dc=example,dc=com")
+	dir.add("uid=bob,dc=example,dc=com", "bob@example.com", "bob-pass")
+
+	p := &ldapAuthProvider{
+		bindDN:     "cn=svc,dc=example,dc=com",
+		bindPass:   "svc-pass",
+		baseDN:     "dc=example,dc=com",
+		userFilter: "(mail=%s)",
+		groupAttr:  "memberOf",
+		adminGroup: "cn=admins,dc=example,dc=com",
+		hubAdmins: map[string][]string{
+			"cn=ops,dc=example,dc=com": {"ops", "general"},
+			"cn=dev,dc=example,dc=com": {"dev", "general"},
+		},
+		connect: dir.connect,
+	}
+	return p, dir
+}
+
+func TestLDAPLookup(t *testing.T) {
+	p, dir := testLDAP()
+
+	entry, err := p.lookup("alice@example.com", "alice-pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.DN != "uid=alice,dc=example,dc=com" {
+		t.Fatalf("got entry %s", entry.DN)
+	}
+	if len(dir.binds) != 2 || dir.binds[0] != p.bindDN || dir.binds[1] != entry.DN {
+		t.Fatalf("binds were %v, want the service account then alice", dir.binds)
+	}
+
+	tests := []struct {
+		email, password string
+		want            error
+	}{
+		{"alice@example.com", "wrong", errWrongPassword},
+		{"alice@example.com", "", errWrongPassword},
+		{"bob@example.com", "alice-pass", errWrongPassword},
+		{"carol@example.com", "alice-pass", errUnknownUser},
+		{"*", "alice-pass", errUnknownUser},
+		{"alice@example.com)(mail=*", "alice-pass", errUnknownUser},
+	}
+	for _, tt := range tests {
+		if _, err := p.lookup(tt.email, tt.password); err != tt.want {
+			t.Errorf("%s/%s: got %v, want %v", tt.email, tt.password, err, tt.want)
+		}
+	}
+}
+
+func TestLDAPDirectoryDown(t *testing.T) {
+	p, dir := testLDAP()
+
+	dir.down = true
+	if _, err := p.lookup("alice@example.com", "alice-pass"); err != errProviderDown {
+		t.Fatalf("unreachable server: got %v, want errProviderDown", err)
+	}
+	dir.down = false
+
+	p.bindPass = "rotated"
+	if _, err := p.lookup("alice@example.com", "alice-pass"); err != errProviderDown {
+		t.Fatalf("failed service bind: got %v, want errProviderDown", err)
+	}
+	p.bindPass = "svc-pass"
+
+	dir.searchErr = errors.New("time limit exceeded")
+	if _, err := p.lookup("alice@example.com", "alice-pass"); err != errProviderDown {
+		t.Fatalf("failed search: got %v, want errProviderDown", err)
+	}
+}
+
+// staticAuthProvider knows one email and password.
+type staticAuthProvider struct {
+	email, password string
+}
+
+func (p staticAuthProvider) Name() string { return "static" }
+
+func (p staticAuthProvider) Authenticate(email, password string) (*User, error) {
+	if email != p.email {
+		return nil, errUnknownUser
+	}
+	if password != p.password {
+		return nil, errWrongPassword
+	}
+	return &User{Id: "static-user", Email: email}, nil
+}
+
+func TestAuthenticateFallsBackWhenDirectoryDown(t *testing.T) {
+	p, dir := testLDAP()
+	dir.down = true
+
+	orig := authProviders
+	authProviders = []authProvider{p, staticAuthProvider{"alice@example.com", "db-pass"}}
+	defer func() { authProviders = orig }()
+
+	u, err := authenticate("alice@example.com", "db-pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Id != "static-user" {
+		t.Fatalf("got user %+v", u)
+	}
+	if _, err := authenticate("alice@example.com", "alice-pass"); err == nil {
+		t.Fatal("the directory's password worked with the directory down")
+	}
+}
+
+func TestLDAPGroups(t *testing.T) {
+	p, _ := testLDAP()
+
+	alice, err := p.lookup("alice@example.com", "alice-pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups := p.groups(alice)
+	if role := p.role(groups); role != roleAdmin {
+		t.Errorf("alice's role is %s, want admin", role)
+	}
+	grant, revoke := p.hubAdminChanges(groups)
+	if !grant["ops"] || !grant["general"] || len(grant) != 2 {
+		t.Errorf("alice is granted %v, want ops and general", grant)
+	}
+	// general comes from ops as well, so not being in dev doesn't take it
+	if !revoke["dev"] || len(revoke) != 1 {
+		t.Errorf("alice loses %v, want only dev", revoke)
+	}
+
+	bob, err := p.lookup("bob@example.com", "bob-pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups = p.groups(bob)
+	if role := p.role(groups); role != roleUser {
+		t.Errorf("bob's role is %s, want user", role)
+	}
+	grant, revoke = p.hubAdminChanges(groups)
+	if len(grant) != 0 || len(revoke) != 3 {
+		t.Errorf("bob is granted %v and loses %v, want nothing and everything", grant, revoke)
+	}
+}
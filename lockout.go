@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessionauth"
+	"github.com/martini-contrib/sessions"
+)
+
+const (
+	// Failed logins allowed before we start making people wait.
+	freeLoginAttempts = 3
+
+	// The wait doubles with every failure after the free ones, up to this.
+	maxLoginBackoff = 15 * time.Minute
+
+	// This many failures in a row lock the account for lockoutDuration,
+	// and the owner gets an email.
+	lockoutThreshold = 10
+	lockoutDuration  = 30 * time.Minute
+
+	// An IP is forgotten after this long without failures.
+	ipFailureTTL = 1 * time.Hour
+)
+
+// trustProxy makes clientIP believe X-Forwarded-For. Only set TRUST_PROXY
+// when chatgo is behind a proxy that sets it, or anyone can pick their IP.
+var trustProxy = os.Getenv("TRUST_PROXY") != ""
+
+// ipFailures tracks failed logins per IP, so one IP can't try a password on
+// lots of accounts. It's in memory, so it's per node and resets on restart.
+type ipFailures struct {
+	mu sync.Mutex
+	ip map[string]*failureCount
+}
+
+type failureCount struct {
+	n    int
+	last time.Time
+}
+
+var loginFailures = &ipFailures{ip: make(map[string]*failureCount)}
+
+func init() {
+	go loginFailures.pruneLoop()
+}
+
+// loginBackoff is how long to wait after the last of n failures.
+func loginBackoff(n int) time.Duration {
+	if n < freeLoginAttempts {
+		return 0
+	}
+	wait := time.Duration(math.Pow(2, float64(n-freeLoginAttempts))) * time.Second
+	if wait > maxLoginBackoff || wait <= 0 {
+		wait = maxLoginBackoff
+	}
+	return wait
+}
+
+// wait returns how long ip has to wait before trying again.
+func (f *ipFailures) wait(ip string) time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fc := f.ip[ip]
+	if fc == nil {
+		return 0
+	}
+	return fc.last.Add(loginBackoff(fc.n)).Sub(time.Now())
+}
+
+func (f *ipFailures) fail(ip string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fc := f.ip[ip]
+	if fc == nil {
+		fc = &failureCount{}
+		f.ip[ip] = fc
+	}
+	fc.n++
+	fc.last = time.Now()
+}
+
+func (f *ipFailures) pruneLoop() {
+	ticker := time.NewTicker(ipFailureTTL / 4)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		f.mu.Lock()
+		for ip, fc := range f.ip {
+			if now.Sub(fc.last) > ipFailureTTL {
+				delete(f.ip, ip)
+			}
+		}
+		f.mu.Unlock()
+	}
+}
+
+// clientIP is the address a request came from.
+func clientIP(req *http.Request) string {
+	if trustProxy {
+		if fwd := req.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// accountWait returns how long u has to wait before trying again, and if
+// that's because the account is locked.
+func accountWait(u *User) (time.Duration, bool) {
+	now := time.Now()
+	if now.Before(u.LockedUntil) {
+		return u.LockedUntil.Sub(now), true
+	}
+	return u.LastFailedLogin.Add(loginBackoff(u.FailedLogins)).Sub(now), false
+}
+
+// loginWait returns how long a login for email from ip has to wait, 0 if it
+// can go ahead.
+func loginWait(email, ip string) (time.Duration, bool) {
+	wait := loginFailures.wait(ip)
+	locked := false
+	if u, err := findUserByEmail(email); err == nil && u != nil {
+		if w, l := accountWait(u); w > wait {
+			wait, locked = w, l
+		}
+	}
+	return wait, locked
+}
+
+// loginFailed counts a failed login against the IP and, if the email is a
+// user's, the account. The account is locked once it hits lockoutThreshold.
+func loginFailed(email, ip, method, reason string) {
+	loginFailures.fail(ip)
+
+	u, err := findUserByEmail(email)
+	if err != nil || u == nil {
+		saveAudit(loginAuditEvent("", email, ip, method, reason, false))
+		return
+	}
+
+	now := time.Now()
+	failures := u.FailedLogins + 1
+	changes := map[string]interface{}{
+		"failed_logins":     r.Row.Field("failed_logins").Default(0).Add(1),
+		"last_failed_login": now,
+	}
+	// a lock that ran out starts a fresh count, otherwise every bad
+	// password after the first lockout would lock the account again
+	if !u.LockedUntil.IsZero() && !now.Before(u.LockedUntil) {
+		failures = 1
+		changes["failed_logins"] = 1
+		changes["locked_until"] = time.Time{}
+	}
+	lock := failures >= lockoutThreshold
+	if lock {
+		changes["locked_until"] = now.Add(lockoutDuration)
+	}
+	if _, err := r.Table("user").Get(u.Id).Update(changes).RunWrite(dbSession); err != nil {
+		fmt.Println("Error counting failed login.", err)
+	}
+
+	saveAudit(loginAuditEvent(u.Id, email, ip, method, reason, false))
+
+	if lock {
+		fmt.Println("Locking account after too many failed logins:", u.Id)
+		saveAudit(auditEvent{Action: auditUserLock, TargetType: "user", TargetID: u.Id, IP: ip})
+		body := fmt.Sprintf("There were %d failed attempts to log in to your ChatGo account, "+
+			"the last one from %s.\n\n"+
+			"To keep it safe, logging in is blocked for the next %d minutes.\n"+
+			"If this wasn't you, consider resetting your password:\n\n%s/forgot\n",
+			failures, ip, int(lockoutDuration/time.Minute), baseURL)
+		if err := sendMail(u.Email, "Your ChatGo account was locked", body); err != nil {
+			fmt.Println("Error sending lockout mail.", err)
+		}
+	}
+}
+
+// loginSucceeded clears the failure count of the account.
+func loginSucceeded(u *User, ip, method string) {
+	if u.FailedLogins > 0 || !u.LockedUntil.IsZero() {
+		_, err := r.Table("user").Get(u.Id).Update(map[string]interface{}{
+			"failed_logins": 0,
+			"locked_until":  time.Time{},
+		}).RunWrite(dbSession)
+		if err != nil {
+			fmt.Println("Error clearing failed logins.", err)
+		}
+	}
+	saveAudit(loginAuditEvent(u.Id, u.Email, ip, method, "", true))
+}
+
+//-----------------------------------------------------------------------------
+// HANDLERS
+//-----------------------------------------------------------------------------
+
+// renderLoginWait shows the login page with how long to wait.
+func renderLoginWait(session sessions.Session, wait time.Duration, locked bool, rend render.Render) {
+	rend.HTML(429, LOGIN_PAGE, page(session, map[string]interface{}{
+		"Providers": oidcProviderList(),
+		"Locked":    locked,
+		"Wait":      int(math.Ceil(wait.Seconds())),
+	}))
+}
+
+// postUnlockHandler - POST /admin/users/:id/unlock, lets a locked out
+// user try again right away.
+func postUnlockHandler(params martini.Params, session sessions.Session, user sessionauth.User, rend render.Render, req *http.Request) {
+	u, ok := adminTarget(params)
+	if !ok {
+		adminReply(session, req, rend, 404, "No such user.")
+		return
+	}
+
+	_, err := r.Table("user").Get(u.Id).Update(map[string]interface{}{
+		"failed_logins": 0,
+		"locked_until":  time.Time{},
+	}).RunWrite(dbSession)
+	if err != nil {
+		fmt.Println("Error unlocking user.", err)
+		adminReply(session, req, rend, 500, "Error unlocking user.")
+		return
+	}
+
+	fmt.Println("User", u.Id, "unlocked by admin", user.(*User).Id)
+	logAudit(req, user.(*User), auditUserUnlock, "user", u.Id, nil)
+	adminReply(session, req, rend, 200, u.Email+" can log in again.")
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// mailer sends plain text emails.
+type mailer interface {
+	Send(to, subject, body string) error
+}
+
+// outbox is the mailer used for account emails.
+// Set MAIL_TRANSPORT=smtp to send through SMTP_ADDR, otherwise mails are
+// written to MAILBOX_DIR so they can be read during development.
+var outbox mailer
+
+// baseURL is put in front of links in emails. Override with BASE_URL.
+var baseURL = "http://localhost:3000"
+
+func init() {
+	if u := os.Getenv("BASE_URL"); u != "" {
+		baseURL = u
+	}
+
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "chatgo@localhost"
+	}
+
+	var err error
+	switch os.Getenv("MAIL_TRANSPORT") {
+	case "smtp":
+		outbox, err = newSMTPMailer(os.Getenv("SMTP_ADDR"), os.Getenv("SMTP_USER"), os.Getenv("SMTP_PASSWORD"), from)
+	default:
+		dir := os.Getenv("MAILBOX_DIR")
+		if dir == "" {
+			dir = "data/mailbox"
+		}
+		outbox, err = newMailboxMailer(dir, from)
+	}
+
+	if err != nil {
+		fmt.Println("Mail transport error, emails will not be sent.", err)
+		outbox = nil
+	}
+}
+
+// sendMail sends through the outbox, if there is one.
+func sendMail(to, subject, body string) error {
+	if outbox == nil {
+		return fmt.Errorf("no mail transport, dropping mail to %s", to)
+	}
+	return outbox.Send(to, subject, body)
+}
+
+// formatMail builds the raw message, headers and all.
+func formatMail(from, to, subject, body string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(body)
+	return buf.Bytes()
+}
+
+// smtpMailer sends mail through an SMTP server.
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func newSMTPMailer(addr, user, password, from string) (*smtpMailer, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("SMTP_ADDR must be set")
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &smtpMailer{addr: addr, from: from}
+	if user != "" {
+		m.auth = smtp.PlainAuth("", user, password, host)
+	}
+	fmt.Println("Sending mail through:", addr)
+	return m, nil
+}
+
+func (m *smtpMailer) Send(to, subject, body string) error {
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, formatMail(m.from, to, subject, body))
+}
+
+// mailboxMailer writes every mail to a file in a directory, and logs it.
+type mailboxMailer struct {
+	dir  string
+	from string
+}
+
+func newMailboxMailer(dir, from string) (*mailboxMailer, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	fmt.Println("Writing mail to:", dir)
+	return &mailboxMailer{dir: dir, from: from}, nil
+}
+
+func (m *mailboxMailer) Send(to, subject, body string) error {
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), randomID(4))
+	path := filepath.Join(m.dir, name)
+	fmt.Println("Mail to", to, "about", subject, "saved in", path)
+	return ioutil.WriteFile(path, formatMail(m.from, to, subject, body), 0600)
+}
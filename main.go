@@ -21,6 +21,10 @@ import (
 
 var dbSession *rethink.Session
 
+// appSecret signs links we send out, like email verification.
+// Set APP_SECRET, or links stop working every restart.
+var appSecret []byte
+
 func init() {
 	var rLimit syscall.Rlimit
 	syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rLimit)
@@ -29,6 +33,12 @@ func init() {
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
+	appSecret = []byte(os.Getenv("APP_SECRET"))
+	if len(appSecret) == 0 {
+		fmt.Println("APP_SECRET not set, using a random one.")
+		appSecret = []byte(randomID(32))
+	}
+
 	dbAddress := os.Getenv("RETHINKDB_ADDRESS")
 	dbName := os.Getenv("RETHINK_TODO_DB")
 
@@ -44,12 +54,13 @@ func init() {
 	}
 }
 
-func indexHandler(user sessionauth.User, r render.Render) {
-	r.HTML(200, "index", user.(*User))
+func indexHandler(session sessions.Session, user sessionauth.User, r render.Render) {
+	r.HTML(200, "index", page(session, map[string]interface{}{"User": user.(*User)}))
 }
 
 func main() {
-	store := sessions.NewCookieStore([]byte("secret123"))
+	// Sessions live in the DB, the cookie only has the signed session ID
+	store := newSessionStore(sessionKeys())
 	m := martini.Classic()
 
 	templateOptions := render.Options{}
@@ -66,22 +77,113 @@ func main() {
 	sessionauth.RedirectUrl = "/login"
 	sessionauth.RedirectParam = "next"
 
+	// Sessions from before a password reset are logged out
+	m.Use(checkSessionEpoch)
+
+	// Form posts must come from our own pages
+	m.Use(checkCSRF)
+
 	m.Get("/", indexHandler)
 	m.Get("/login", getLoginPage)
 	m.Get("/edit", getEditPage)
 	m.Get("/register", getRegisterPage)
+	m.Get("/forgot", getForgotPage)
+	m.Get("/reset", getResetPage)
 	m.Get("/logout", sessionauth.LoginRequired, logoutHandler)
 	m.Post("/login", binding.Bind(User{}), postLoginHandler)
 	m.Post("/register", binding.Bind(User{}), postRegisterHandler)
+	m.Post("/forgot", postForgotHandler)
+	m.Post("/reset", postResetHandler)
+	m.Get("/verify", getVerifyHandler)
+	m.Post("/verify/resend", sessionauth.LoginRequired, postResendVerifyHandler)
 	m.Post("/edit", sessionauth.LoginRequired, binding.Bind(User{}), postEditHandler)
+	m.Get("/login/oidc/:provider", getOIDCLoginHandler)
+	m.Get("/login/oidc/:provider/callback", getOIDCCallbackHandler)
+	m.Get("/login/2fa", getLoginTwoFactorPage)
+	m.Post("/login/2fa", postLoginTwoFactorHandler)
+	m.Get("/2fa", sessionauth.LoginRequired, getTwoFactorPage)
+	m.Get("/2fa/qr.png", sessionauth.LoginRequired, getTwoFactorQRHandler)
+	m.Post("/2fa/enable", sessionauth.LoginRequired, postTwoFactorEnableHandler)
+	m.Post("/2fa/disable", sessionauth.LoginRequired, postTwoFactorDisableHandler)
+	m.Get("/tokens", sessionauth.LoginRequired, getTokensPage)
+	m.Get("/sessions", sessionauth.LoginRequired, getSessionsPage)
+	m.Get("/account", sessionauth.LoginRequired, getAccountPage)
+	m.Get("/account/export", sessionauth.LoginRequired, getExportHandler)
+	m.Post("/account/delete", sessionauth.LoginRequired, postDeleteAccountHandler)
+	m.Post("/sessions/revoke-others", sessionauth.LoginRequired, postRevokeSessionHandler)
+	m.Post("/sessions/:id/revoke", sessionauth.LoginRequired, postRevokeSessionHandler)
+	m.Post("/tokens", sessionauth.LoginRequired, postTokenHandler)
+	m.Post("/tokens/:id/revoke", sessionauth.LoginRequired, postRevokeTokenHandler)
+	m.Post("/bots", sessionauth.LoginRequired, postBotHandler)
+	m.Post("/bots/:id/tokens", sessionauth.LoginRequired, postTokenHandler)
+
+	// Workspaces, managed by their own admins
+	m.Get("/workspace", sessionauth.LoginRequired, getWorkspacePage)
+	m.Post("/workspaces", sessionauth.LoginRequired, postWorkspaceHandler)
+	m.Post("/workspace/leave", sessionauth.LoginRequired, postLeaveWorkspaceHandler)
+	m.Post("/workspace/members/:id/remove", sessionauth.LoginRequired, requireWorkspaceAdmin, postRemoveMemberHandler)
+	m.Post("/workspace/members/:id/admin", sessionauth.LoginRequired, requireWorkspaceAdmin, postWorkspaceAdminHandler(true))
+	m.Post("/workspace/members/:id/unadmin", sessionauth.LoginRequired, requireWorkspaceAdmin, postWorkspaceAdminHandler(false))
+
+	// Invite links, to a workspace or one of its hubs
+	m.Get("/invite/:token", getInviteHandler)
+	m.Post("/invites", sessionauth.LoginRequired, postInviteHandler)
+	m.Post("/invites/:id/revoke", sessionauth.LoginRequired, postRevokeInviteHandler)
+
+	// Admin console, the JSON API also takes tokens with the admin scope
+	m.Get("/admin", sessionauth.LoginRequired, requireAdmin, getAdminPage)
+	m.Get("/admin/hubs/:id", sessionauth.LoginRequired, requireAdmin, getAdminHubPage)
+	m.Get("/api/admin/users", apiAuth(scopeAdmin), sessionauth.LoginRequired, requireAdmin, getAdminUsersHandler)
+	m.Get("/api/admin/users/:id", apiAuth(scopeAdmin), sessionauth.LoginRequired, requireAdmin, getAdminUserHandler)
+	m.Get("/api/admin/hubs", apiAuth(scopeAdmin), sessionauth.LoginRequired, requireAdmin, getAdminHubsHandler)
+	m.Get("/api/admin/hubs/:id", apiAuth(scopeAdmin), sessionauth.LoginRequired, requireAdmin, getAdminHubHandler)
+	m.Get("/api/admin/audit", apiAuth(scopeAdmin), sessionauth.LoginRequired, requireAdmin, getAuditHandler)
+	m.Get("/api/admin/audit/export", apiAuth(scopeAdmin), sessionauth.LoginRequired, requireAdmin, getAuditExportHandler)
+	m.Post("/admin/users/:id/disable", apiAuth(scopeAdmin), sessionauth.LoginRequired, requireAdmin, postDisableUserHandler(true))
+	m.Post("/admin/users/:id/enable", apiAuth(scopeAdmin), sessionauth.LoginRequired, requireAdmin, postDisableUserHandler(false))
+	m.Post("/admin/users/:id/logout", apiAuth(scopeAdmin), sessionauth.LoginRequired, requireAdmin, postForceLogoutHandler)
+	m.Post("/admin/users/:id/reset-password", apiAuth(scopeAdmin), sessionauth.LoginRequired, requireAdmin, postAdminResetPasswordHandler)
+	m.Post("/admin/users/:id/2fa/reset", apiAuth(scopeAdmin), sessionauth.LoginRequired, requireAdmin, postResetTwoFactorHandler)
+	m.Post("/admin/users/:id/unlock", apiAuth(scopeAdmin), sessionauth.LoginRequired, requireAdmin, postUnlockHandler)
+	m.Post("/admin/hubs/:id/archive", apiAuth(scopeAdmin), sessionauth.LoginRequired, requireAdmin, postArchiveHubHandler(true))
+	m.Post("/admin/hubs/:id/unarchive", apiAuth(scopeAdmin), sessionauth.LoginRequired, requireAdmin, postArchiveHubHandler(false))
+	m.Post("/admin/hubs/:id/guests", apiAuth(scopeAdmin), sessionauth.LoginRequired, requireAdmin, postGuestAccessHandler(true))
+	m.Post("/admin/hubs/:id/no-guests", apiAuth(scopeAdmin), sessionauth.LoginRequired, requireAdmin, postGuestAccessHandler(false))
+	m.Post("/admin/hubs/:id/close", apiAuth(scopeAdmin), sessionauth.LoginRequired, requireAdmin, postCloseHubHandler)
 
 	m.Get("/hub", sessionauth.LoginRequired, getHub)
-
-	//m.Post("/room/:name", sessionauth.LoginRequired, binding.Bind(hub{}), createHub)
+	m.Get("/hub/:id/history", apiAuth(scopeRead), sessionauth.LoginRequired, getHistoryHandler)
+	m.Get("/hub/:id/members", apiAuth(scopeRead), sessionauth.LoginRequired, getMembersHandler)
+	m.Post("/hub/:id/messages", apiAuth(scopeWrite), sessionauth.LoginRequired, postHubMessageHandler)
+	m.Get("/hub/:id/pins", apiAuth(scopeRead), sessionauth.LoginRequired, getPinsHandler)
+
+	// Messages users saved for themselves
+	m.Get("/bookmarks", apiAuth(scopeRead), sessionauth.LoginRequired, getBookmarksHandler)
+	m.Post("/bookmarks", apiAuth(scopeWrite), sessionauth.LoginRequired, postBookmarkHandler)
+	m.Post("/bookmarks/:id/remove", apiAuth(scopeWrite), sessionauth.LoginRequired, postRemoveBookmarkHandler)
+	m.Get("/scheduled", apiAuth(scopeRead), sessionauth.LoginRequired, getScheduledHandler)
+	m.Post("/scheduled", apiAuth(scopeWrite), sessionauth.LoginRequired, postScheduledHandler)
+	m.Post("/scheduled/:id", apiAuth(scopeWrite), sessionauth.LoginRequired, postEditScheduledHandler)
+	m.Post("/scheduled/:id/cancel", apiAuth(scopeWrite), sessionauth.LoginRequired, postCancelScheduledHandler)
+
+	//m.Post("/room/:name", sessionauth.LoginRequired, createHub)
 	//m.Get("/room", sessionauth.LoginRequired, getRoom)
 
-	m.Get("/ws", sessionauth.LoginRequired, wsHandler)
+	m.Get("/ws", apiAuth(scopeRead), sessionauth.LoginRequired, wsHandler)
+
+	// guests, for hubs an admin opened to them
+	m.Get("/guest/:id", getGuestHub)
+	m.Get("/guest/:id/history", getGuestHistoryHandler)
+	m.Get("/ws/guest", wsGuestHandler)
+
+	m.Post("/attachment", apiAuth(scopeWrite), sessionauth.LoginRequired, postAttachmentHandler)
+	m.Get("/attachment/:id", apiAuth(scopeRead), sessionauth.LoginRequired, getAttachmentHandler)
+	m.Get("/attachment/:id/thumb", apiAuth(scopeRead), sessionauth.LoginRequired, getThumbnailHandler)
 
 	m.Use(martini.Static("static"))
+
+	// pick up hubs and memberships changed by other processes
+	watchFeeds()
+
 	m.Run()
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+
+	r "github.com/dancannon/gorethink"
+)
+
+// Unread counts stop at this, clients show it as "99+".
+const maxUnreadCount = 99
+
+// hubState is a hub the user is in, as sent in the hello frame.
+type hubState struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Archived bool   `json:"archived,omitempty"`
+	LastRead int64  `json:"last_read"` // unix millis
+	Unread   int    `json:"unread"`
+	Pinned   []msg  `json:"pinned,omitempty"`
+}
+
+// saveMembership puts a hub in or out of the user's saved hubs, so they're
+// back in it next time they connect. Other nodes pick it up from the user
+// feed. Joining marks everything before it as read. Does nothing for guests.
+func saveMembership(userID, hubID string, in bool) error {
+	if isGuestID(userID) {
+		return nil // guests aren't saved
+	}
+	var err error
+	if in {
+		_, err = r.Table("user").Get(userID).Update(map[string]interface{}{
+			"hubs":      map[string]bool{hubID: true},
+			"last_read": map[string]interface{}{hubID: r.Row.Field("last_read").Field(hubID).Default(nowMillis())},
+		}).RunWrite(dbSession)
+	} else {
+		_, err = r.Table("user").Get(userID).
+			Replace(r.Row.Without(map[string]interface{}{
+				"hubs":      map[string]bool{hubID: true},
+				"last_read": map[string]bool{hubID: true},
+			})).RunWrite(dbSession)
+	}
+	return err
+}
+
+// clearMemberships forgets every saved hub of the user.
+func clearMemberships(userID string) error {
+	if isGuestID(userID) {
+		return nil // guests aren't saved
+	}
+	_, err := r.Table("user").Get(userID).Replace(r.Row.Without("hubs", "last_read")).RunWrite(dbSession)
+	return err
+}
+
+// markRead moves the user's read marker in a hub to now.
+func markRead(userID, hubID string) error {
+	if isGuestID(userID) {
+		return nil // guests aren't saved
+	}
+	_, err := r.Table("user").Get(userID).Update(map[string]interface{}{
+		"last_read": map[string]int64{hubID: nowMillis()},
+	}).RunWrite(dbSession)
+	return err
+}
+
+// unreadCount counts messages others sent to a hub after lastRead, up to
+// maxUnreadCount.
+func unreadCount(userID, hubID string, lastRead int64) (int, error) {
+	row, err := r.Table("message").
+		Between([]interface{}{hubID, lastRead}, []interface{}{hubID, r.Maxval}, r.BetweenOpts{Index: "hub_time", LeftBound: "open"}).
+		Filter(r.Row.Field("from_id").Ne(userID)).
+		Limit(maxUnreadCount).
+		Count().
+		RunRow(dbSession)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	err = row.Scan(&n)
+	return n, err
+}
+
+// savedHubs loads the hubs in u.Hubs, and forgets the ones that were
+// deleted in the meantime. Hubs that can't be loaded for other reasons,
+// eg. the DB being unreachable, are kept for the next time.
+func savedHubs(u *User) []*hub {
+	hubs := []*hub{}
+	for hubID, in := range u.Hubs {
+		if !in {
+			continue
+		}
+		hb, err := h.findHub(hubID)
+		if err == errNoSuchHub {
+			fmt.Println("Saved hub is gone, forgetting it.", hubID)
+			saveMembership(u.Id, hubID, false)
+			continue
+		}
+		if err != nil {
+			fmt.Println("Error loading saved hub.", hubID, err)
+			continue
+		}
+		hubs = append(hubs, hb)
+	}
+	return hubs
+}
+
+// restoreMemberships joins a new connection to the default hub and every
+// hub it saved, and sends the hello frame listing them with their unread
+// counts. Unverified users only get the default hub.
+func restoreMemberships(c *connection, u *User) {
+	var hubs []*hub
+	if !c.readOnly {
+		hubs = savedHubs(u)
+	}
+	if defaultHub, err := h.defaultHub(u.WorkspaceID); err == nil {
+		if !u.Hubs[defaultHub.HubID] {
+			// everyone is in it, save it so it gets unread counts too
+			saveMembership(u.Id, defaultHub.HubID, true)
+		}
+		if c.readOnly || !u.Hubs[defaultHub.HubID] {
+			hubs = append(hubs, defaultHub)
+		}
+	} else {
+		fmt.Println("Error getting default hub.", err)
+	}
+
+	// hello goes first, so the client knows the hubs before their messages
+	// come in. Anything sent in between is in the history it loads.
+	hello := msg{Type: msgTypeHello, Hubs: make([]hubState, 0, len(hubs))}
+	for _, hb := range hubs {
+		hb.mu.RLock()
+		st := hubState{ID: hb.HubID, Name: hb.HubName, Archived: hb.Archived, LastRead: u.LastRead[hb.HubID]}
+		hb.mu.RUnlock()
+
+		if st.LastRead > 0 {
+			n, err := unreadCount(u.Id, hb.HubID, st.LastRead)
+			if err != nil {
+				fmt.Println("Error counting unread messages.", err)
+			}
+			st.Unread = n
+		}
+		st.Pinned = hb.pinnedMessages()
+		hello.Hubs = append(hello.Hubs, st)
+	}
+	select {
+	case c.send <- hello:
+	default:
+		fmt.Println("Send buffer full, hello dropped:", c.userID)
+	}
+
+	for _, hb := range hubs {
+		h.join(c, hb)
+	}
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go.crypto/bcrypt"
+	r "github.com/dancannon/gorethink"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessionauth"
+	"github.com/martini-contrib/sessions"
+)
+
+const (
+	// Session keys for a login that went off to the identity provider.
+	oidcStateKey    = "oidc_state"
+	oidcNonceKey    = "oidc_nonce"
+	oidcProviderKey = "oidc_provider"
+	oidcRedirectKey = "oidc_next"
+
+	// Clock difference allowed when checking token times.
+	oidcClockSkew = 2 * time.Minute
+
+	// Discovery documents and keys are fetched again after this long.
+	oidcCacheTTL = 1 * time.Hour
+)
+
+// oidcClient is used for every call to an identity provider.
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcProvider is an OpenID Connect identity provider users can sign in with.
+// Configure them with OIDC_PROVIDERS, eg.
+// OIDC_PROVIDERS='{"corp":{"issuer":"https://id.example.com","client_id":"chatgo","client_secret":"..."}}'
+// The issuer can be a plain http URL, so a local mock IdP works too.
+type oidcProvider struct {
+	Name         string   `json:"-"`
+	DisplayName  string   `json:"display_name"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes"`
+
+	// Workspace new users from this provider are made in, the default
+	// workspace if empty.
+	WorkspaceID string `json:"workspace_id"`
+
+	mu      sync.Mutex
+	config  *oidcConfig
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+// oidcConfig is the part of the discovery document we need.
+type oidcConfig struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcClaims are the ID token claims we look at.
+type oidcClaims struct {
+	Issuer        string          `json:"iss"`
+	Subject       string          `json:"sub"`
+	Audience      json.RawMessage `json:"aud"`
+	Expires       int64           `json:"exp"`
+	IssuedAt      int64           `json:"iat"`
+	Nonce         string          `json:"nonce"`
+	Email         string          `json:"email"`
+	EmailVerified interface{}     `json:"email_verified"`
+	Name          string          `json:"preferred_username"`
+}
+
+var oidcProviders = make(map[string]*oidcProvider)
+
+func init() {
+	s := os.Getenv("OIDC_PROVIDERS")
+	if s == "" {
+		return
+	}
+	if err := json.Unmarshal([]byte(s), &oidcProviders); err != nil {
+		fmt.Println("Error parsing OIDC_PROVIDERS, OIDC login is off.", err)
+		oidcProviders = make(map[string]*oidcProvider)
+		return
+	}
+	for name, p := range oidcProviders {
+		p.Name = name
+		p.Issuer = strings.TrimRight(p.Issuer, "/")
+		if p.DisplayName == "" {
+			p.DisplayName = name
+		}
+		if len(p.Scopes) == 0 {
+			p.Scopes = []string{"openid", "email", "profile"}
+		}
+	}
+}
+
+// oidcProviderList is the providers in a stable order, for the login page.
+func oidcProviderList() []*oidcProvider {
+	list := make([]*oidcProvider, 0, len(oidcProviders))
+	for _, p := range oidcProviders {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (p *oidcProvider) redirectURI() string {
+	return baseURL + "/login/oidc/" + p.Name + "/callback"
+}
+
+// getJSON fetches a URL and decodes the JSON reply into v.
+func getJSON(u string, v interface{}) error {
+	resp, err := oidcClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// discover returns the provider's config and signing keys, fetching them
+// when they're missing, old, or when a token uses a key we haven't seen.
+func (p *oidcProvider) discover(kid string) (*oidcConfig, map[string]*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// an unknown key means the provider rotated keys, but don't let bad
+	// tokens make us fetch them on every request
+	age := time.Since(p.fetched)
+	if p.config != nil && age < oidcCacheTTL && (kid == "" || p.keys[kid] != nil || age < time.Minute) {
+		return p.config, p.keys, nil
+	}
+
+	var config oidcConfig
+	if err := getJSON(p.Issuer+"/.well-known/openid-configuration", &config); err != nil {
+		return nil, nil, err
+	}
+	if strings.TrimRight(config.Issuer, "/") != p.Issuer {
+		return nil, nil, fmt.Errorf("provider says its issuer is %q", config.Issuer)
+	}
+
+	keys, err := fetchJWKS(config.JWKSURI)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.config, p.keys, p.fetched = &config, keys, time.Now()
+	return p.config, p.keys, nil
+}
+
+// fetchJWKS gets the RSA signing keys of a provider, by key ID.
+func fetchJWKS(u string) (map[string]*rsa.PublicKey, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := getJSON(u, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("provider has no RSA signing keys")
+	}
+	return keys, nil
+}
+
+// authURL is where the user is sent to sign in.
+func (p *oidcProvider) authURL(state, nonce string) (string, error) {
+	config, _, err := p.discover("")
+	if err != nil {
+		return "", err
+	}
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.ClientID)
+	v.Set("redirect_uri", p.redirectURI())
+	v.Set("scope", strings.Join(p.Scopes, " "))
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+
+	sep := "?"
+	if strings.Contains(config.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return config.AuthorizationEndpoint + sep + v.Encode(), nil
+}
+
+// exchange trades the code from the callback for an ID token.
+func (p *oidcProvider) exchange(code string) (string, error) {
+	config, _, err := p.discover("")
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.redirectURI())
+
+	req, err := http.NewRequest("POST", config.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var token struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if resp.StatusCode != 200 || token.IDToken == "" {
+		return "", fmt.Errorf("token endpoint: %s %s", resp.Status, token.Error)
+	}
+	return token.IDToken, nil
+}
+
+// verifyIDToken checks the signature and claims of an ID token.
+// Only RS256 is accepted, what every provider supports.
+func (p *oidcProvider) verifyIDToken(raw, nonce string) (*oidcClaims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported ID token algorithm %q", header.Alg)
+	}
+
+	_, keys, err := p.discover(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	key := keys[header.Kid]
+	if key == nil && header.Kid == "" && len(keys) == 1 {
+		for _, k := range keys {
+			key = k
+		}
+	}
+	if key == nil {
+		return nil, fmt.Errorf("unknown signing key %q", header.Kid)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+		return nil, errors.New("bad ID token signature")
+	}
+
+	var claims oidcClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	switch {
+	case strings.TrimRight(claims.Issuer, "/") != p.Issuer:
+		return nil, fmt.Errorf("ID token from wrong issuer %q", claims.Issuer)
+	case !claims.hasAudience(p.ClientID):
+		return nil, errors.New("ID token is for another client")
+	case now.After(time.Unix(claims.Expires, 0).Add(oidcClockSkew)):
+		return nil, errors.New("ID token expired")
+	case claims.IssuedAt != 0 && now.Add(oidcClockSkew).Before(time.Unix(claims.IssuedAt, 0)):
+		return nil, errors.New("ID token issued in the future")
+	case claims.Nonce == "" || claims.Nonce != nonce:
+		return nil, errors.New("ID token nonce doesn't match")
+	case claims.Subject == "":
+		return nil, errors.New("ID token has no subject")
+	}
+	return &claims, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(seg, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// hasAudience checks aud, which can be a string or a list.
+func (c *oidcClaims) hasAudience(clientID string) bool {
+	var one string
+	if json.Unmarshal(c.Audience, &one) == nil {
+		return one == clientID
+	}
+	var many []string
+	if json.Unmarshal(c.Audience, &many) == nil {
+		for _, aud := range many {
+			if aud == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// emailVerified reads email_verified, some providers send it as a string.
+func (c *oidcClaims) emailVerified() bool {
+	switch v := c.EmailVerified.(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// oidcUser finds the user for a signed in identity. Users already linked to
+// it come first, then users with the same email, who get linked. If there's
+// nobody, a new user is made. Emails are only trusted if the provider
+// verified them.
+func oidcUser(p *oidcProvider, claims *oidcClaims) (*User, error) {
+	row, err := r.Table("user").
+		Filter(r.Row.Field("identities").Field(p.Name).Default("").Eq(claims.Subject)).
+		RunRow(dbSession)
+	if err != nil {
+		return nil, err
+	}
+	if !row.IsNil() {
+		var u User
+		if err := row.Scan(&u); err != nil {
+			return nil, err
+		}
+		return &u, nil
+	}
+
+	if claims.Email == "" || !claims.emailVerified() {
+		return nil, errors.New("provider didn't give a verified email")
+	}
+
+	u, err := findUserByEmail(claims.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	if u != nil {
+		_, err := r.Table("user").Get(u.Id).Update(map[string]interface{}{
+			"identities": map[string]string{p.Name: claims.Subject},
+			"unverified": false,
+		}).RunWrite(dbSession)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println("Linked", p.Name, "identity to user", u.Id)
+		u.Unverified = false
+		return u, nil
+	}
+
+	// nobody can log in with this password, it's random and thrown away
+	hash, err := bcrypt.GenerateFromPassword([]byte(randomID(32)), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	newUser := User{
+		Email:       claims.Email,
+		Password:    string(hash),
+		Identities:  map[string]string{p.Name: claims.Subject},
+		WorkspaceID: p.WorkspaceID,
+	}
+	// same rules as registering, a name that's taken or odd is left out
+	// and the user can pick one later
+	if claims.Name != "" && validateUsername(claims.Name, "") == "" {
+		newUser.Username = claims.Name
+	}
+	res, err := r.Table("user").Insert(newUser).RunWrite(dbSession)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.GeneratedKeys) == 0 {
+		return nil, errors.New("no ID for new user")
+	}
+	newUser.Id = res.GeneratedKeys[0]
+	fmt.Println("Registered", newUser.Email, "from", p.Name)
+	return &newUser, nil
+}
+
+//-----------------------------------------------------------------------------
+// HANDLERS
+//-----------------------------------------------------------------------------
+
+// getOIDCLoginHandler - GET /login/oidc/:provider, off to the provider.
+func getOIDCLoginHandler(params martini.Params, session sessions.Session, rend render.Render, req *http.Request) {
+	p := oidcProviders[params["provider"]]
+	if p == nil {
+		rend.Redirect(sessionauth.RedirectUrl)
+		return
+	}
+
+	state, nonce := randomID(16), randomID(16)
+	u, err := p.authURL(state, nonce)
+	if err != nil {
+		fmt.Println("Error reaching identity provider.", err)
+		session.AddFlash("Couldn't reach " + p.DisplayName + ", try again later.")
+		rend.Redirect(sessionauth.RedirectUrl)
+		return
+	}
+
+	session.Set(oidcStateKey, state)
+	session.Set(oidcNonceKey, nonce)
+	session.Set(oidcProviderKey, p.Name)
+	session.Set(oidcRedirectKey, req.URL.Query().Get(sessionauth.RedirectParam))
+	rend.Redirect(u)
+}
+
+// getOIDCCallbackHandler - GET /login/oidc/:provider/callback, where the
+// provider sends the user back with a code.
+func getOIDCCallbackHandler(params martini.Params, session sessions.Session, rend render.Render, req *http.Request) {
+	state, _ := session.Get(oidcStateKey).(string)
+	nonce, _ := session.Get(oidcNonceKey).(string)
+	name, _ := session.Get(oidcProviderKey).(string)
+	redirect, _ := session.Get(oidcRedirectKey).(string)
+	session.Delete(oidcStateKey)
+	session.Delete(oidcNonceKey)
+	session.Delete(oidcProviderKey)
+	session.Delete(oidcRedirectKey)
+
+	query := req.URL.Query()
+	p := oidcProviders[params["provider"]]
+	if p == nil || name != p.Name || state == "" || query.Get("state") != state {
+		fmt.Println("OIDC callback with bad state.")
+		rend.Redirect(sessionauth.RedirectUrl)
+		return
+	}
+	if e := query.Get("error"); e != "" {
+		fmt.Println("OIDC login refused:", e, query.Get("error_description"))
+		session.AddFlash("Couldn't sign you in with " + p.DisplayName + ".")
+		rend.Redirect(sessionauth.RedirectUrl)
+		return
+	}
+
+	idToken, err := p.exchange(query.Get("code"))
+	if err != nil {
+		fmt.Println("Error getting ID token.", err)
+		session.AddFlash("Couldn't sign you in with " + p.DisplayName + ".")
+		rend.Redirect(sessionauth.RedirectUrl)
+		return
+	}
+
+	claims, err := p.verifyIDToken(idToken, nonce)
+	if err != nil {
+		fmt.Println("Bad ID token.", err)
+		session.AddFlash("Couldn't sign you in with " + p.DisplayName + ".")
+		rend.Redirect(sessionauth.RedirectUrl)
+		return
+	}
+
+	u, err := oidcUser(p, claims)
+	if err == nil {
+		err = loginBlocked(u)
+	}
+	if err != nil {
+		fmt.Println("Error finding OIDC user.", err)
+		session.AddFlash("Couldn't sign you in with " + p.DisplayName + ".")
+		rend.Redirect(sessionauth.RedirectUrl)
+		return
+	}
+
+	method := "oidc:" + p.Name
+	if u.TOTPEnabled {
+		startSecondFactor(session, u, method, redirect)
+		rend.Redirect("/login/2fa")
+		return
+	}
+	finishLogin(session, u, method, redirect, rend, req)
+}
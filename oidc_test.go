@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockIdP is a minimal OpenID Connect provider: discovery, JWKS and a
+// token endpoint that trades testCode for whatever claims are set.
+type mockIdP struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	kid    string
+	claims map[string]interface{}
+}
+
+const (
+	testClientID     = "chatgo-test"
+	testClientSecret = "s3cret"
+	testCode         = "good-code"
+)
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{key: key, kid: "key-1"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": idp.kid,
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		id, secret, _ := req.BasicAuth()
+		if req.Method != "POST" || id != testClientID || secret != testClientSecret {
+			w.WriteHeader(401)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+		if req.FormValue("grant_type") != "authorization_code" || req.FormValue("code") != testCode {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(t, idp.claims)})
+	})
+	idp.Server = httptest.NewServer(mux)
+	return idp
+}
+
+// sign makes an RS256 JWT with the IdP's key.
+func (idp *mockIdP) sign(t *testing.T, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": idp.kid})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// goodClaims are what a real login would get for the given nonce.
+func (idp *mockIdP) goodClaims(nonce string) map[string]interface{} {
+	now := time.Now().Unix()
+	return map[string]interface{}{
+		"iss":                idp.URL,
+		"sub":                "user-123",
+		"aud":                testClientID,
+		"exp":                now + 300,
+		"iat":                now,
+		"nonce":              nonce,
+		"email":              "alice@example.com",
+		"email_verified":     true,
+		"preferred_username": "alice",
+	}
+}
+
+func (idp *mockIdP) provider() *oidcProvider {
+	return &oidcProvider{
+		Name:         "mock",
+		Issuer:       idp.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		Scopes:       []string{"openid", "email"},
+	}
+}
+
+func TestOIDCDiscoveryAndAuthURL(t *testing.T) {
+	idp := newMockIdP(t)
+	defer idp.Close()
+	p := idp.provider()
+
+	u, err := p.authURL("the-state", "the-nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(u, idp.URL+"/authorize?") {
+		t.Fatalf("auth URL %s isn't the IdP's authorization endpoint", u)
+	}
+	q := parsed.Query()
+	for k, want := range map[string]string{
+		"response_type": "code",
+		"client_id":     testClientID,
+		"redirect_uri":  p.redirectURI(),
+		"scope":         "openid email",
+		"state":         "the-state",
+		"nonce":         "the-nonce",
+	} {
+		if q.Get(k) != want {
+			t.Errorf("%s = %q, want %q", k, q.Get(k), want)
+		}
+	}
+}
+
+func TestOIDCDiscoveryWrongIssuer(t *testing.T) {
+	idp := newMockIdP(t)
+	defer idp.Close()
+	p := idp.provider()
+	p.Issuer = idp.URL + "/other"
+
+	if _, err := p.authURL("s", "n"); err == nil {
+		t.Fatal("accepted a discovery document for another issuer")
+	}
+}
+
+func TestOIDCCodeExchange(t *testing.T) {
+	idp := newMockIdP(t)
+	defer idp.Close()
+	p := idp.provider()
+	idp.claims = idp.goodClaims("n-1")
+
+	raw, err := p.exchange(testCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := p.verifyIDToken(raw, "n-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "user-123" || claims.Email != "alice@example.com" || !claims.emailVerified() || claims.Name != "alice" {
+		t.Fatalf("got claims %+v", claims)
+	}
+
+	if _, err := p.exchange("bad-code"); err == nil {
+		t.Fatal("exchanged a bad code")
+	}
+	p.ClientSecret = "wrong"
+	if _, err := p.exchange(testCode); err == nil {
+		t.Fatal("exchanged a code with the wrong client secret")
+	}
+}
+
+func TestOIDCIDTokenValidation(t *testing.T) {
+	idp := newMockIdP(t)
+	defer idp.Close()
+	p := idp.provider()
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		token  func() string
+		nonce  string
+		wantOK bool
+	}{
+		{"good", func() string { return idp.sign(t, idp.goodClaims("n")) }, "n", true},
+		{"audience list", func() string {
+			c := idp.goodClaims("n")
+			c["aud"] = []string{"someone-else", testClientID}
+			return idp.sign(t, c)
+		}, "n", true},
+		{"wrong nonce", func() string { return idp.sign(t, idp.goodClaims("n")) }, "other", false},
+		{"no nonce", func() string { return idp.sign(t, idp.goodClaims("")) }, "", false},
+		{"wrong audience", func() string {
+			c := idp.goodClaims("n")
+			c["aud"] = "someone-else"
+			return idp.sign(t, c)
+		}, "n", false},
+		{"wrong issuer", func() string {
+			c := idp.goodClaims("n")
+			c["iss"] = "https://evil.example.com"
+			return idp.sign(t, c)
+		}, "n", false},
+		{"expired", func() string {
+			c := idp.goodClaims("n")
+			c["exp"] = time.Now().Add(-time.Hour).Unix()
+			return idp.sign(t, c)
+		}, "n", false},
+		{"issued in the future", func() string {
+			c := idp.goodClaims("n")
+			c["iat"] = time.Now().Add(time.Hour).Unix()
+			return idp.sign(t, c)
+		}, "n", false},
+		{"no subject", func() string {
+			c := idp.goodClaims("n")
+			delete(c, "sub")
+			return idp.sign(t, c)
+		}, "n", false},
+		{"signed by another key", func() string {
+			orig := idp.key
+			idp.key = other
+			defer func() { idp.key = orig }()
+			return idp.sign(t, idp.goodClaims("n"))
+		}, "n", false},
+		{"tampered", func() string {
+			parts := strings.Split(idp.sign(t, idp.goodClaims("n")), ".")
+			c := idp.goodClaims("n")
+			c["sub"] = "admin"
+			payload, _ := json.Marshal(c)
+			return parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+		}, "n", false},
+		{"alg none", func() string {
+			header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+			payload, _ := json.Marshal(idp.goodClaims("n"))
+			return header + "." + base64.RawURLEncoding.EncodeToString(payload) + "."
+		}, "n", false},
+		{"malformed", func() string { return "not-a-jwt" }, "n", false},
+	}
+	for _, tt := range tests {
+		_, err := p.verifyIDToken(tt.token(), tt.nonce)
+		if tt.wantOK && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !tt.wantOK && err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+}
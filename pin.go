@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessionauth"
+)
+
+// Most messages a hub can have pinned.
+const maxPins = 50
+
+var (
+	errTooManyPins = fmt.Errorf("a hub can have at most %d pinned messages", maxPins)
+	errNotInHub    = errors.New("no such message in this hub")
+)
+
+// canModerate reports if the user can manage a hub, eg. pin messages:
+// its hub admins, the admins of its workspace and server admins.
+func canModerate(userID, role string, hb *hub) bool {
+	if role == roleAdmin {
+		return true
+	}
+	hb.mu.RLock()
+	hubAdmin := hb.HubAdmins[userID] > 0
+	hb.mu.RUnlock()
+	if hubAdmin {
+		return true
+	}
+	ws, err := getWorkspace(hb.WorkspaceID)
+	return err == nil && ws != nil && ws.Admins[userID]
+}
+
+// pinnedIDs returns a copy of the IDs of the hub's pinned messages.
+func (hb *hub) pinnedIDs() []string {
+	hb.mu.RLock()
+	defer hb.mu.RUnlock()
+	return append([]string(nil), hb.Pinned...)
+}
+
+// pinMessage adds a message of the hub to its pinned list. Members see it
+// when the hub feed picks up the change, see applyHub.
+func pinMessage(hb *hub, msgID string) error {
+	ids := hb.pinnedIDs()
+	for _, id := range ids {
+		if id == msgID {
+			return nil
+		}
+	}
+	if len(ids) >= maxPins {
+		return errTooManyPins
+	}
+
+	m, err := getSavedMessage(msgID)
+	if err != nil {
+		return err
+	}
+	if m == nil || m.HubID != hb.HubID {
+		return errNotInHub
+	}
+
+	// another pin could land between the check above and this write, so
+	// the count is checked again in the write itself
+	pinned := r.Row.Field("pinned").Default([]string{})
+	res, err := r.Table("hub").Get(hb.HubID).Update(r.Branch(
+		pinned.Contains(msgID).Or(pinned.Count().Lt(maxPins)),
+		map[string]interface{}{"pinned": pinned.SetInsert(msgID)},
+		r.Error(errTooManyPins.Error()),
+	)).RunWrite(dbSession)
+	if res.Errors > 0 {
+		return errTooManyPins
+	}
+	return err
+}
+
+// unpinMessage takes a message off the hub's pinned list.
+func unpinMessage(hb *hub, msgID string) error {
+	_, err := r.Table("hub").Get(hb.HubID).Update(map[string]interface{}{
+		"pinned": r.Row.Field("pinned").Default([]string{}).SetDifference([]string{msgID}),
+	}).RunWrite(dbSession)
+	return err
+}
+
+// getSavedMessage loads a message by ID, nil if there's no such message.
+// One sent a moment ago may still be queued for the history writer, if
+// so it waits for what this node queued before giving up.
+func getSavedMessage(id string) (*msg, error) {
+	msgs, err := getMessages([]string{id})
+	if err == nil && len(msgs) == 0 && historyQueued(id) {
+		flushHistory()
+		msgs, err = getMessages([]string{id})
+	}
+	if err != nil || len(msgs) == 0 {
+		return nil, err
+	}
+	return &msgs[0], nil
+}
+
+// getMessages loads messages by ID, in that order. Messages that are gone
+// are left out.
+func getMessages(ids []string) ([]msg, error) {
+	msgs := []msg{}
+	if len(ids) == 0 {
+		return msgs, nil
+	}
+	keys := make([]interface{}, len(ids))
+	for i, id := range ids {
+		keys[i] = id
+	}
+	rows, err := r.Table("message").GetAll(keys...).Run(dbSession)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byID := make(map[string]msg, len(ids))
+	for rows.Next() {
+		var m msg
+		if err := rows.Scan(&m); err != nil {
+			return nil, err
+		}
+		byID[m.ID] = m
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if m, ok := byID[id]; ok {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs, nil
+}
+
+// pinnedMessages returns the hub's pinned messages, oldest pin first.
+func (hb *hub) pinnedMessages() []msg {
+	pins, err := getMessages(hb.pinnedIDs())
+	if err != nil {
+		fmt.Println("Error loading pinned messages.", hb.HubID, err)
+	}
+	return pins
+}
+
+// sendJoined acks a join with the hub's name and pinned messages.
+func (c *connection) sendJoined(hb *hub) {
+	hb.mu.RLock()
+	m := msg{Type: msgTypeJoined, HubID: hb.HubID, Body: hb.HubName}
+	hb.mu.RUnlock()
+	m.Pinned = hb.pinnedMessages()
+
+	select {
+	case c.send <- m:
+	default:
+	}
+}
+
+// samePins reports if two pinned lists are the same.
+func samePins(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//-----------------------------------------------------------------------------
+// HANDLERS
+//-----------------------------------------------------------------------------
+
+// getPinsHandler - GET /hub/:id/pins
+func getPinsHandler(params martini.Params, user sessionauth.User, rend render.Render) {
+	hb, err := workspaceHub(user.(*User), params["id"])
+	if err != nil {
+		rend.JSON(404, map[string]string{"error": "no such hub"})
+		return
+	}
+	rend.JSON(200, hb.pinnedMessages())
+}
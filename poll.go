@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+)
+
+const (
+	maxPollOptions    = 10
+	maxPollText       = 200
+	maxPollDuration   = 30 * 24 * time.Hour
+	pollCloseInterval = 15 * time.Second
+)
+
+var (
+	errNoSuchPoll = errors.New("no such poll in this hub")
+	errPollClosed = errors.New("this poll is closed")
+	errBadChoice  = errors.New("pick one of the poll's options")
+)
+
+// poll is sent with a msgTypePoll message and saved with it, votes and all,
+// so the results stay in the history once it's closed.
+type poll struct {
+	Question  string   `json:"question" gorethink:"question"`
+	Options   []string `json:"options" gorethink:"options"`
+	Multi     bool     `json:"multi,omitempty" gorethink:"multi,omitempty"`         // more than one choice per voter
+	Anonymous bool     `json:"anonymous,omitempty" gorethink:"anonymous,omitempty"` // only counts are shown
+	Closes    int64    `json:"closes,omitempty" gorethink:"closes,omitempty"`       // unix millis, 0 until closed by hand
+	Closed    bool     `json:"closed,omitempty" gorethink:"closed,omitempty"`
+
+	// Votes by user ID. Clients never see it, they get Counts and, if the
+	// poll isn't anonymous, the names in Voters. See MarshalJSON.
+	Votes  map[string]pollVote `json:"-" gorethink:"votes,omitempty"`
+	Counts []int               `json:"counts" gorethink:"-"`
+	Voters [][]string          `json:"voters,omitempty" gorethink:"-"`
+}
+
+type pollVote struct {
+	Name    string `gorethink:"name"`
+	Choices []int  `gorethink:"choices"`
+}
+
+func init() {
+	// closed polls are left out of the index, the r.Error skips them
+	_, err := r.Table("message").IndexCreateFunc("poll_closes", func(row r.Term) interface{} {
+		return r.Branch(row.Field("poll").Field("closed").Default(false), r.Error("closed"), row.Field("poll").Field("closes"))
+	}).Run(dbSession)
+	fmt.Println("create index message poll_closes error: ", err)
+
+	go pollCloser()
+}
+
+// MarshalJSON fills in the tally. Polls relayed by other nodes have no
+// Votes, their tally is kept as it came.
+func (p poll) MarshalJSON() ([]byte, error) {
+	type plain poll
+	out := plain(p)
+	if p.Votes != nil || p.Counts == nil {
+		out.Counts = make([]int, len(p.Options))
+		out.Voters = nil
+		if !p.Anonymous {
+			out.Voters = make([][]string, len(p.Options))
+		}
+		for _, v := range p.Votes {
+			for _, i := range v.Choices {
+				if i < 0 || i >= len(p.Options) {
+					continue
+				}
+				out.Counts[i]++
+				if !p.Anonymous {
+					out.Voters[i] = append(out.Voters[i], v.Name)
+				}
+			}
+		}
+		for _, names := range out.Voters {
+			sort.Strings(names)
+		}
+	}
+	return json.Marshal(out)
+}
+
+// open reports if the poll still takes votes at now, in unix millis.
+func (p *poll) open(now int64) bool {
+	return !p.Closed && (p.Closes == 0 || p.Closes > now)
+}
+
+// newPoll checks a poll sent by a client and returns a clean copy of it.
+func newPoll(in *poll) (*poll, error) {
+	if in == nil {
+		return nil, errors.New("poll is missing")
+	}
+	p := &poll{
+		Question:  strings.TrimSpace(in.Question),
+		Multi:     in.Multi,
+		Anonymous: in.Anonymous,
+		Closes:    in.Closes,
+	}
+	if p.Question == "" || len(p.Question) > maxPollText {
+		return nil, fmt.Errorf("questions are 1 to %d characters", maxPollText)
+	}
+	for _, o := range in.Options {
+		o = strings.TrimSpace(o)
+		if o == "" || len(o) > maxPollText {
+			return nil, fmt.Errorf("options are 1 to %d characters", maxPollText)
+		}
+		p.Options = append(p.Options, o)
+	}
+	if len(p.Options) < 2 || len(p.Options) > maxPollOptions {
+		return nil, fmt.Errorf("polls have 2 to %d options", maxPollOptions)
+	}
+	if p.Closes != 0 {
+		left := time.Duration(p.Closes-nowMillis()) * time.Millisecond
+		if left <= 0 || left > maxPollDuration {
+			return nil, errors.New("polls close in the next 30 days")
+		}
+	}
+	return p, nil
+}
+
+// getPoll loads a poll message of the hub.
+func getPoll(hubID, pollID string) (*msg, error) {
+	msgs, err := getMessages([]string{pollID})
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 || msgs[0].HubID != hubID || msgs[0].Poll == nil {
+		return nil, errNoSuchPoll
+	}
+	return &msgs[0], nil
+}
+
+// castVote records the connection's choices in a poll, replacing an
+// earlier vote. No choices takes the vote back.
+func castVote(c *connection, hb *hub, pollID string, choices []int) error {
+	m, err := getPoll(hb.HubID, pollID)
+	if err != nil {
+		return err
+	}
+	if !m.Poll.open(nowMillis()) {
+		return errPollClosed
+	}
+	if len(choices) > 1 && !m.Poll.Multi {
+		return errBadChoice
+	}
+	seen := make(map[int]bool)
+	for _, i := range choices {
+		if i < 0 || i >= len(m.Poll.Options) || seen[i] {
+			return errBadChoice
+		}
+		seen[i] = true
+	}
+
+	// the poll could close between the read above and this write, the
+	// write fails then and nothing is recorded
+	closes := r.Row.Field("poll").Field("closes").Default(0)
+	open := r.Row.Field("poll").Field("closed").Default(false).Not().And(closes.Eq(0).Or(closes.Gt(nowMillis())))
+	var change interface{}
+	if len(choices) == 0 {
+		change = r.Row.Without(map[string]interface{}{"poll": map[string]interface{}{"votes": map[string]bool{c.userID: true}}})
+	} else {
+		change = r.Row.Merge(map[string]interface{}{"poll": map[string]interface{}{"votes": map[string]interface{}{
+			c.userID: map[string]interface{}{"name": c.userName, "choices": choices},
+		}}})
+	}
+	res, err := r.Table("message").Get(pollID).Replace(r.Branch(open, change, r.Error(errPollClosed.Error()))).RunWrite(dbSession)
+	if res.Errors > 0 {
+		return errPollClosed
+	}
+	if err != nil {
+		return err
+	}
+
+	// the vote counts, even if the poll closes before the tally goes out
+	if m, err = getPoll(hb.HubID, pollID); err != nil {
+		return err
+	}
+	sendTally(*m)
+	return nil
+}
+
+// closePoll stops a poll taking votes and sends everyone the results.
+// Only one caller gets to close it, the others get errPollClosed.
+func closePoll(m msg) error {
+	res, err := r.Table("message").Get(m.ID).Update(r.Branch(
+		r.Row.Field("poll").Field("closed").Default(false),
+		map[string]interface{}{},
+		map[string]interface{}{"poll": map[string]interface{}{"closed": true}},
+	)).RunWrite(dbSession)
+	if err != nil {
+		return err
+	}
+	if res.Replaced != 1 {
+		return errPollClosed
+	}
+
+	final, err := getPoll(m.HubID, m.ID)
+	if err != nil {
+		return err
+	}
+	sendTally(*final)
+	return nil
+}
+
+// sendTally tells the hub how a poll stands. It's not saved, the poll
+// message itself has the votes.
+func sendTally(m msg) {
+	t := msg{Type: msgTypePollTally, HubID: m.HubID, Body: m.ID, Poll: m.Poll}
+	if hb := h.getHub(m.HubID); hb != nil {
+		hb.broadcast(t)
+	}
+	cl.publishMsg(t)
+}
+
+// pollCloser closes polls when their time is up. Every node runs it,
+// closePoll makes sure only one announces the results.
+func pollCloser() {
+	ticker := time.NewTicker(pollCloseInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		rows, err := r.Table("message").
+			Between(1, nowMillis(), r.BetweenOpts{Index: "poll_closes", RightBound: "closed"}).
+			Run(dbSession)
+		if err != nil {
+			fmt.Println("Error looking for polls to close.", err)
+			continue
+		}
+		var due []msg
+		for rows.Next() {
+			var m msg
+			if err := rows.Scan(&m); err != nil {
+				fmt.Println("Error reading poll.", err)
+				break
+			}
+			due = append(due, m)
+		}
+		rows.Close()
+
+		for _, m := range due {
+			if err := closePoll(m); err != nil && err != errPollClosed {
+				fmt.Println("Error closing poll.", m.ID, err)
+			}
+		}
+	}
+}
+
+// startPoll sends a new poll to a hub the connection is in. It's saved
+// before anyone sees it, so votes and closing never miss it.
+func (c *connection) startPoll(m msg) {
+	p, err := newPoll(m.Poll)
+	if err != nil {
+		c.sendError("poll", err.Error())
+		return
+	}
+	if !c.inHub(m.HubID) {
+		fmt.Println("User not in hub, dropping poll.", c.userID, m.HubID)
+		return
+	}
+	if hb := h.getHub(m.HubID); hb != nil && hb.archived() {
+		c.sendError("archived", "This hub is archived, nobody can post in it.")
+		return
+	}
+	m.ID = randomID(16)
+	m.Body = p.Question
+	m.Attachments = nil
+	m.Poll = p
+	if _, err := r.Table("message").Insert(m).RunWrite(dbSession); err != nil {
+		fmt.Println("Error saving poll.", err)
+		c.sendError("poll", "The poll couldn't be saved, try again.")
+		return
+	}
+	if err := h.broadcastSaved(m.HubID, m); err == errHubArchived {
+		c.sendError("archived", "This hub is archived, nobody can post in it.")
+	} else if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// votePoll handles a vote, Body is the poll's message ID.
+func (c *connection) votePoll(m msg) {
+	hb := h.getHub(m.HubID)
+	if hb == nil || !c.inHub(m.HubID) {
+		return
+	}
+	if hb.archived() {
+		c.sendError("archived", "This hub is archived, nobody can vote in it.")
+		return
+	}
+	err := castVote(c, hb, m.Body, m.Choices)
+	if err == errNoSuchPoll || err == errPollClosed || err == errBadChoice {
+		c.sendError("poll", err.Error())
+	} else if err != nil {
+		fmt.Println("Error voting.", err)
+	}
+}
+
+// endPoll closes a poll early, only its author and hub admins can.
+func (c *connection) endPoll(m msg) {
+	hb := h.getHub(m.HubID)
+	if hb == nil || !c.inHub(m.HubID) {
+		return
+	}
+	p, err := getPoll(hb.HubID, m.Body)
+	if err != nil {
+		c.sendError("poll", err.Error())
+		return
+	}
+	if p.FromID != c.userID && !canModerate(c.userID, c.role, hb) {
+		c.sendError("forbidden", "Only the poll's author and hub admins can close it.")
+		return
+	}
+	if err := closePoll(*p); err == errPollClosed {
+		c.sendError("poll", err.Error())
+	} else if err != nil {
+		fmt.Println("Error closing poll.", err)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialTestConn serves one connection of a user in hb over a real
+// websocket, through the same read and write pumps as wsHandler. The
+// returned func closes both ends.
+func dialTestConn(t *testing.T, hb *hub) (*websocket.Conn, func()) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ws, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		c := newConnection("poll-test-user", "poller", roleUser, ws)
+		h.join(c, hb)
+		go c.writePump()
+		c.readPump()
+	}))
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	return ws, func() {
+		ws.Close()
+		srv.Close()
+	}
+}
+
+func readReply(t *testing.T, ws *websocket.Conn) msg {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var m msg
+	if err := ws.ReadJSON(&m); err != nil {
+		t.Fatal("connection closed instead of replying:", err)
+	}
+	return m
+}
+
+func TestPollAtTheLimitFitsInAFrame(t *testing.T) {
+	hb := h.addHub(&hub{HubID: "poll-test-hub", HubName: "polls"})
+	defer func() {
+		s := h.shard(hb.HubID)
+		s.mu.Lock()
+		delete(s.hubs, hb.HubID)
+		s.mu.Unlock()
+	}()
+	ws, hangUp := dialTestConn(t, hb)
+	defer hangUp()
+
+	// json escapes < as \u003c, six bytes for each character
+	options := make([]string, maxPollOptions)
+	for i := range options {
+		options[i] = strings.Repeat("<", maxPollText-1) + string(rune('a'+i))
+	}
+	in := msg{Type: msgTypePoll, HubID: hb.HubID, Poll: &poll{
+		Question: strings.Repeat("<", maxPollText),
+		Options:  options,
+	}}
+	if err := ws.WriteJSON(in); err != nil {
+		t.Fatal(err)
+	}
+	got := readReply(t, ws)
+	if got.Type != msgTypePoll || got.Poll == nil || len(got.Poll.Options) != maxPollOptions || got.Body != in.Poll.Question {
+		t.Fatalf("got %+v, want the poll back", got)
+	}
+
+	// anything else is still held to maxMessageSize, without dropping
+	// the connection
+	in = msg{Type: msgTypeBroadcast, HubID: hb.HubID, Body: strings.Repeat("x", maxMessageSize)}
+	if err := ws.WriteJSON(in); err != nil {
+		t.Fatal(err)
+	}
+	if got := readReply(t, ws); got.Type != msgTypeError || got.Code != "too_long" {
+		t.Fatalf("got %+v, want a too_long error", got)
+	}
+}
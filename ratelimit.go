@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Users with no role set get the roleUser limits.
+	roleUser  = "user"
+	roleAdmin = "admin"
+
+	// Throttled this many times inside violationWindow gets you muted.
+	maxViolations   = 5
+	violationWindow = 30 * time.Second
+	muteDuration    = 2 * time.Minute
+
+	// Buckets that haven't been touched in this long are forgotten.
+	bucketIdleTimeout = 10 * time.Minute
+)
+
+// rateLimit configures a token bucket: Rate tokens are added per second,
+// and at most Burst tokens can be saved up. Every message costs one token.
+type rateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst float64 `json:"burst"`
+}
+
+// roleLimits are the limits for a role, per connection and per user.
+// A user with many connections shares the user bucket between them.
+type roleLimits struct {
+	Conn rateLimit `json:"conn"`
+	User rateLimit `json:"user"`
+}
+
+// rateLimits maps roles to their limits. Override with RATE_LIMITS, eg.
+// RATE_LIMITS='{"user":{"conn":{"rate":1,"burst":5},"user":{"rate":2,"burst":10}}}'
+var rateLimits = map[string]roleLimits{
+	roleUser: {
+		Conn: rateLimit{Rate: 2, Burst: 10},
+		User: rateLimit{Rate: 3, Burst: 15},
+	},
+	roleAdmin: {
+		Conn: rateLimit{Rate: 10, Burst: 50},
+		User: rateLimit{Rate: 20, Burst: 100},
+	},
+	roleGuest: {
+		Conn: rateLimit{Rate: 0.5, Burst: 3},
+		User: rateLimit{Rate: 0.5, Burst: 3},
+	},
+}
+
+// hubRateLimit caps how many messages a single hub takes from everyone.
+// Override with HUB_RATE_LIMIT='{"rate":50,"burst":200}'
+var hubRateLimit = rateLimit{Rate: 50, Burst: 200}
+
+var limiter = newRateLimiter()
+
+func init() {
+	if s := os.Getenv("RATE_LIMITS"); s != "" {
+		custom := make(map[string]roleLimits)
+		if err := json.Unmarshal([]byte(s), &custom); err != nil {
+			fmt.Println("Error parsing RATE_LIMITS, using defaults.", err)
+		} else {
+			for role, l := range custom {
+				rateLimits[role] = l
+			}
+		}
+	}
+	if s := os.Getenv("HUB_RATE_LIMIT"); s != "" {
+		if err := json.Unmarshal([]byte(s), &hubRateLimit); err != nil {
+			fmt.Println("Error parsing HUB_RATE_LIMIT, using default.", err)
+		}
+	}
+
+	go limiter.pruneLoop()
+}
+
+// limitsFor returns the limits for a role, falling back to roleUser.
+func limitsFor(role string) roleLimits {
+	if l, ok := rateLimits[role]; ok {
+		return l
+	}
+	return rateLimits[roleUser]
+}
+
+// tokenBucket is the state of a single bucket, the limit is passed in
+// so changing the config applies to existing buckets.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the last call.
+func (b *tokenBucket) refill(l rateLimit, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = l.Burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * l.Rate
+		if b.tokens > l.Burst {
+			b.tokens = l.Burst
+		}
+	}
+	b.last = now
+}
+
+// wait returns how long until a token is available, 0 if there is one now.
+func (b *tokenBucket) wait(l rateLimit, now time.Time) time.Duration {
+	b.refill(l, now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	if l.Rate <= 0 {
+		return muteDuration
+	}
+	return time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+}
+
+// rateLimiter holds the per-user and per-hub buckets, and buckets for
+// anything else keyed by a string, see take.
+// The per-connection bucket lives on the connection itself.
+type rateLimiter struct {
+	mu    sync.Mutex
+	users map[string]*tokenBucket
+	hubs  map[string]*tokenBucket
+	keys  map[string]*tokenBucket
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		users: make(map[string]*tokenBucket),
+		hubs:  make(map[string]*tokenBucket),
+		keys:  make(map[string]*tokenBucket),
+	}
+}
+
+// take takes a token from the bucket for key, eg. "resend:<userID>".
+// When throttled it returns how long until the next token.
+func (rl *rateLimiter) take(key string, l rateLimit) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	b := rl.keys[key]
+	if b == nil {
+		b = &tokenBucket{}
+		rl.keys[key] = b
+	}
+	if w := b.wait(l, time.Now()); w > 0 {
+		return false, w
+	}
+	b.tokens--
+	return true, 0
+}
+
+// allow takes a token from the connection, user and (if hubID is set) hub
+// buckets. Nothing is taken unless all of them have one. When throttled it
+// returns how long the client should wait before retrying, and if it was
+// the connection's or user's own bucket that ran out rather than the hub's.
+func (rl *rateLimiter) allow(c *connection, hubID string) (bool, time.Duration, bool) {
+	return rl.allowSender(c.userID, c.role, &c.bucket, hubID)
+}
+
+// allowSender is allow for messages that may not come from a connection,
+// eg. the HTTP API or a schedule, connBucket is nil then. They share the
+// user and hub buckets with the user's websocket.
+func (rl *rateLimiter) allowSender(userID, role string, connBucket *tokenBucket, hubID string) (bool, time.Duration, bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	limits := limitsFor(role)
+
+	userBucket := rl.users[userID]
+	if userBucket == nil {
+		userBucket = &tokenBucket{}
+		rl.users[userID] = userBucket
+	}
+
+	var retryAfter time.Duration
+	if connBucket != nil {
+		retryAfter = connBucket.wait(limits.Conn, now)
+	}
+	if w := userBucket.wait(limits.User, now); w > retryAfter {
+		retryAfter = w
+	}
+
+	own := retryAfter > 0
+
+	var hubBucket *tokenBucket
+	if hubID != "" {
+		hubBucket = rl.hubs[hubID]
+		if hubBucket == nil {
+			hubBucket = &tokenBucket{}
+			rl.hubs[hubID] = hubBucket
+		}
+		if w := hubBucket.wait(hubRateLimit, now); w > retryAfter {
+			retryAfter = w
+		}
+	}
+
+	if retryAfter > 0 {
+		return false, retryAfter, own
+	}
+
+	if connBucket != nil {
+		connBucket.tokens--
+	}
+	userBucket.tokens--
+	if hubBucket != nil {
+		hubBucket.tokens--
+	}
+	return true, 0, false
+}
+
+// pruneLoop forgets idle buckets so the maps don't grow forever.
+func (rl *rateLimiter) pruneLoop() {
+	ticker := time.NewTicker(bucketIdleTimeout)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		rl.mu.Lock()
+		for id, b := range rl.users {
+			if now.Sub(b.last) > bucketIdleTimeout {
+				delete(rl.users, id)
+			}
+		}
+		for id, b := range rl.hubs {
+			if now.Sub(b.last) > bucketIdleTimeout {
+				delete(rl.hubs, id)
+			}
+		}
+		for key, b := range rl.keys {
+			if now.Sub(b.last) > bucketIdleTimeout {
+				delete(rl.keys, key)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
+
+// checkRate decides if a message from c can go through. If not, the client
+// is told why and when to retry. Repeated violations of its own limits get
+// the conn muted, a busy hub doesn't count against it.
+// Only called from the connection's readPump.
+func (c *connection) checkRate(hubID string) bool {
+	now := time.Now()
+
+	if now.Before(c.mutedUntil) {
+		c.throttled("muted", "You are muted for flooding.", c.mutedUntil.Sub(now))
+		return false
+	}
+
+	ok, retryAfter, own := limiter.allow(c, hubID)
+	if ok {
+		return true
+	}
+	if !own {
+		// someone else is flooding the hub, that's not on c
+		c.throttled("hub_rate_limited", "This hub is busy, try again shortly.", retryAfter)
+		return false
+	}
+
+	if now.Sub(c.violationStart) > violationWindow {
+		c.violationStart = now
+		c.violations = 0
+	}
+	c.violations++
+
+	if c.violations >= maxViolations {
+		fmt.Println("Muting user for flooding:", c.userID)
+		c.mutedUntil = now.Add(muteDuration)
+		c.violations = 0
+		c.throttled("muted", "You are muted for flooding.", muteDuration)
+		return false
+	}
+
+	c.throttled("rate_limited", "You are sending messages too fast.", retryAfter)
+	return false
+}
+
+// throttled tells the client its message was rejected.
+// Don't block the read pump if the client isn't reading either.
+func (c *connection) throttled(code, body string, retryAfter time.Duration) {
+	m := msg{
+		Type:       msgTypeError,
+		Code:       code,
+		Body:       body,
+		RetryAfter: int64(retryAfter / time.Millisecond),
+	}
+	select {
+	case c.send <- m:
+	default:
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"code.google.com/p/go.crypto/bcrypt"
+	r "github.com/dancannon/gorethink"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessionauth"
+	"github.com/martini-contrib/sessions"
+)
+
+var (
+	FORGOT_PAGE = "forgot"
+	RESET_PAGE  = "reset"
+)
+
+const (
+	// How long a password reset link works for.
+	resetTokenTTL = 1 * time.Hour
+
+	// Session key holding the user's session epoch at login time.
+	sessionEpochKey = "session_epoch"
+)
+
+// Reset mails are throttled per address and per IP, like verification
+// mails, so /forgot can't be used to flood someone's inbox.
+var (
+	forgotEmailLimit = rateLimit{Rate: 1.0 / 60, Burst: 3}
+	forgotIPLimit    = rateLimit{Rate: 1.0 / 60, Burst: 10}
+)
+
+// resetToken is a pending password reset. Only the hash of the token is
+// stored, the token itself is only ever in the email.
+type resetToken struct {
+	Id      string    `gorethink:"id"` // sha256 of the token
+	UserID  string    `gorethink:"user_id"`
+	Created time.Time `gorethink:"created"`
+	Expires time.Time `gorethink:"expires"`
+	Used    bool      `gorethink:"used"`
+}
+
+// hashToken is how secret tokens are stored. They're random and long,
+// so a plain sha256 is enough.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newResetToken stores a new reset token for the user and returns it.
+func newResetToken(userID string) (string, error) {
+	token := randomID(32)
+	now := time.Now()
+	rt := resetToken{
+		Id:      hashToken(token),
+		UserID:  userID,
+		Created: now,
+		Expires: now.Add(resetTokenTTL),
+	}
+	if _, err := r.Table("reset_token").Insert(rt).RunWrite(dbSession); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// getResetToken looks up a token that can still be used.
+func getResetToken(token string) (*resetToken, error) {
+	var rt resetToken
+	row, err := r.Table("reset_token").Get(hashToken(token)).RunRow(dbSession)
+	if err != nil {
+		return nil, err
+	}
+	if row.IsNil() {
+		return nil, errors.New("unknown reset token")
+	}
+	if err := row.Scan(&rt); err != nil {
+		return nil, err
+	}
+	if rt.Used || time.Now().After(rt.Expires) {
+		return nil, errors.New("reset token used or expired")
+	}
+	return &rt, nil
+}
+
+// useResetToken marks a token used. Only one caller can ever win this,
+// even if the link is submitted twice at the same time.
+func useResetToken(rt *resetToken) error {
+	res, err := r.Table("reset_token").Get(rt.Id).Update(func(row r.Term) interface{} {
+		return r.Branch(
+			row.Field("used").Or(row.Field("expires").Lt(r.Now())),
+			map[string]interface{}{},
+			map[string]interface{}{"used": true},
+		)
+	}).RunWrite(dbSession)
+	if err != nil {
+		return err
+	}
+	if res.Replaced != 1 {
+		return errors.New("reset token used or expired")
+	}
+
+	// any other links sent to this user are no good anymore
+	r.Table("reset_token").GetAllByIndex("user_id", rt.UserID).
+		Filter(r.Row.Field("used").Eq(false)).
+		Delete().RunWrite(dbSession)
+	return nil
+}
+
+// sendResetMail mails u a new reset link. body has a %s for the link.
+func sendResetMail(u *User, body string) error {
+	token, err := newResetToken(u.Id)
+	if err != nil {
+		return err
+	}
+	link := baseURL + "/reset?token=" + token
+	return sendMail(u.Email, "Reset your ChatGo password", fmt.Sprintf(body, link))
+}
+
+// setPassword saves a new password hash and signs the user out of every
+// session but keepSessionID, which can be "".
+func setPassword(userID string, hash []byte, keepSessionID string) error {
+	_, err := r.Table("user").Get(userID).Update(map[string]interface{}{
+		"password":      string(hash),
+		"session_epoch": r.Row.Field("session_epoch").Default(0).Add(1),
+	}).RunWrite(dbSession)
+	if err != nil {
+		return err
+	}
+
+	if err := revokeUserSessions(userID, keepSessionID, "password changed"); err != nil {
+		return err
+	}
+	disconnectUser(userID, "password changed")
+	return nil
+}
+
+// checkSessionEpoch logs out sessions started before the user's last
+// password reset. Runs on every request after sessionauth.SessionUser.
+func checkSessionEpoch(session sessions.Session, user sessionauth.User) {
+	if !user.IsAuthenticated() {
+		return
+	}
+	epoch, _ := session.Get(sessionEpochKey).(int)
+	if epoch != user.(*User).SessionEpoch {
+		fmt.Println("Session is from before a password reset, logging out.")
+		sessionauth.Logout(session, user)
+	}
+}
+
+//-----------------------------------------------------------------------------
+// HANDLERS
+//-----------------------------------------------------------------------------
+
+func getForgotPage(session sessions.Session, r render.Render) {
+	r.HTML(200, FORGOT_PAGE, page(session, nil))
+}
+
+// postForgotHandler mails a reset link if the email belongs to a user.
+// The reply is the same either way, so this can't be used to find users.
+func postForgotHandler(session sessions.Session, rend render.Render, req *http.Request) {
+	email := req.FormValue("email")
+	if problem := validateEmail(email); problem != "" {
+		session.AddFlash(problem)
+		rend.Redirect("/forgot")
+		return
+	}
+
+	// the same whether the address has an account or not
+	ok, _ := limiter.take("forgot-ip:"+clientIP(req), forgotIPLimit)
+	if ok {
+		ok, _ = limiter.take("forgot:"+strings.ToLower(strings.TrimSpace(email)), forgotEmailLimit)
+	}
+	if !ok {
+		fmt.Println("Too many reset mails for", email, "from", clientIP(req))
+		session.AddFlash("Too many reset requests, try again in a few minutes.")
+		rend.Redirect("/forgot")
+		return
+	}
+
+	user, err := findUserByEmail(email)
+	if err == nil && user != nil {
+		body := "Someone asked to reset the password of your ChatGo account.\n\n" +
+			"To choose a new password, open this link within an hour:\n\n%s\n\n" +
+			"If it wasn't you, ignore this email and nothing will change.\n"
+		if err := sendResetMail(user, body); err != nil {
+			fmt.Println("Error sending reset mail.", err)
+		}
+	} else if err != nil {
+		fmt.Println(err)
+	}
+
+	rend.HTML(200, FORGOT_PAGE, page(session, map[string]interface{}{"Sent": true}))
+}
+
+func getResetPage(session sessions.Session, rend render.Render, req *http.Request) {
+	token := req.URL.Query().Get("token")
+	if _, err := getResetToken(token); err != nil {
+		fmt.Println(err)
+		rend.HTML(200, RESET_PAGE, page(session, map[string]interface{}{"Invalid": true}))
+		return
+	}
+	rend.HTML(200, RESET_PAGE, page(session, map[string]interface{}{"Token": token}))
+}
+
+func postResetHandler(session sessions.Session, rend render.Render, req *http.Request) {
+	token := req.FormValue("token")
+	password := req.FormValue("password")
+
+	rt, err := getResetToken(token)
+	if err != nil {
+		fmt.Println(err)
+		rend.HTML(200, RESET_PAGE, page(session, map[string]interface{}{"Invalid": true}))
+		return
+	}
+
+	if password != req.FormValue("confirmpassword") {
+		fmt.Println("New passwords don't match")
+		session.AddFlash("The passwords don't match.")
+		rend.Redirect("/reset?token=" + token)
+		return
+	}
+	var u User
+	if err := u.GetById(rt.UserID); err != nil {
+		rend.Redirect("/reset?token=" + token)
+		return
+	}
+	if problem := validatePassword(password, u.Email); problem != "" {
+		session.AddFlash(problem)
+		rend.Redirect("/reset?token=" + token)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		rend.Redirect("/reset?token=" + token)
+		return
+	}
+
+	if err := useResetToken(rt); err != nil {
+		fmt.Println(err)
+		rend.HTML(200, RESET_PAGE, page(session, map[string]interface{}{"Invalid": true}))
+		return
+	}
+
+	if err := setPassword(rt.UserID, hash, ""); err != nil {
+		fmt.Println("Error saving new password.", err)
+		rend.Redirect("/reset?token=" + token)
+		return
+	}
+	logAudit(req, &u, auditPasswordReset, "user", u.Id, nil)
+
+	fmt.Println("Password reset done. Try to login.")
+	session.AddFlash("Your password is changed, log in with it.")
+	rend.Redirect(sessionauth.RedirectUrl)
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessionauth"
+	"github.com/robfig/cron"
+)
+
+const (
+	// How often every node looks for scheduled messages that are due.
+	schedulerInterval = 15 * time.Second
+
+	// Pending schedules a user can have.
+	maxScheduledPerUser = 100
+
+	// How far ahead a one-off message can be scheduled.
+	maxScheduleAhead = 365 * 24 * time.Hour
+)
+
+var (
+	errReminderUndelivered = errors.New("reminder's user isn't connected here")
+	errScheduleThrottled   = errors.New("author or hub over the rate limit, skipped")
+)
+
+// scheduledMsg is a message to send later, once at Due or on every Cron
+// tick. It's sent as its author, so it stops working if they lose access
+// to the hub. Reminders go to UserID instead of a hub, only to their own
+// author for now.
+type scheduledMsg struct {
+	Id      string    `json:"id" gorethink:"id,omitempty"`
+	OwnerID string    `json:"-" gorethink:"owner_id"`
+	HubID   string    `json:"hub_id,omitempty" gorethink:"hub_id,omitempty"`
+	UserID  string    `json:"user_id,omitempty" gorethink:"user_id,omitempty"`
+	Body    string    `json:"body" gorethink:"body"`
+	Cron    string    `json:"cron,omitempty" gorethink:"cron,omitempty"` // standard 5 field spec, UTC
+	Due     time.Time `json:"due" gorethink:"due"`                       // next send
+	Created time.Time `json:"created" gorethink:"created"`
+
+	LastSent  time.Time `json:"last_sent,omitempty" gorethink:"last_sent,omitempty"`
+	LastError string    `json:"last_error,omitempty" gorethink:"last_error,omitempty"`
+}
+
+// scheduleInput is what clients send to create or edit a schedule. At is
+// RFC 3339, for one-off sends.
+type scheduleInput struct {
+	HubID  string `json:"hub_id"`
+	UserID string `json:"user_id"`
+	Body   string `json:"body"`
+	At     string `json:"at"`
+	Cron   string `json:"cron"`
+}
+
+func init() {
+	_, err := r.Table("scheduled").IndexCreate("due").Run(dbSession)
+	fmt.Println("create index scheduled due error: ", err)
+	_, err = r.Table("scheduled").IndexCreate("owner_id").Run(dbSession)
+	fmt.Println("create index scheduled owner_id error: ", err)
+
+	go schedulerLoop()
+}
+
+// apply sets the body and timing of s from in, and works out when it's
+// due next.
+func (s *scheduledMsg) apply(in scheduleInput, now time.Time) error {
+	s.Body = strings.TrimSpace(in.Body)
+	if s.Body == "" {
+		return errors.New("body is empty")
+	}
+	if (in.At == "") == (in.Cron == "") {
+		return errors.New("give either at or cron")
+	}
+
+	s.Cron = in.Cron
+	if in.Cron != "" {
+		sched, err := cron.ParseStandard(in.Cron)
+		if err != nil {
+			return fmt.Errorf("bad cron: %v", err)
+		}
+		s.Due = sched.Next(now)
+		return nil
+	}
+
+	at, err := time.Parse(time.RFC3339, in.At)
+	if err != nil {
+		return fmt.Errorf("bad at: %v", err)
+	}
+	if !at.After(now) || at.Sub(now) > maxScheduleAhead {
+		return errors.New("at has to be in the next year")
+	}
+	s.Due = at.UTC()
+	return nil
+}
+
+// next returns when a recurring schedule is due after now, zero for one-off.
+func (s *scheduledMsg) next(now time.Time) time.Time {
+	if s.Cron == "" {
+		return time.Time{}
+	}
+	sched, err := cron.ParseStandard(s.Cron)
+	if err != nil {
+		return time.Time{}
+	}
+	return sched.Next(now)
+}
+
+// getScheduled returns the user's schedule with the given ID, nil if none.
+func getScheduled(ownerID, id string) (*scheduledMsg, error) {
+	row, err := r.Table("scheduled").Get(id).RunRow(dbSession)
+	if err != nil {
+		return nil, err
+	}
+	if row.IsNil() {
+		return nil, nil
+	}
+	var s scheduledMsg
+	if err := row.Scan(&s); err != nil {
+		return nil, err
+	}
+	if s.OwnerID != ownerID {
+		return nil, nil
+	}
+	return &s, nil
+}
+
+// listScheduled returns the user's pending schedules, soonest first.
+func listScheduled(ownerID string) ([]scheduledMsg, error) {
+	rows, err := r.Table("scheduled").GetAllByIndex("owner_id", ownerID).OrderBy("due").Run(dbSession)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pending := []scheduledMsg{}
+	for rows.Next() {
+		var s scheduledMsg
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		pending = append(pending, s)
+	}
+	return pending, rows.Err()
+}
+
+// schedulerLoop sends scheduled messages when they're due. Every node
+// runs it, claimDue makes sure only one of them sends each message.
+// Reminders are only claimed by the node their user is connected to, so
+// they wait in the table while the user is offline.
+func schedulerLoop() {
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		rows, err := r.Table("scheduled").
+			Between(r.Minval, now, r.BetweenOpts{Index: "due", RightBound: "closed"}).
+			Run(dbSession)
+		if err != nil {
+			fmt.Println("Error looking for scheduled messages.", err)
+			continue
+		}
+		var due []scheduledMsg
+		for rows.Next() {
+			var s scheduledMsg
+			if err := rows.Scan(&s); err != nil {
+				fmt.Println("Error reading scheduled message.", err)
+				break
+			}
+			due = append(due, s)
+		}
+		rows.Close()
+
+		for i := range due {
+			if due[i].UserID != "" && h.getConn(due[i].UserID) == nil {
+				continue
+			}
+			if claimDue(&due[i], now) {
+				sendScheduled(&due[i])
+			}
+		}
+	}
+}
+
+// claimDue moves s on to its next send, or deletes it if it was one-off.
+// Only one node sees true for each send: the write only happens if the
+// row is still due when it was read.
+func claimDue(s *scheduledMsg, now time.Time) bool {
+	var after interface{}
+	if next := s.next(now); !next.IsZero() {
+		after = r.Row.Merge(map[string]interface{}{"due": next, "last_sent": now})
+	}
+	res, err := r.Table("scheduled").Get(s.Id).
+		Replace(r.Branch(r.Row.Field("due").Eq(s.Due), after, r.Row)).
+		RunWrite(dbSession)
+	if err != nil {
+		fmt.Println("Error claiming scheduled message.", s.Id, err)
+		return false
+	}
+	return res.Replaced+res.Deleted == 1
+}
+
+// sendScheduled sends s as its author, if they can still post there.
+func sendScheduled(s *scheduledMsg) {
+	err := deliverScheduled(s)
+	if err == errReminderUndelivered {
+		// the user went away since the claim, put it back as it was
+		_, err = r.Table("scheduled").Insert(s, r.InsertOpts{Upsert: true}).RunWrite(dbSession)
+		if err != nil {
+			fmt.Println("Error putting back reminder.", s.Id, err)
+		}
+		return
+	}
+	if err != nil {
+		fmt.Println("Scheduled message not sent.", s.Id, err)
+	}
+	if s.Cron != "" {
+		// one-off ones are gone already, recurring ones show what happened
+		lastError := ""
+		if err != nil {
+			lastError = err.Error()
+		}
+		r.Table("scheduled").Get(s.Id).Update(map[string]interface{}{"last_error": lastError}).RunWrite(dbSession)
+	}
+}
+
+func deliverScheduled(s *scheduledMsg) error {
+	var author User
+	if err := author.GetById(s.OwnerID); err != nil {
+		return err
+	}
+	if author.Id == "" || loginBlocked(&author) != nil {
+		return errors.New("author can't sign in anymore")
+	}
+
+	m := msg{
+		ID:     randomID(16),
+		Type:   msgTypeBroadcast,
+		HubID:  s.HubID,
+		From:   author.Username,
+		FromID: author.Id,
+		Body:   s.Body,
+		Time:   nowMillis(),
+	}
+	if s.UserID != "" {
+		m.Type, m.ID = msgTypeReminder, s.Id
+		if !sendToUser(s.UserID, m) {
+			return errReminderUndelivered
+		}
+		return nil
+	}
+
+	if !author.Hubs[s.HubID] {
+		return errors.New("author isn't in the hub anymore")
+	}
+	if _, err := workspaceHub(&author, s.HubID); err != nil {
+		return err
+	}
+	// sent as the author, so it counts against their rate limits and the
+	// hub's like anything they'd send themselves, a send over it is dropped
+	if ok, _, _ := limiter.allowSender(author.Id, author.Role, nil, s.HubID); !ok {
+		return errScheduleThrottled
+	}
+	return h.broadcast(s.HubID, m)
+}
+
+// checkTarget makes sure u can schedule sends to in's hub or user.
+func checkTarget(u *User, in scheduleInput, s *scheduledMsg) error {
+	if in.HubID == "" && (in.UserID == "" || in.UserID == u.Id) {
+		s.UserID = u.Id // a reminder
+		return nil
+	}
+	if in.HubID == "" {
+		return errors.New("reminders can only be for yourself")
+	}
+	if _, err := workspaceHub(u, in.HubID); err != nil || !u.Hubs[in.HubID] {
+		return errors.New("join the hub first")
+	}
+	s.HubID = in.HubID
+	return nil
+}
+
+func readScheduleInput(req *http.Request) (scheduleInput, error) {
+	var in scheduleInput
+	err := json.NewDecoder(io.LimitReader(req.Body, 64<<10)).Decode(&in)
+	return in, err
+}
+
+//-----------------------------------------------------------------------------
+// HANDLERS
+//-----------------------------------------------------------------------------
+
+// getScheduledHandler - GET /scheduled, the user's pending schedules.
+func getScheduledHandler(user sessionauth.User, rend render.Render) {
+	pending, err := listScheduled(user.(*User).Id)
+	if err != nil {
+		fmt.Println("Error listing scheduled messages.", err)
+		rend.JSON(500, map[string]string{"error": "error listing scheduled messages"})
+		return
+	}
+	rend.JSON(200, pending)
+}
+
+// postScheduledHandler - POST /scheduled, takes JSON like
+// {"hub_id": "...", "body": "standup!", "cron": "0 9 * * 1-5"} or
+// {"body": "call Bob", "at": "2030-01-02T15:04:05Z"}. Without a hub_id
+// it's a reminder only the user sees.
+func postScheduledHandler(user sessionauth.User, rend render.Render, req *http.Request) {
+	u := user.(*User)
+	if u.Unverified {
+		rend.JSON(403, map[string]string{"error": "verify your email first"})
+		return
+	}
+	in, err := readScheduleInput(req)
+	if err != nil {
+		rend.JSON(400, map[string]string{"error": "expected JSON with body and at or cron"})
+		return
+	}
+
+	s := &scheduledMsg{OwnerID: u.Id, Created: time.Now()}
+	if err := checkTarget(u, in, s); err != nil {
+		rend.JSON(403, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := s.apply(in, time.Now().UTC()); err != nil {
+		rend.JSON(400, map[string]string{"error": err.Error()})
+		return
+	}
+
+	pending, err := listScheduled(u.Id)
+	if err != nil || len(pending) >= maxScheduledPerUser {
+		rend.JSON(403, map[string]string{"error": fmt.Sprintf("you can have at most %d scheduled messages", maxScheduledPerUser)})
+		return
+	}
+
+	res, err := r.Table("scheduled").Insert(s).RunWrite(dbSession)
+	if err != nil || len(res.GeneratedKeys) == 0 {
+		fmt.Println("Error saving scheduled message.", err)
+		rend.JSON(500, map[string]string{"error": "error saving scheduled message"})
+		return
+	}
+	s.Id = res.GeneratedKeys[0]
+	rend.JSON(201, s)
+}
+
+// postEditScheduledHandler - POST /scheduled/:id, changes the body and
+// timing of a pending schedule, same JSON as creating one. The target
+// can't change.
+func postEditScheduledHandler(params martini.Params, user sessionauth.User, rend render.Render, req *http.Request) {
+	s, err := getScheduled(user.(*User).Id, params["id"])
+	if err != nil || s == nil {
+		rend.JSON(404, map[string]string{"error": "no such scheduled message"})
+		return
+	}
+	in, err := readScheduleInput(req)
+	if err != nil {
+		rend.JSON(400, map[string]string{"error": "expected JSON with body and at or cron"})
+		return
+	}
+	if err := s.apply(in, time.Now().UTC()); err != nil {
+		rend.JSON(400, map[string]string{"error": err.Error()})
+		return
+	}
+
+	res, err := r.Table("scheduled").Get(s.Id).Update(map[string]interface{}{
+		"body": s.Body,
+		"cron": s.Cron,
+		"due":  s.Due,
+	}).RunWrite(dbSession)
+	if err != nil {
+		fmt.Println("Error editing scheduled message.", err)
+		rend.JSON(500, map[string]string{"error": "error saving scheduled message"})
+		return
+	}
+	// a one-off one can be sent, and gone, since it was read above
+	if res.Replaced+res.Unchanged == 0 {
+		rend.JSON(404, map[string]string{"error": "no such scheduled message, it may have been sent"})
+		return
+	}
+	rend.JSON(200, s)
+}
+
+// postCancelScheduledHandler - POST /scheduled/:id/cancel
+func postCancelScheduledHandler(params martini.Params, user sessionauth.User, rend render.Render) {
+	s, err := getScheduled(user.(*User).Id, params["id"])
+	if err != nil || s == nil {
+		rend.JSON(404, map[string]string{"error": "no such scheduled message"})
+		return
+	}
+	if _, err := r.Table("scheduled").Get(s.Id).Delete().RunWrite(dbSession); err != nil {
+		fmt.Println("Error cancelling scheduled message.", err)
+		rend.JSON(500, map[string]string{"error": "error cancelling scheduled message"})
+		return
+	}
+	rend.JSON(200, map[string]string{"status": "ok"})
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/go-martini/martini"
+	"github.com/gorilla/securecookie"
+	gsessions "github.com/gorilla/sessions"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessionauth"
+	"github.com/martini-contrib/sessions"
+)
+
+var SESSIONS_PAGE = "sessions"
+
+const (
+	// Sessions not used for this long are deleted, sooner if nobody
+	// ever logged in with them.
+	sessionIdleTTL     = 30 * 24 * time.Hour
+	anonSessionIdleTTL = 24 * time.Hour
+
+	// last_seen is only written this often per session.
+	sessionTouchInterval = time.Minute
+
+	// Session key holding the session's own ID, so handlers can find it.
+	sessionIDKey = "sid"
+
+	// Set by rotateSession, Save gives the session a new ID.
+	sessionRotateKey = "rotate"
+)
+
+// storedSession is a session in the "session" table. The cookie only
+// holds the signed ID, the values live here.
+type storedSession struct {
+	Id        string    `gorethink:"id"`
+	UserID    string    `gorethink:"user_id"`
+	Data      string    `gorethink:"data"` // gob of the values, base64
+	UserAgent string    `gorethink:"user_agent"`
+	IP        string    `gorethink:"ip"`
+	Created   time.Time `gorethink:"created"`
+	LastSeen  time.Time `gorethink:"last_seen"`
+}
+
+// rethinkStore is a sessions.Store that keeps sessions in RethinkDB, so
+// they can be listed and revoked.
+type rethinkStore struct {
+	codecs  []securecookie.Codec
+	options *gsessions.Options
+}
+
+// sessionKeys are the keys cookies are signed with, from SESSION_KEYS,
+// comma separated. The first one signs new cookies, the others are still
+// accepted, so keys can be rotated by adding a new one at the front and
+// dropping the last one later. Without SESSION_KEYS, APP_SECRET is used.
+func sessionKeys() [][]byte {
+	var keys [][]byte
+	for _, k := range strings.Split(os.Getenv("SESSION_KEYS"), ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			keys = append(keys, []byte(k))
+		}
+	}
+	if len(keys) == 0 {
+		keys = append(keys, appSecret)
+	}
+	return keys
+}
+
+// newSessionStore makes a store signing cookies with keys, see sessionKeys.
+func newSessionStore(keys [][]byte) *rethinkStore {
+	// only signing, the cookie has nothing secret in it
+	var pairs [][]byte
+	for _, k := range keys {
+		pairs = append(pairs, k, nil)
+	}
+	st := &rethinkStore{
+		codecs:  securecookie.CodecsFromPairs(pairs...),
+		options: &gsessions.Options{Path: "/", HttpOnly: true},
+	}
+	go st.pruneLoop()
+	return st
+}
+
+// Options sets the cookie options, from sessions.Store.
+func (st *rethinkStore) Options(o sessions.Options) {
+	st.options = &gsessions.Options{
+		Path:     o.Path,
+		Domain:   o.Domain,
+		MaxAge:   o.MaxAge,
+		Secure:   o.Secure,
+		HttpOnly: o.HttpOnly,
+	}
+	if st.options.Path == "" {
+		st.options.Path = "/"
+	}
+	st.options.HttpOnly = true
+}
+
+// Get returns the session for the request, cached for the request.
+func (st *rethinkStore) Get(req *http.Request, name string) (*gsessions.Session, error) {
+	return gsessions.GetRegistry(req).Get(st, name)
+}
+
+// New loads the session named in the cookie, or starts a new one.
+func (st *rethinkStore) New(req *http.Request, name string) (*gsessions.Session, error) {
+	s := gsessions.NewSession(st, name)
+	opts := *st.options
+	s.Options = &opts
+	s.IsNew = true
+
+	cookie, err := req.Cookie(name)
+	if err != nil {
+		return st.fresh(s), nil
+	}
+
+	var id string
+	if err := securecookie.DecodeMulti(name, cookie.Value, &id, st.codecs...); err != nil {
+		return st.fresh(s), nil
+	}
+
+	stored, err := getStoredSession(id)
+	if err != nil {
+		// revoked or expired, start over
+		return st.fresh(s), nil
+	}
+	if err := decodeSessionValues(stored.Data, s.Values); err != nil {
+		fmt.Println("Error decoding session.", err)
+		return st.fresh(s), nil
+	}
+
+	s.ID = stored.Id
+	s.IsNew = false
+	s.Values[sessionIDKey] = s.ID
+
+	if time.Since(stored.LastSeen) > sessionTouchInterval {
+		go r.Table("session").Get(s.ID).Update(map[string]interface{}{
+			"last_seen": time.Now(),
+			"ip":        clientIP(req),
+		}).RunWrite(dbSession)
+	}
+	return s, nil
+}
+
+// fresh gives a new session its ID.
+func (st *rethinkStore) fresh(s *gsessions.Session) *gsessions.Session {
+	s.ID = randomID(32)
+	s.Values[sessionIDKey] = s.ID
+	return s
+}
+
+// Save writes the session and sets the cookie. Existing sessions are only
+// updated, never created again, so a revoked session stays revoked even
+// if a request of it was still running.
+func (st *rethinkStore) Save(req *http.Request, w http.ResponseWriter, s *gsessions.Session) error {
+	if s.Options.MaxAge < 0 {
+		r.Table("session").Get(s.ID).Delete().RunWrite(dbSession)
+		http.SetCookie(w, gsessions.NewCookie(s.Name(), "", s.Options))
+		return nil
+	}
+
+	if rotate, _ := s.Values[sessionRotateKey].(bool); rotate {
+		delete(s.Values, sessionRotateKey)
+		if !s.IsNew {
+			if _, err := r.Table("session").Get(s.ID).Delete().RunWrite(dbSession); err != nil {
+				return err
+			}
+		}
+		st.fresh(s)
+		s.IsNew = true
+	}
+
+	data, err := encodeSessionValues(s.Values)
+	if err != nil {
+		return err
+	}
+	userID, _ := s.Values[sessionauth.SessionKey].(string)
+
+	if s.IsNew {
+		now := time.Now()
+		stored := storedSession{
+			Id:        s.ID,
+			UserID:    userID,
+			Data:      data,
+			UserAgent: req.UserAgent(),
+			IP:        clientIP(req),
+			Created:   now,
+			LastSeen:  now,
+		}
+		if _, err := r.Table("session").Insert(stored).RunWrite(dbSession); err != nil {
+			return err
+		}
+		s.IsNew = false
+	} else {
+		_, err := r.Table("session").Get(s.ID).Update(map[string]interface{}{
+			"user_id":   userID,
+			"data":      data,
+			"last_seen": time.Now(),
+		}).RunWrite(dbSession)
+		if err != nil {
+			return err
+		}
+	}
+
+	encoded, err := securecookie.EncodeMulti(s.Name(), s.ID, st.codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, gsessions.NewCookie(s.Name(), encoded, s.Options))
+	return nil
+}
+
+// pruneLoop deletes sessions nobody used in sessionIdleTTL.
+func (st *rethinkStore) pruneLoop() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		_, err := r.Table("session").
+			Filter(r.Row.Field("last_seen").Lt(now.Add(-sessionIdleTTL)).
+				Or(r.Row.Field("user_id").Eq("").And(r.Row.Field("last_seen").Lt(now.Add(-anonSessionIdleTTL))))).
+			Delete().RunWrite(dbSession)
+		if err != nil {
+			fmt.Println("Error pruning sessions.", err)
+		}
+	}
+}
+
+func encodeSessionValues(values map[interface{}]interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(values); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func decodeSessionValues(data string, values map[interface{}]interface{}) error {
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(&values)
+}
+
+func getStoredSession(id string) (*storedSession, error) {
+	var stored storedSession
+	row, err := r.Table("session").Get(id).RunRow(dbSession)
+	if err != nil {
+		return nil, err
+	}
+	if row.IsNil() {
+		return nil, errors.New("unknown session")
+	}
+	if err := row.Scan(&stored); err != nil {
+		return nil, err
+	}
+	if time.Since(stored.LastSeen) > sessionIdleTTL {
+		return nil, errors.New("session expired")
+	}
+	return &stored, nil
+}
+
+// listSessions returns the signed in sessions of a user, last used first.
+func listSessions(userID string) ([]storedSession, error) {
+	rows, err := r.Table("session").GetAllByIndex("user_id", userID).
+		OrderBy(r.Desc("last_seen")).Run(dbSession)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []storedSession{}
+	for rows.Next() {
+		var s storedSession
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+// rotateSession makes the session get a new ID when it's saved, and
+// deletes it under the old one. Logging in calls it, so a session ID
+// someone planted in the browser before is worth nothing after.
+func rotateSession(session sessions.Session) {
+	session.Set(sessionRotateKey, true)
+}
+
+// revokeSession signs a session out and closes its websocket.
+func revokeSession(userID, sessionID, reason string) error {
+	_, err := r.Table("session").Get(sessionID).Delete().RunWrite(dbSession)
+	if err != nil {
+		return err
+	}
+	disconnectSession(userID, sessionID, reason)
+	return nil
+}
+
+// revokeUserSessions signs out every session of a user except keepID.
+func revokeUserSessions(userID, keepID, reason string) error {
+	list, err := listSessions(userID)
+	if err != nil {
+		return err
+	}
+	for _, s := range list {
+		if s.Id == keepID {
+			continue
+		}
+		if err := revokeSession(userID, s.Id, reason); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// HANDLERS
+//-----------------------------------------------------------------------------
+
+// getSessionsPage - GET /sessions, where the user is signed in.
+func getSessionsPage(session sessions.Session, user sessionauth.User, rend render.Render) {
+	list, err := listSessions(user.(*User).Id)
+	if err != nil {
+		fmt.Println("Error listing sessions.", err)
+	}
+	current, _ := session.Get(sessionIDKey).(string)
+	rend.HTML(200, SESSIONS_PAGE, page(session, map[string]interface{}{
+		"Sessions": list,
+		"Current":  current,
+	}))
+}
+
+// postRevokeSessionHandler - POST /sessions/:id/revoke, or
+// /sessions/revoke-others for everything but this one.
+func postRevokeSessionHandler(params martini.Params, session sessions.Session, user sessionauth.User, rend render.Render, req *http.Request) {
+	currUser := user.(*User)
+	current, _ := session.Get(sessionIDKey).(string)
+
+	var err error
+	if id := params["id"]; id != "" {
+		stored, lookupErr := getStoredSession(id)
+		if lookupErr != nil || stored.UserID != currUser.Id {
+			rend.Redirect("/sessions")
+			return
+		}
+		err = revokeSession(currUser.Id, id, "signed out from another device")
+	} else {
+		err = revokeUserSessions(currUser.Id, current, "signed out from another device")
+	}
+	if err != nil {
+		fmt.Println("Error revoking session.", err)
+		session.AddFlash("Couldn't sign that out, try again.")
+	} else if id := params["id"]; id != "" {
+		logAudit(req, currUser, auditSessionRevoke, "session", id, nil)
+	} else {
+		logAudit(req, currUser, auditSessionRevoke, "user", currUser.Id, map[string]string{"kept": current})
+	}
+	rend.Redirect("/sessions")
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image/png"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"code.google.com/p/go.crypto/bcrypt"
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/qr"
+	r "github.com/dancannon/gorethink"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessionauth"
+	"github.com/martini-contrib/sessions"
+)
+
+var (
+	TWOFACTOR_PAGE = "twofactor"
+	LOGIN_2FA_PAGE = "login2fa"
+)
+
+const (
+	// RFC 6238 defaults, what every authenticator app expects.
+	totpPeriod = 30
+	totpDigits = 6
+
+	// Codes from this many periods before or after now are accepted,
+	// to allow for clock drift.
+	totpSkew = 1
+
+	totpIssuer = "ChatGo"
+
+	recoveryCodeCount = 10
+
+	// How long between the password and the code steps of a login.
+	pendingLoginTTL = 5 * time.Minute
+
+	// Session keys for enrollment and the second login step.
+	totpPendingKey     = "totp_pending"
+	pendingUserKey     = "2fa_user"
+	pendingRedirectKey = "2fa_next"
+	pendingMethodKey   = "2fa_method"
+	pendingStartedKey  = "2fa_started"
+)
+
+// Wrong codes allowed per user before they have to slow down.
+var totpAttemptLimit = rateLimit{Rate: 1.0 / 30, Burst: 5}
+
+// newTOTPSecret returns a random secret, base32 like authenticator apps want.
+func newTOTPSecret() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+}
+
+// totpCode computes the code for a time step, RFC 4226 with SHA1.
+func totpCode(secret []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// checkTOTP checks a code against the secret and returns the time step it
+// matched. Steps at or before lastCounter are rejected so a code can't be
+// replayed.
+func checkTOTP(secret, code string, lastCounter int64) (int64, bool) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+	code = strings.TrimSpace(code)
+
+	now := time.Now().Unix() / totpPeriod
+	for counter := now - totpSkew; counter <= now+totpSkew; counter++ {
+		if counter <= lastCounter {
+			continue
+		}
+		if hmac.Equal([]byte(totpCode(key, counter)), []byte(code)) {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI is what goes in the QR code for authenticator apps.
+func totpURI(email, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+email) + "?" + v.Encode()
+}
+
+// newRecoveryCodes returns fresh codes for the user, and their hashes to store.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code := randomID(5)
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes[i] = code
+		hashes[i] = string(hash)
+	}
+	return codes, hashes, nil
+}
+
+// checkSecondFactor checks a TOTP or recovery code for the user, and saves
+// what it used up so it can't be used again.
+func checkSecondFactor(u *User, code string) error {
+	if counter, ok := checkTOTP(u.TOTPSecret, code, u.TOTPLastCounter); ok {
+		// only save if nobody used this step in the meantime
+		res, err := r.Table("user").Get(u.Id).Update(func(row r.Term) interface{} {
+			return r.Branch(
+				row.Field("totp_last_counter").Default(0).Lt(counter),
+				map[string]interface{}{"totp_last_counter": counter},
+				map[string]interface{}{},
+			)
+		}).RunWrite(dbSession)
+		if err != nil {
+			return err
+		}
+		if res.Replaced != 1 {
+			return errors.New("code already used")
+		}
+		return nil
+	}
+
+	code = strings.ToLower(strings.TrimSpace(code))
+	for i, hash := range u.RecoveryCodes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) != nil {
+			continue
+		}
+		// only one login gets to use it, even if two race with the same code
+		res, err := r.Table("user").Get(u.Id).Update(func(row r.Term) interface{} {
+			codes := row.Field("recovery_codes").Default([]string{})
+			return r.Branch(
+				codes.Contains(hash),
+				map[string]interface{}{"recovery_codes": codes.SetDifference([]string{hash})},
+				map[string]interface{}{},
+			)
+		}).RunWrite(dbSession)
+		if err != nil {
+			return err
+		}
+		if res.Replaced != 1 {
+			return errors.New("code already used")
+		}
+		fmt.Println("Recovery code used,", len(u.RecoveryCodes)-i-1, "left for", u.Id)
+		return nil
+	}
+
+	return errors.New("wrong code")
+}
+
+// resetTwoFactor turns 2FA off for a user.
+func resetTwoFactor(userID string) error {
+	_, err := r.Table("user").Get(userID).Update(map[string]interface{}{
+		"totp_enabled":      false,
+		"totp_secret":       "",
+		"totp_last_counter": 0,
+		"recovery_codes":    []string{},
+	}).RunWrite(dbSession)
+	return err
+}
+
+// startSecondFactor remembers who passed the password step, the code step
+// finishes the login.
+func startSecondFactor(session sessions.Session, u *User, method, redirect string) {
+	session.Set(pendingUserKey, u.Id)
+	session.Set(pendingMethodKey, method)
+	session.Set(pendingRedirectKey, redirect)
+	session.Set(pendingStartedKey, time.Now().Unix())
+}
+
+// pendingLoginUser returns the user waiting for the code step, if any.
+func pendingLoginUser(session sessions.Session) (*User, error) {
+	userID, _ := session.Get(pendingUserKey).(string)
+	started, _ := session.Get(pendingStartedKey).(int64)
+	if userID == "" || time.Since(time.Unix(started, 0)) > pendingLoginTTL {
+		clearSecondFactor(session)
+		return nil, errors.New("no login waiting for a code")
+	}
+
+	var u User
+	if err := u.GetById(userID); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func clearSecondFactor(session sessions.Session) {
+	session.Delete(pendingUserKey)
+	session.Delete(pendingRedirectKey)
+	session.Delete(pendingMethodKey)
+	session.Delete(pendingStartedKey)
+}
+
+//-----------------------------------------------------------------------------
+// HANDLERS
+//-----------------------------------------------------------------------------
+
+// getTwoFactorPage shows 2FA status, or starts enrollment with a new secret.
+func getTwoFactorPage(session sessions.Session, user sessionauth.User, rend render.Render) {
+	currUser := user.(*User)
+	if currUser.TOTPEnabled {
+		rend.HTML(200, TWOFACTOR_PAGE, page(session, map[string]interface{}{"Enabled": true}))
+		return
+	}
+
+	secret, _ := session.Get(totpPendingKey).(string)
+	if secret == "" {
+		secret = newTOTPSecret()
+		session.Set(totpPendingKey, secret)
+	}
+	rend.HTML(200, TWOFACTOR_PAGE, page(session, map[string]interface{}{
+		"Secret": secret,
+		"URI":    totpURI(currUser.Email, secret),
+	}))
+}
+
+// getTwoFactorQRHandler - GET /2fa/qr.png, the pending secret as a QR code.
+func getTwoFactorQRHandler(session sessions.Session, user sessionauth.User, w http.ResponseWriter, req *http.Request) {
+	secret, _ := session.Get(totpPendingKey).(string)
+	if secret == "" {
+		http.NotFound(w, req)
+		return
+	}
+
+	code, err := qr.Encode(totpURI(user.(*User).Email, secret), qr.M, qr.Auto)
+	if err == nil {
+		code, err = barcode.Scale(code, 200, 200)
+	}
+	if err != nil {
+		fmt.Println("Error making QR code.", err)
+		http.Error(w, "error making QR code", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	png.Encode(w, code)
+}
+
+// postTwoFactorEnableHandler confirms enrollment with a code from the app,
+// and shows the recovery codes once.
+func postTwoFactorEnableHandler(session sessions.Session, user sessionauth.User, rend render.Render, req *http.Request) {
+	currUser := user.(*User)
+	secret, _ := session.Get(totpPendingKey).(string)
+
+	counter, ok := checkTOTP(secret, req.FormValue("code"), 0)
+	if secret == "" || !ok {
+		fmt.Println("Wrong 2FA enrollment code.")
+		session.AddFlash("That code didn't work, check your phone's clock and try again.")
+		rend.Redirect("/2fa")
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		rend.Redirect("/2fa")
+		return
+	}
+
+	_, err = r.Table("user").Get(currUser.Id).Update(map[string]interface{}{
+		"totp_enabled":      true,
+		"totp_secret":       secret,
+		"totp_last_counter": counter,
+		"recovery_codes":    hashes,
+	}).RunWrite(dbSession)
+	if err != nil {
+		fmt.Println("Error enabling 2FA.", err)
+		rend.Redirect("/2fa")
+		return
+	}
+
+	session.Delete(totpPendingKey)
+	logAudit(req, currUser, auditTwoFactorOn, "user", currUser.Id, nil)
+	rend.HTML(200, TWOFACTOR_PAGE, page(session, map[string]interface{}{"Enabled": true, "RecoveryCodes": codes}))
+}
+
+// postTwoFactorDisableHandler turns 2FA off. It takes a current code or a
+// recovery code rather than the password, OIDC and LDAP users have none.
+func postTwoFactorDisableHandler(session sessions.Session, user sessionauth.User, rend render.Render, req *http.Request) {
+	currUser := user.(*User)
+	if !currUser.TOTPEnabled {
+		rend.Redirect("/2fa")
+		return
+	}
+	if ok, _ := limiter.take("2fa:"+currUser.Id, totpAttemptLimit); !ok {
+		session.AddFlash("Too many attempts, try again in a few minutes.")
+		rend.Redirect("/2fa")
+		return
+	}
+	if err := checkSecondFactor(currUser, req.FormValue("code")); err != nil {
+		fmt.Println("Wrong 2FA code.", err)
+		session.AddFlash("Wrong code.")
+		rend.Redirect("/2fa")
+		return
+	}
+	if err := resetTwoFactor(currUser.Id); err != nil {
+		fmt.Println("Error disabling 2FA.", err)
+	} else {
+		logAudit(req, currUser, auditTwoFactorOff, "user", currUser.Id, nil)
+	}
+	rend.Redirect("/2fa")
+}
+
+func getLoginTwoFactorPage(session sessions.Session, rend render.Render) {
+	if _, err := pendingLoginUser(session); err != nil {
+		rend.Redirect(sessionauth.RedirectUrl)
+		return
+	}
+	rend.HTML(200, LOGIN_2FA_PAGE, page(session, nil))
+}
+
+// postLoginTwoFactorHandler is the second login step, after the password.
+func postLoginTwoFactorHandler(session sessions.Session, rend render.Render, req *http.Request) {
+	u, err := pendingLoginUser(session)
+	if err != nil {
+		fmt.Println(err)
+		rend.Redirect(sessionauth.RedirectUrl)
+		return
+	}
+
+	if _, locked := accountWait(u); locked {
+		clearSecondFactor(session)
+		rend.Redirect(sessionauth.RedirectUrl)
+		return
+	}
+
+	if ok, _ := limiter.take("2fa:"+u.Id, totpAttemptLimit); !ok {
+		fmt.Println("Too many 2FA attempts for", u.Id)
+		rend.HTML(429, LOGIN_2FA_PAGE, page(session, map[string]interface{}{"Throttled": true}))
+		return
+	}
+
+	if err := checkSecondFactor(u, req.FormValue("code")); err != nil {
+		fmt.Println("2FA failed.", err)
+		loginFailed(u.Email, clientIP(req), "totp", err.Error())
+		rend.HTML(200, LOGIN_2FA_PAGE, page(session, map[string]interface{}{"Wrong": true}))
+		return
+	}
+
+	// an admin may have disabled or locked the account since the password
+	// step, look again now the code is right
+	if u, err = pendingLoginUser(session); err != nil {
+		fmt.Println(err)
+		rend.Redirect(sessionauth.RedirectUrl)
+		return
+	}
+	if err := loginBlocked(u); err != nil {
+		fmt.Println("Login blocked after 2FA.", u.Id, err)
+		clearSecondFactor(session)
+		rend.Redirect(sessionauth.RedirectUrl)
+		return
+	}
+	if _, locked := accountWait(u); locked {
+		clearSecondFactor(session)
+		rend.Redirect(sessionauth.RedirectUrl)
+		return
+	}
+
+	redirect, _ := session.Get(pendingRedirectKey).(string)
+	method, _ := session.Get(pendingMethodKey).(string)
+	clearSecondFactor(session)
+	finishLogin(session, u, method+"+totp", redirect, rend, req)
+}
@@ -28,11 +28,49 @@ type User struct {
 	Email         string    `form:"email" gorethink:"email"`
 	Password      string    `form:"password" gorethink:"password"`
 	Username      string    `form:"username" gorethink:"username,omitempty"`
+	Role          string    `form:"-" gorethink:"role,omitempty"`
 	Created       time.Time `form:"-" gorethink:"-"`
 	authenticated bool      `form:"-" gorethink:"-"`
 
-	// chatgo specific, hubs user is in
+	// chatgo specific, hubs user is in, rejoined on connect
 	Hubs map[string]bool `form:"-" gorethink:"hubs"`
+
+	// When the user last read each hub, unix millis by hubID
+	LastRead map[string]int64 `form:"-" gorethink:"last_read,omitempty"`
+
+	// Set until the user opens the link in the verification email
+	Unverified bool `form:"-" gorethink:"unverified,omitempty"`
+
+	// Bumped on password reset, sessions from an older epoch are logged out
+	SessionEpoch int `form:"-" gorethink:"session_epoch"`
+
+	// Two-factor auth, the recovery codes are bcrypt hashes
+	TOTPEnabled     bool     `form:"-" gorethink:"totp_enabled,omitempty"`
+	TOTPSecret      string   `form:"-" gorethink:"totp_secret,omitempty"`
+	TOTPLastCounter int64    `form:"-" gorethink:"totp_last_counter,omitempty"`
+	RecoveryCodes   []string `form:"-" gorethink:"recovery_codes,omitempty"`
+
+	// Subject IDs from OIDC providers the user signs in with, by provider
+	Identities map[string]string `form:"-" gorethink:"identities,omitempty"`
+
+	// Failed logins in a row, see lockout.go
+	FailedLogins    int       `form:"-" gorethink:"failed_logins,omitempty"`
+	LastFailedLogin time.Time `form:"-" gorethink:"last_failed_login,omitempty"`
+	LockedUntil     time.Time `form:"-" gorethink:"locked_until,omitempty"`
+
+	// Bots only sign in with API tokens, and belong to the user OwnerID
+	Bot     bool   `form:"-" gorethink:"bot,omitempty"`
+	OwnerID string `form:"-" gorethink:"owner_id,omitempty"`
+
+	// Set when the user deletes their account, see account.go
+	DeletedAt  time.Time `form:"-" gorethink:"deleted_at,omitempty"`
+	PurgeAfter time.Time `form:"-" gorethink:"purge_after,omitempty"`
+
+	// Set by an admin, the user can't sign in until it's cleared
+	Disabled bool `form:"-" gorethink:"disabled,omitempty"`
+
+	// The workspace the user belongs to, see workspace.go
+	WorkspaceID string `form:"-" gorethink:"workspace_id,omitempty"`
 }
 
 // GetAnonymousUser should generate an anonymous user model
@@ -76,51 +114,62 @@ func (u *User) GetById(id interface{}) error {
 	return nil
 }
 
+// findUserByEmail returns the user with the given email, nil if none.
+func findUserByEmail(email string) (*User, error) {
+	row, err := rethink.Table("user").GetAllByIndex("email", email).RunRow(dbSession)
+	if err != nil {
+		return nil, err
+	}
+	if row.IsNil() {
+		return nil, nil
+	}
+	var u User
+	if err := row.Scan(&u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
 //-----------------------------------------------------------------------------
 // HANDLERS
 //-----------------------------------------------------------------------------
 
-func getLoginPage(user sessionauth.User, r render.Render) {
+func getLoginPage(session sessions.Session, user sessionauth.User, r render.Render) {
 	if user.IsAuthenticated() {
 		r.Redirect(INDEX_PAGE)
 		return
 	}
-	r.HTML(200, LOGIN_PAGE, nil)
+	r.HTML(200, LOGIN_PAGE, page(session, map[string]interface{}{"Providers": oidcProviderList()}))
 }
 
-func logoutHandler(session sessions.Session, user sessionauth.User, r render.Render) {
+func logoutHandler(session sessions.Session, user sessionauth.User, r render.Render, req *http.Request) {
+	id, _ := session.Get(sessionIDKey).(string)
+	if id != "" {
+		revokeSession(user.(*User).Id, id, "logged out")
+	}
+	logAudit(req, user.(*User), auditLogout, "session", id, nil)
 	sessionauth.Logout(session, user)
 	r.Redirect(INDEX_PAGE)
 }
 
-func getRegisterPage(user sessionauth.User, r render.Render) {
+func getRegisterPage(session sessions.Session, user sessionauth.User, r render.Render) {
 	if user.IsAuthenticated() {
 		r.Redirect(INDEX_PAGE)
 		return
 	}
-	r.HTML(200, REGISTER_PAGE, nil)
+	// a guest keeps their nickname unless they pick another
+	guestName, _ := session.Get(guestNameKey).(string)
+	r.HTML(200, REGISTER_PAGE, page(session, map[string]interface{}{"GuestName": guestName}))
 }
 
-func getEditPage(user sessionauth.User, r render.Render) {
-	r.HTML(200, EDIT_PAGE, user.(*User))
+func getEditPage(session sessions.Session, user sessionauth.User, r render.Render) {
+	r.HTML(200, EDIT_PAGE, page(session, map[string]interface{}{"User": user.(*User)}))
 }
 
-func postEditHandler(user sessionauth.User, editUser User, r render.Render, req *http.Request) {
-	var userInDb User
-	query := rethink.Table("user").Filter(rethink.Row.Field("email").Eq(editUser.Email))
-	row, err := query.RunRow(dbSession)
-	changed := false
-
-	if err == nil && !row.IsNil() {
-		if err := row.Scan(&userInDb); err != nil {
-			r.Redirect(EDIT_PAGE)
-			return
-		}
-	} else {
-		fmt.Println(err)
-		r.Redirect(EDIT_PAGE)
-		return
-	}
+// postEditHandler saves the profile of the logged in user.
+func postEditHandler(session sessions.Session, user sessionauth.User, editUser User, r render.Render, req *http.Request) {
+	userInDb := user.(*User)
+	changes := map[string]interface{}{}
 
 	oldPass := req.PostForm.Get("oldpassword")
 	newPass := req.PostForm.Get("newpassword")
@@ -130,40 +179,68 @@ func postEditHandler(user sessionauth.User, editUser User, r render.Render, req
 		oldPassErr := bcrypt.CompareHashAndPassword([]byte(userInDb.Password), []byte(oldPass))
 		if oldPassErr != nil {
 			fmt.Println("Wrong password.")
+			session.AddFlash("Your current password is wrong.")
 			r.Redirect(EDIT_PAGE)
 			return
 		}
 
-		// Try to compare new passwords between each other
-		pass1Hash, _ := bcrypt.GenerateFromPassword([]byte(newPass), bcrypt.DefaultCost)
-		passErr := bcrypt.CompareHashAndPassword(pass1Hash, []byte(confirmNewPass))
-		if passErr != nil {
+		if newPass != confirmNewPass {
 			fmt.Println("New passwords don't match")
+			session.AddFlash("The new passwords don't match.")
+			r.Redirect(EDIT_PAGE)
+			return
+		}
+		if problem := validatePassword(newPass, userInDb.Email); problem != "" {
+			session.AddFlash(problem)
 			r.Redirect(EDIT_PAGE)
 			return
 		}
-
-		// All good save new password
-		userInDb.Password = string(pass1Hash)
-		changed = true
 	} else if newPass != "" && oldPass == "" {
 		fmt.Println("Need old password to confirm edit.")
+		session.AddFlash("Enter your current password to change it.")
 		r.Redirect(EDIT_PAGE)
 		return
 	}
 
-	// TODO, validate these
 	// If there's a new username, edit it
 	if editUser.Username != "" && userInDb.Username != editUser.Username {
-		userInDb.Username = editUser.Username
-		changed = true
+		if problem := validateUsername(editUser.Username, userInDb.Id); problem != "" {
+			session.AddFlash(problem)
+			r.Redirect(EDIT_PAGE)
+			return
+		}
+		changes["username"] = editUser.Username
 	}
 
 	// Save user info in the db if something changed
-	if changed {
-		rethink.Table("user").Update(userInDb).RunWrite(dbSession)
+	if len(changes) > 0 {
+		if _, err := rethink.Table("user").Get(userInDb.Id).Update(changes).RunWrite(dbSession); err != nil {
+			fmt.Println("Error saving user.", err)
+			session.AddFlash("Couldn't save your profile, try again.")
+			r.Redirect(EDIT_PAGE)
+			return
+		}
 	}
+
+	if newPass != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(newPass), bcrypt.DefaultCost)
+		if err == nil {
+			current, _ := session.Get(sessionIDKey).(string)
+			err = setPassword(userInDb.Id, hash, current)
+		}
+		if err != nil {
+			fmt.Println("Error saving new password.", err)
+			session.AddFlash("Couldn't save your new password, try again.")
+			r.Redirect(EDIT_PAGE)
+			return
+		}
+		// setPassword signs out every session, but not this one
+		session.Set(sessionEpochKey, userInDb.SessionEpoch+1)
+		logAudit(req, userInDb, auditPasswordChange, "user", userInDb.Id, nil)
+	}
+
 	fmt.Println("Edit finished, redirecting...")
+	session.AddFlash("Profile saved.")
 	r.Redirect(EDIT_PAGE)
 }
 
@@ -174,41 +251,74 @@ func postRegisterHandler(session sessions.Session, newUser User, r render.Render
 		return
 	}
 
-	var userInDb User
-	query := rethink.Table("user").Filter(rethink.Row.Field("email").Eq(newUser.Email))
-	row, err := query.RunRow(dbSession)
+	if newUser.Username == "" {
+		newUser.Username, _ = session.Get(guestNameKey).(string)
+	}
 
-	if err == nil && !row.IsNil() {
-		// Register, error case.
-		if err := row.Scan(&userInDb); err != nil {
-			fmt.Println("Error reading DB")
-		} else {
-			fmt.Println("User already exists. Redirecting to login.")
+	problems := []string{}
+	if problem := validateEmail(newUser.Email); problem != "" {
+		problems = append(problems, problem)
+	}
+	if problem := validatePassword(newUser.Password, newUser.Email); problem != "" {
+		problems = append(problems, problem)
+	}
+	if newUser.Password != req.FormValue("confirmpassword") {
+		problems = append(problems, "The passwords don't match.")
+	}
+	if newUser.Username != "" {
+		if problem := validateUsername(newUser.Username, ""); problem != "" {
+			problems = append(problems, problem)
 		}
+	}
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			session.AddFlash(problem)
+		}
+		r.Redirect("/register")
+		return
+	}
 
+	userInDb, err := findUserByEmail(newUser.Email)
+	if err != nil {
+		fmt.Println(err)
+		session.AddFlash("Couldn't register you, try again.")
+		r.Redirect("/register")
+		return
+	}
+	if userInDb != nil {
+		fmt.Println("User already exists. Redirecting to login.")
+		session.AddFlash("There's already an account with that email, log in instead.")
 		r.Redirect(sessionauth.RedirectUrl)
 		return
-	} else { // User doesn't exist, continue with registration.
-		if row.IsNil() {
-			fmt.Println("User doesn't exist. Registering...")
-		} else {
-			fmt.Println(err)
-		}
 	}
+	fmt.Println("User doesn't exist. Registering...")
 
-	// Try to compare passwords
-	pass1Hash, _ := bcrypt.GenerateFromPassword([]byte(newUser.Password), bcrypt.DefaultCost)
-	pass2String := req.FormValue("confirmpassword")
-	passErr := bcrypt.CompareHashAndPassword(pass1Hash, []byte(pass2String))
+	pass1Hash, err := bcrypt.GenerateFromPassword([]byte(newUser.Password), bcrypt.DefaultCost)
+	if err != nil {
+		session.AddFlash("Couldn't register you, try again.")
+		r.Redirect("/register")
+		return
+	}
 
-	if passErr != nil {
-		fmt.Println("Error, passwords don't match.", passErr)
-	} else { // passwords are the same, insert user to db
-		newUser.Password = string(pass1Hash)
-		rethink.Table("user").Insert(newUser).RunWrite(dbSession)
-		fmt.Println("Register done. Try to login.")
+	newUser.Password = string(pass1Hash)
+	newUser.Unverified = true
+	res, err := rethink.Table("user").Insert(newUser).RunWrite(dbSession)
+	if err != nil || len(res.GeneratedKeys) == 0 {
+		fmt.Println("Error inserting user.", err)
+		session.AddFlash("Couldn't register you, try again.")
+		r.Redirect("/register")
+		return
 	}
+	newUser.Id = res.GeneratedKeys[0]
+	if err := sendVerifyMail(&newUser); err != nil {
+		fmt.Println("Error sending verification mail.", err)
+	}
+
+	session.Delete(guestIDKey)
+	session.Delete(guestNameKey)
 
+	fmt.Println("Register done. Try to login.")
+	session.AddFlash("You're registered! Log in, and check your email for a link to verify your account.")
 	r.Redirect(sessionauth.RedirectUrl)
 }
 
@@ -219,34 +329,48 @@ func postLoginHandler(session sessions.Session, userLoggingIn User, r render.Ren
 		return
 	}
 
-	var userInDb User
-	query := rethink.Table("user").Filter(rethink.Row.Field("email").Eq(userLoggingIn.Email))
-	row, err := query.RunRow(dbSession)
+	ip := clientIP(req)
+	if wait, locked := loginWait(userLoggingIn.Email, ip); wait > 0 {
+		fmt.Println("Login attempt too soon after failures.", userLoggingIn.Email, ip)
+		renderLoginWait(session, wait, locked, r)
+		return
+	}
 
-	// TODO do flash errors
-	if err == nil && !row.IsNil() {
-		if err := row.Scan(&userInDb); err != nil {
-			r.Redirect(sessionauth.RedirectUrl)
-			return
-		}
-	} else {
-		fmt.Println(err)
+	userInDb, err := authenticate(userLoggingIn.Email, userLoggingIn.Password)
+	if err != nil {
+		fmt.Println("Login failed.", err)
+		loginFailed(userLoggingIn.Email, ip, "password", err.Error())
+		session.AddFlash("Wrong email or password.")
 		r.Redirect(sessionauth.RedirectUrl)
 		return
 	}
 
-	passErr := bcrypt.CompareHashAndPassword([]byte(userInDb.Password), []byte(userLoggingIn.Password))
-	if passErr != nil {
-		fmt.Println("Wrong Password")
-		r.Redirect(sessionauth.RedirectUrl)
-	} else {
-		err := sessionauth.AuthenticateSession(session, &userInDb)
-		if err != nil {
-			fmt.Println("Wrong Auth")
-			r.JSON(500, err)
-		}
-		params := req.URL.Query()
-		redirect := params.Get(sessionauth.RedirectParam)
-		r.Redirect(redirect)
+	params := req.URL.Query()
+	redirect := params.Get(sessionauth.RedirectParam)
+	if userInDb.TOTPEnabled {
+		// password is right, now the code
+		startSecondFactor(session, userInDb, "password", redirect)
+		r.Redirect("/login/2fa")
+		return
+	}
+	finishLogin(session, userInDb, "password", redirect, r, req)
+}
+
+// finishLogin signs the user in once every login step passed.
+func finishLogin(session sessions.Session, u *User, method, redirect string, r render.Render, req *http.Request) {
+	rotateSession(session)
+	session.Set(sessionEpochKey, u.SessionEpoch)
+	err := sessionauth.AuthenticateSession(session, u)
+	if err != nil {
+		fmt.Println("Wrong Auth")
+		r.JSON(500, err)
+		return
+	}
+	loginSucceeded(u, clientIP(req), method)
+
+	// they came from an invite link, accept it now
+	if token, _ := session.Get(inviteTokenKey).(string); token != "" && redirect == "" {
+		redirect = "/invite/" + token
 	}
+	r.Redirect(redirect)
 }
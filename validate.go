@@ -0,0 +1,86 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	r "github.com/dancannon/gorethink"
+)
+
+const (
+	minPasswordLength = 8
+	// bcrypt ignores anything after 72 bytes
+	maxPasswordLength = 72
+
+	minUsernameLength = 3
+	maxUsernameLength = 20
+)
+
+var (
+	// Not the whole RFC, just enough to catch typos.
+	emailPattern    = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+	usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+)
+
+// validateEmail returns what's wrong with an email, "" if nothing.
+func validateEmail(email string) string {
+	if len(email) > 254 || !emailPattern.MatchString(email) {
+		return "That doesn't look like an email address."
+	}
+	return ""
+}
+
+// validatePassword returns what's wrong with a new password, "" if nothing.
+func validatePassword(password, email string) string {
+	if len(password) < minPasswordLength {
+		return "Passwords need at least 8 characters."
+	}
+	if len(password) > maxPasswordLength {
+		return "Passwords can't be longer than 72 characters."
+	}
+
+	var letter, digit bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLetter(c):
+			letter = true
+		case unicode.IsDigit(c):
+			digit = true
+		}
+	}
+	if !letter || !digit {
+		return "Passwords need at least one letter and one number."
+	}
+	if email != "" && strings.EqualFold(password, email) {
+		return "Your password can't be your email."
+	}
+	return ""
+}
+
+// validateUsername returns what's wrong with a username, "" if nothing.
+// Usernames are unique, ignoring case. userID is who wants it, so keeping
+// your own name isn't a clash.
+func validateUsername(username, userID string) string {
+	if len(username) < minUsernameLength || len(username) > maxUsernameLength {
+		return "Usernames need 3 to 20 characters."
+	}
+	if !usernamePattern.MatchString(username) {
+		return "Usernames can only have letters, numbers, dots, dashes and underscores."
+	}
+	if strings.HasPrefix(strings.ToLower(username), guestNamePrefix) {
+		return "Usernames starting with " + guestNamePrefix + " are for guests."
+	}
+
+	row, err := r.Table("user").
+		Filter(r.Row.Field("username").Default("").Downcase().Eq(strings.ToLower(username)).
+			And(r.Row.Field("id").Ne(userID))).
+		RunRow(dbSession)
+	if err != nil {
+		return "Couldn't check that username, try again."
+	}
+	if !row.IsNil() {
+		return "That username is taken."
+	}
+	return ""
+}
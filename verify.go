@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessionauth"
+	"github.com/martini-contrib/sessions"
+)
+
+var VERIFY_PAGE = "verify"
+
+const (
+	// How long a verification link works for.
+	verifyLinkTTL = 48 * time.Hour
+)
+
+// resendLimit throttles how often a user can ask for a new link.
+var resendLimit = rateLimit{Rate: 1.0 / 60, Burst: 3}
+
+// verifySignature signs a verification link. The email is part of it so
+// a link stops working if the address changes.
+func verifySignature(userID, email string, expires int64) string {
+	mac := hmac.New(sha256.New, appSecret)
+	fmt.Fprintf(mac, "verify|%s|%s|%d", userID, email, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyLink returns a signed link that verifies the user's email.
+func verifyLink(u *User) string {
+	expires := time.Now().Add(verifyLinkTTL).Unix()
+	return fmt.Sprintf("%s/verify?uid=%s&exp=%d&sig=%s",
+		baseURL, u.Id, expires, verifySignature(u.Id, u.Email, expires))
+}
+
+// sendVerifyMail mails the user a link to verify their email.
+func sendVerifyMail(u *User) error {
+	body := "Welcome to ChatGo!\n\n" +
+		"Open this link to verify your email and start chatting:\n\n" + verifyLink(u) + "\n\n" +
+		"If you didn't sign up, ignore this email.\n"
+	return sendMail(u.Email, "Verify your ChatGo email", body)
+}
+
+// checkVerifyLink validates the query of a verification link and returns
+// the user it is for.
+func checkVerifyLink(req *http.Request) (*User, error) {
+	query := req.URL.Query()
+	userID := query.Get("uid")
+
+	expires, err := strconv.ParseInt(query.Get("exp"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return nil, errors.New("verification link expired")
+	}
+
+	var u User
+	if err := u.GetById(userID); err != nil {
+		return nil, err
+	}
+	if u.Id == "" {
+		return nil, errors.New("verification link for unknown user")
+	}
+
+	expected := verifySignature(u.Id, u.Email, expires)
+	if !hmac.Equal([]byte(expected), []byte(query.Get("sig"))) {
+		return nil, errors.New("bad verification link signature")
+	}
+	return &u, nil
+}
+
+//-----------------------------------------------------------------------------
+// HANDLERS
+//-----------------------------------------------------------------------------
+
+// getVerifyHandler - GET /verify, the link from the email.
+func getVerifyHandler(rend render.Render, req *http.Request) {
+	u, err := checkVerifyLink(req)
+	if err != nil {
+		fmt.Println(err)
+		rend.HTML(200, VERIFY_PAGE, map[string]interface{}{"Invalid": true})
+		return
+	}
+
+	if u.Unverified {
+		_, err = r.Table("user").Get(u.Id).Update(map[string]interface{}{"unverified": false}).RunWrite(dbSession)
+		if err != nil {
+			fmt.Println("Error saving verified user.", err)
+			rend.HTML(200, VERIFY_PAGE, map[string]interface{}{"Invalid": true})
+			return
+		}
+		// reconnect so the websocket isn't restricted anymore
+		disconnectUser(u.Id, "email verified")
+	}
+
+	rend.HTML(200, VERIFY_PAGE, map[string]interface{}{"Verified": true})
+}
+
+// postResendVerifyHandler - POST /verify/resend, mails a new link.
+func postResendVerifyHandler(session sessions.Session, user sessionauth.User, rend render.Render) {
+	currUser := user.(*User)
+
+	if !currUser.Unverified {
+		rend.Redirect(INDEX_PAGE)
+		return
+	}
+
+	if ok, _ := limiter.take("resend:"+currUser.Id, resendLimit); !ok {
+		fmt.Println("Too many verification mails for", currUser.Id)
+		session.AddFlash("Too many verification emails, try again in a few minutes.")
+		rend.Redirect(INDEX_PAGE)
+		return
+	}
+
+	if err := sendVerifyMail(currUser); err != nil {
+		fmt.Println("Error sending verification mail.", err)
+	}
+	session.AddFlash("A new verification link is on its way.")
+	rend.Redirect(INDEX_PAGE)
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessionauth"
+	"github.com/martini-contrib/sessions"
+)
+
+var WORKSPACE_PAGE = "workspace"
+
+const (
+	// Users and hubs from before workspaces have no workspace ID, they're
+	// in the default workspace. It has no row in the workspace table.
+	defaultWorkspaceID = ""
+
+	maxWorkspaceName = 64
+)
+
+var errOtherWorkspace = errors.New("hub is in another workspace")
+
+// workspace owns users and hubs. Hub names only have to be unique inside
+// a workspace, and connections only ever join hubs of their own.
+type workspace struct {
+	Id      string          `json:"id" gorethink:"id,omitempty"`
+	Name    string          `json:"name" gorethink:"name"`
+	Admins  map[string]bool `json:"-" gorethink:"admins"`
+	Created time.Time       `json:"created" gorethink:"created"`
+}
+
+func init() {
+	_, err := r.Table("user").IndexCreate("workspace_id").Run(dbSession)
+	fmt.Println("create index user workspace_id error: ", err)
+}
+
+// getWorkspace returns the workspace with the given ID, nil if none.
+func getWorkspace(id string) (*workspace, error) {
+	if id == defaultWorkspaceID {
+		return nil, nil
+	}
+	row, err := r.Table("workspace").Get(id).RunRow(dbSession)
+	if err != nil {
+		return nil, err
+	}
+	if row.IsNil() {
+		return nil, nil
+	}
+	var ws workspace
+	if err := row.Scan(&ws); err != nil {
+		return nil, err
+	}
+	return &ws, nil
+}
+
+// isAdmin reports if u can manage the workspace. Server admins can
+// manage every workspace.
+func (ws *workspace) isAdmin(u *User) bool {
+	return u.Role == roleAdmin || ws.Admins[u.Id]
+}
+
+// newWorkspace creates a workspace with u as its admin and moves u into it.
+func newWorkspace(name string, u *User) (*workspace, error) {
+	ws := &workspace{
+		Name:    name,
+		Admins:  map[string]bool{u.Id: true},
+		Created: time.Now(),
+	}
+	res, err := r.Table("workspace").Insert(ws).RunWrite(dbSession)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.GeneratedKeys) == 0 {
+		return nil, errors.New("no ID for new workspace")
+	}
+	ws.Id = res.GeneratedKeys[0]
+	return ws, moveToWorkspace(u.Id, ws.Id)
+}
+
+// moveToWorkspace puts a user, and their bots, in another workspace. Their
+// saved hubs are all in the old one, so they're forgotten along with their
+// admin rights there and the messages they scheduled for those hubs. Open
+// websockets are closed so they reconnect to the new workspace.
+func moveToWorkspace(userID, workspaceID string) error {
+	var u User
+	row, err := r.Table("user").Get(userID).RunRow(dbSession)
+	if err != nil {
+		return err
+	}
+	if row.IsNil() {
+		return errors.New("no such user")
+	}
+	if err := row.Scan(&u); err != nil {
+		return err
+	}
+
+	move := r.Row.Without("hubs", "last_read").Merge(map[string]interface{}{"workspace_id": workspaceID})
+	if _, err := r.Table("user").Get(userID).Replace(move).RunWrite(dbSession); err != nil {
+		return err
+	}
+	if _, err := r.Table("user").GetAllByIndex("owner_id", userID).Replace(move).RunWrite(dbSession); err != nil {
+		return err
+	}
+	bots, err := listBots(userID)
+	if err != nil {
+		return err
+	}
+
+	ids := []string{userID}
+	for _, bot := range bots {
+		ids = append(ids, bot.Id)
+	}
+	for _, id := range ids {
+		if u.WorkspaceID != workspaceID {
+			if err := leaveWorkspaceHubs(u.WorkspaceID, id); err != nil {
+				return err
+			}
+		}
+		disconnectUser(id, "moved to another workspace")
+	}
+	return nil
+}
+
+// leaveWorkspaceHubs takes away the user's admin rights on the hubs of a
+// workspace, and deletes what they scheduled for those hubs. Reminders
+// aren't tied to a hub, they stay.
+func leaveWorkspaceHubs(workspaceID, userID string) error {
+	_, err := r.Table("hub").
+		Between([]interface{}{workspaceID, r.Minval}, []interface{}{workspaceID, r.Maxval}, r.BetweenOpts{Index: "workspace_name"}).
+		Filter(r.Row.Field("admins").Default(map[string]int{}).HasFields(userID)).
+		Replace(r.Row.Without(map[string]interface{}{"admins": map[string]bool{userID: true}})).
+		RunWrite(dbSession)
+	if err != nil {
+		return err
+	}
+	_, err = r.Table("scheduled").GetAllByIndex("owner_id", userID).
+		Filter(r.Row.HasFields("hub_id")).
+		Delete().RunWrite(dbSession)
+	return err
+}
+
+// dropWorkspaceAdmin takes away the user's admin rights on a workspace.
+func dropWorkspaceAdmin(workspaceID, userID string) error {
+	if workspaceID == defaultWorkspaceID {
+		return nil
+	}
+	_, err := r.Table("workspace").Get(workspaceID).
+		Replace(r.Row.Without(map[string]interface{}{"admins": map[string]bool{userID: true}})).
+		RunWrite(dbSession)
+	return err
+}
+
+// workspaceMembers returns the people in a workspace, without bots.
+func workspaceMembers(workspaceID string) ([]User, error) {
+	rows, err := r.Table("user").GetAllByIndex("workspace_id", workspaceID).
+		Filter(r.Row.Field("bot").Default(false).Eq(false)).
+		Filter(r.Row.HasFields("deleted_at").Not()).
+		OrderBy("email").
+		Run(dbSession)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// workspaceHub returns a hub the user can see, an error if it's in
+// another workspace.
+func workspaceHub(u *User, hubID string) (*hub, error) {
+	hb, err := h.findHub(hubID)
+	if err != nil {
+		return nil, err
+	}
+	if hb.WorkspaceID != u.WorkspaceID {
+		return nil, errOtherWorkspace
+	}
+	return hb, nil
+}
+
+// requireWorkspaceAdmin stops users that can't manage their workspace.
+// The workspace is mapped for the handler.
+func requireWorkspaceAdmin(user sessionauth.User, w http.ResponseWriter, c martini.Context) {
+	u := user.(*User)
+	ws, err := getWorkspace(u.WorkspaceID)
+	if err != nil || ws == nil || !ws.isAdmin(u) {
+		http.Error(w, "workspace admins only", http.StatusForbidden)
+		return
+	}
+	c.Map(ws)
+}
+
+// workspaceTarget loads a member of ws a workspace admin action is about.
+func workspaceTarget(params martini.Params, ws *workspace) (*User, bool) {
+	u, ok := adminTarget(params)
+	if !ok || u.WorkspaceID != ws.Id {
+		return nil, false
+	}
+	return u, true
+}
+
+//-----------------------------------------------------------------------------
+// HANDLERS
+//-----------------------------------------------------------------------------
+
+// getWorkspacePage - GET /workspace, the user's workspace and its members.
+func getWorkspacePage(session sessions.Session, user sessionauth.User, rend render.Render) {
+	u := user.(*User)
+	ws, err := getWorkspace(u.WorkspaceID)
+	if err != nil {
+		fmt.Println("Error loading workspace.", err)
+	}
+
+	data := map[string]interface{}{"User": u}
+
+	hubs, err := inviteHubs(u, ws)
+	if err != nil {
+		fmt.Println("Error listing hubs to invite to.", err)
+	}
+	invites, err := listInvites(u, ws)
+	if err != nil {
+		fmt.Println("Error listing invites.", err)
+	}
+	data["InviteHubs"] = hubs
+	data["Invites"] = invites
+	data["CanInvite"] = len(hubs) > 0 || (ws != nil && ws.isAdmin(u))
+
+	if ws != nil {
+		members, err := workspaceMembers(ws.Id)
+		if err != nil {
+			fmt.Println("Error listing workspace members.", err)
+		}
+		data["Workspace"] = ws
+		data["Members"] = members
+		data["Admin"] = ws.isAdmin(u)
+	}
+	rend.HTML(200, WORKSPACE_PAGE, page(session, data))
+}
+
+// postWorkspaceHandler - POST /workspaces, creates a workspace. Only users
+// in the default workspace can, they become its admin.
+func postWorkspaceHandler(session sessions.Session, user sessionauth.User, rend render.Render, req *http.Request) {
+	u := user.(*User)
+	name := strings.TrimSpace(req.FormValue("name"))
+	if u.WorkspaceID != defaultWorkspaceID {
+		session.AddFlash("Leave your workspace before creating another.")
+		rend.Redirect("/workspace")
+		return
+	}
+	if u.Unverified {
+		session.AddFlash("Verify your email before creating a workspace.")
+		rend.Redirect("/workspace")
+		return
+	}
+	if name == "" || len(name) > maxWorkspaceName {
+		session.AddFlash(fmt.Sprintf("Workspace names are 1 to %d characters.", maxWorkspaceName))
+		rend.Redirect("/workspace")
+		return
+	}
+
+	ws, err := newWorkspace(name, u)
+	if err != nil {
+		fmt.Println("Error creating workspace.", err)
+		session.AddFlash("Couldn't create the workspace, try again.")
+		rend.Redirect("/workspace")
+		return
+	}
+	logAudit(req, u, auditWorkspaceCreate, "workspace", ws.Id, map[string]string{"name": name})
+	session.AddFlash("Workspace created, invite people below.")
+	rend.Redirect("/workspace")
+}
+
+// postLeaveWorkspaceHandler - POST /workspace/leave, back to the default
+// workspace. The last admin can't leave while there are other members.
+func postLeaveWorkspaceHandler(session sessions.Session, user sessionauth.User, rend render.Render, req *http.Request) {
+	u := user.(*User)
+	ws, err := getWorkspace(u.WorkspaceID)
+	if err != nil || ws == nil {
+		rend.Redirect("/workspace")
+		return
+	}
+	if ws.Admins[u.Id] && len(ws.Admins) == 1 {
+		members, err := workspaceMembers(ws.Id)
+		if err != nil || len(members) > 1 {
+			session.AddFlash("Make someone else an admin before you leave.")
+			rend.Redirect("/workspace")
+			return
+		}
+	}
+
+	if err := dropWorkspaceAdmin(ws.Id, u.Id); err == nil {
+		err = moveToWorkspace(u.Id, defaultWorkspaceID)
+	}
+	if err != nil {
+		fmt.Println("Error leaving workspace.", err)
+		session.AddFlash("Couldn't leave the workspace, try again.")
+		rend.Redirect("/workspace")
+		return
+	}
+	logAudit(req, u, auditWorkspaceLeave, "workspace", ws.Id, nil)
+	session.AddFlash("You left " + ws.Name + ".")
+	rend.Redirect("/workspace")
+}
+
+// postRemoveMemberHandler - POST /workspace/members/:id/remove, puts a
+// member back in the default workspace.
+func postRemoveMemberHandler(ws *workspace, params martini.Params, session sessions.Session, user sessionauth.User, rend render.Render, req *http.Request) {
+	target, ok := workspaceTarget(params, ws)
+	if !ok {
+		session.AddFlash("No such member.")
+		rend.Redirect("/workspace")
+		return
+	}
+	if target.Id == user.(*User).Id {
+		session.AddFlash("Use leave to remove yourself.")
+		rend.Redirect("/workspace")
+		return
+	}
+
+	err := dropWorkspaceAdmin(ws.Id, target.Id)
+	if err == nil {
+		err = moveToWorkspace(target.Id, defaultWorkspaceID)
+	}
+	if err != nil {
+		fmt.Println("Error removing workspace member.", err)
+		session.AddFlash("Couldn't remove them, try again.")
+		rend.Redirect("/workspace")
+		return
+	}
+	logAudit(req, user.(*User), auditWorkspaceRemove, "user", target.Id, map[string]string{"workspace": ws.Id})
+	session.AddFlash(target.Email + " was removed.")
+	rend.Redirect("/workspace")
+}
+
+// postWorkspaceAdminHandler - POST /workspace/members/:id/admin and
+// /unadmin. An admin can't take away their own rights.
+func postWorkspaceAdminHandler(admin bool) martini.Handler {
+	return func(ws *workspace, params martini.Params, session sessions.Session, user sessionauth.User, rend render.Render, req *http.Request) {
+		target, ok := workspaceTarget(params, ws)
+		if !ok {
+			session.AddFlash("No such member.")
+			rend.Redirect("/workspace")
+			return
+		}
+		if !admin && target.Id == user.(*User).Id {
+			session.AddFlash("Another admin has to do that.")
+			rend.Redirect("/workspace")
+			return
+		}
+
+		var err error
+		if admin {
+			_, err = r.Table("workspace").Get(ws.Id).Update(map[string]interface{}{
+				"admins": map[string]bool{target.Id: true},
+			}).RunWrite(dbSession)
+		} else {
+			err = dropWorkspaceAdmin(ws.Id, target.Id)
+		}
+		if err != nil {
+			fmt.Println("Error changing workspace admins.", err)
+			session.AddFlash("Couldn't change that, try again.")
+			rend.Redirect("/workspace")
+			return
+		}
+		logAudit(req, user.(*User), auditWorkspaceAdmin, "user", target.Id, map[string]string{
+			"workspace": ws.Id,
+			"admin":     fmt.Sprint(admin),
+		})
+		rend.Redirect("/workspace")
+	}
+}